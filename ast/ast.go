@@ -8,6 +8,7 @@
 package ast
 
 import (
+	"bytes"
 	"go/ast"
 	"strings"
 
@@ -1007,6 +1008,7 @@ type (
 		Path    *BasicLit     // import path
 		Comment *CommentGroup // line comments; or nil
 		EndPos  token.Pos     // end of spec (overrides Path.Pos if nonzero)
+		Kind    ImportKind    // kind of the imported package; or ImportUnknown
 	}
 
 	// A ValueSpec node represents a constant or variable declaration
@@ -1190,29 +1192,109 @@ type File struct {
 	Code         []byte
 	NoEntrypoint bool      // no `main` or `init` func to indicate the module entry point.
 	NoPkgDecl    bool      // no `package xxx` declaration
+	PkgDeclLen   int       // length of the package clause injected at the beginning of Code if NoPkgDecl; or 0
 	NoEntry_     *NoEntry_ // to be removed
 	FileType     FileType
+	FileStart    token.Pos  // start of entire file (position of the first byte of Code)
+	Features     FeatureSet // Go+ specific features used by the file
 }
 
 type NoEntry_ struct {
-	Entry string
-	Line  int
-	Size  int
+	Entry  string
+	Line   int
+	Size   int
+	Offset int    // offset in Code of the injected entrypoint
+	Recv   string // receiver of the injected entrypoint (such as `this *T`); or ""
+
+	// EntryPos and EntryEnd delimit the injected header of the entrypoint
+	// (such as ` func main(){`), and Rbrace is the position of the injected
+	// closing brace, so that an editor can hide or fold them.
+	EntryPos, EntryEnd token.Pos
+	Rbrace             token.Pos
+
+	// LastExprPos is the position of the expression of the last statement of
+	// the entrypoint if it is an expression statement (such as `x + 1`), so
+	// that a REPL can capture its value; token.NoPos otherwise. It is only
+	// set in parser.ParseCaptureLast mode.
+	LastExprPos token.Pos
 }
 
 func (f *File) AdjustPos_(pos token.Position) (token.Position, bool) {
 	var changed bool
-	if f.NoPkgDecl && pos.Line == 1 {
-		pos.Column -= 13 //package main;
+	if n := len(f.Code) - 2; f.NoEntrypoint && pos.Offset > n && n >= 0 && f.Code[n] == '\n' {
+		// in the injected "\n}" (or at EOF): the end of the original source,
+		// where the injected newline starts
+		pos.Line--
+		pos.Column = n - bytes.LastIndexByte(f.Code[:n], '\n')
+		pos.Offset = n
 		changed = true
 	}
-	if f.NoEntrypoint && pos.Line == f.NoEntry_.Line {
-		pos.Column -= f.NoEntry_.Size
+	if f.NoEntrypoint && f.sameLine(f.NoEntry_.Offset, pos.Offset) {
+		e := f.NoEntry_
+		if pos.Offset >= e.Offset+e.Size {
+			pos.Column -= e.Size
+			changed = true
+		} else if pos.Offset > e.Offset { // inside the injected entrypoint
+			pos.Column -= pos.Offset - e.Offset
+			changed = true
+		}
+	}
+	if f.NoPkgDecl && f.sameLine(0, pos.Offset) {
+		pos.Column -= f.PkgDeclLen
+		if pos.Column < 1 {
+			pos.Column = 1
+		}
+		changed = true
+	}
+	if offset := f.origOffset(pos.Offset); offset != pos.Offset {
+		pos.Offset = offset
 		changed = true
 	}
 	return pos, changed
 }
 
+// sameLine reports whether offset is on the line of Code that starts before
+// (or at) from, whatever the line numbers reported for them (see
+// token.File.AddLineColumnInfo).
+func (f *File) sameLine(from, offset int) bool {
+	if offset > len(f.Code) {
+		offset = len(f.Code)
+	}
+	return offset >= from && bytes.IndexByte(f.Code[from:offset], '\n') < 0
+}
+
+// ByteOffset returns the byte offset of the position pos of f in the original
+// source, i.e. without the text injected for a missing package clause or
+// entrypoint (see NoPkgDecl and NoEntrypoint). A position inside injected
+// text maps to the point of injection.
+func (f *File) ByteOffset(pos token.Pos) int {
+	return f.origOffset(int(pos - f.FileStart))
+}
+
+func (f *File) origOffset(offset int) int {
+	n := len(f.Code)
+	if f.NoEntrypoint {
+		e := f.NoEntry_
+		if offset >= e.Offset+e.Size {
+			offset -= e.Size
+		} else if offset > e.Offset {
+			offset = e.Offset
+		}
+		n -= e.Size + 2 // " func main(){" ... "\n}"
+	}
+	if f.NoPkgDecl {
+		offset -= f.PkgDeclLen
+		if offset < 0 {
+			offset = 0
+		}
+		n -= f.PkgDeclLen
+	}
+	if offset > n {
+		offset = n
+	}
+	return offset
+}
+
 const (
 	FileTypeGo  = -1 // .go (should be negative)
 	FileTypeGop = 0  // .gop
@@ -218,3 +218,78 @@ func (p *RangeExpr) End() token.Pos {
 func (*RangeExpr) exprNode() {}
 
 // -----------------------------------------------------------------------------
+
+// A RawBlock node represents a `kind { ... }` block of an embedded language.
+// Its content isn't parsed as Go+ but kept as raw text.
+type RawBlock struct {
+	KindPos token.Pos // position of Kind
+	Kind    string    // kind of the block, such as `shader`
+	Lbrace  token.Pos // position of "{"
+	Text    string    // raw text between the braces, starting at Lbrace+1
+	Rbrace  token.Pos // position of "}"
+}
+
+// Pos - position of first character belonging to the node
+func (p *RawBlock) Pos() token.Pos {
+	return p.KindPos
+}
+
+// End - position of first character immediately after the node
+func (p *RawBlock) End() token.Pos {
+	return p.Rbrace + 1
+}
+
+func (*RawBlock) declNode() {}
+
+// -----------------------------------------------------------------------------
+
+// A FeatureSet is a set of Go+ specific features used by a file, recorded by
+// the parser in File.Features.
+type FeatureSet uint32
+
+const (
+	// FeatureCommandCall - a call without parentheses: `println "Hi"`
+	FeatureCommandCall FeatureSet = 1 << iota
+	// FeatureOperator - an operator method: `func (a T) + (b T) T`
+	FeatureOperator
+	// FeatureSliceLit - a slice literal without type: `[1, 2, 3]`
+	FeatureSliceLit
+	// FeatureLambda - a lambda expression: `x => x * x`
+	FeatureLambda
+	// FeatureComprehension - a list or map comprehension: `[x*x for x <- a]`
+	FeatureComprehension
+	// FeatureForPhrase - a `for x <- container` loop
+	FeatureForPhrase
+	// FeatureRangeExpr - a range expression: `1:10:2`
+	FeatureRangeExpr
+	// FeatureErrWrap - an error wrapping expression: `expr!`, `expr?` or `expr?:val`
+	FeatureErrWrap
+	// FeatureRatLit - a rational literal: `1r`
+	FeatureRatLit
+	// FeatureRawBlock - a raw block of an embedded language (see RawBlock)
+	FeatureRawBlock
+)
+
+// Has reports whether all features of x are in fs.
+func (fs FeatureSet) Has(x FeatureSet) bool {
+	return fs&x == x
+}
+
+// -----------------------------------------------------------------------------
+
+// ImportKind classifies the package of an import spec. It is set by the
+// classifier configured for the parser.
+type ImportKind int
+
+const (
+	// ImportUnknown - the import isn't classified
+	ImportUnknown ImportKind = iota
+	// ImportStd - a package of the standard library
+	ImportStd
+	// ImportLocal - a package of the current module
+	ImportLocal
+	// ImportThirdParty - a package of another module
+	ImportThirdParty
+)
+
+// -----------------------------------------------------------------------------
@@ -497,6 +497,6 @@ func MergePackageFiles(pkg *Package, mode MergeMode) *File {
 	// TODO(gri) need to compute unresolved identifiers!
 	return &File{
 		doc, pos, NewIdent(pkg.Name), decls, pkg.Scope,
-		imports, nil, comments, nil, false, false, nil, FileTypeGop,
+		imports, nil, comments, nil, false, false, 0, nil, FileTypeGop, token.NoPos, 0,
 	}
 }
@@ -50,9 +50,9 @@ func RegisterClassFileType(extGmx, extSpx string, pkgPaths ...string) {
 	if pkgPaths == nil {
 		panic("RegisterClassFileType: no pkgPath specified")
 	}
-	parser.RegisterFileType(extGmx, ast.FileTypeGmx)
+	parser.MustRegisterFileType(extGmx, ast.FileTypeGmx)
 	if extSpx != "" {
-		parser.RegisterFileType(extSpx, ast.FileTypeSpx)
+		parser.MustRegisterFileType(extSpx, ast.FileTypeSpx)
 	}
 	if _, ok := gmxTypes[extGmx]; !ok {
 		gmxTypes[extGmx] = gmxInfo{extSpx, pkgPaths}
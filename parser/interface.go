@@ -32,6 +32,47 @@ const (
 	AllErrors
 	// ParseGoFiles - parse *.go files
 	ParseGoFiles
+	// ParseCaptureLast - record the last expression statement of a headless
+	// script in NoEntry_.LastExprPos, so that its value can be captured
+	ParseCaptureLast
+	// ParseDetailedErrors - return a *DetailedErrorList (instead of a
+	// scanner.ErrorList) holding an ErrorDetail for each error
+	ParseDetailedErrors
+	// ParseWarnDeprecated - report each use of deprecated syntax to
+	// Config.Warn (see CategoryDeprecated)
+	ParseWarnDeprecated
+	// DisableAutoEntry - don't wrap the statements of a headless script into
+	// an entrypoint function: report the "expected declaration" error instead
+	DisableAutoEntry
+	// DisableAutoPkgDecl - don't inject `package main` into a file without
+	// package clause: report the "expected 'package'" error instead
+	DisableAutoPkgDecl
+	// StripShebang - if the extension of a file is unknown and its source
+	// starts with a `#!` line (an executable script), blank out that line and
+	// parse the file as a .gop one; line numbers are kept
+	StripShebang
+	// ParseTestFiles - group the test files (*_test.gop) of a directory apart
+	// from the other files: the package keyed "name_test" holds the test files
+	// of package name, whether they declare package name or name_test. By
+	// default, test files are grouped by the package they declare
+	ParseTestFiles
+	// RecoverErrors - if a file has syntax errors, return its partial AST
+	// along with the errors, positioned in the file set and with its metadata
+	// (NoPkgDecl, NoEntrypoint, FileType...) set, so that tools can still walk
+	// it (e.g. to show an outline)
+	RecoverErrors
+	// StrictFileType - report an error for a file whose extension isn't the
+	// one of a Go+ file type (see ErrUnknownFileType), instead of parsing it
+	// as a .gop file. Directories only hold files of such types anyway
+	StrictFileType
+	// DeclarationsOnly - skip the function bodies (including the ones of
+	// function literals) instead of parsing them, e.g. to index the top-level
+	// declarations of large files quickly: each body is an empty block keeping
+	// the positions of its braces, and errors inside bodies aren't reported.
+	// The package clause and entrypoint of a headless script are still
+	// detected, since its statements are outside of function bodies until
+	// they're wrapped, but the body of the injected entrypoint is empty too
+	DeclarationsOnly
 )
 
 // ParseFile parses the source code of a single Go source file and returns
@@ -40,9 +81,18 @@ const (
 //
 // If src != nil, ParseFile parses the source from src and the filename is
 // only used when recording position information. The type of the argument
-// for the src parameter must be string, []byte, or io.Reader.
+// for the src parameter must be string, []byte, or io.Reader. An io.ReaderAt
+// that also has a `Size() int64` method (such as *io.SectionReader) is read
+// with a single buffer of the exact size, instead of a growing one.
+// The source is parsed from that buffer as is: it is only copied if a package
+// clause or an entrypoint has to be injected (see ast.File.NoPkgDecl and
+// ast.File.NoEntrypoint).
 // If src == nil, ParseFile parses the file specified by filename.
 //
+// A leading UTF-8 byte order mark is stripped: positions are relative to the
+// source without it, as an editor shows them. CRLF line endings are kept as
+// is: a '\r' before a newline changes neither line nor column numbers.
+//
 // The mode parameter controls the amount of source text parsed and other
 // optional parser functionality. Position information is recorded in the
 // file set fset, which must not be nil.
@@ -53,7 +103,7 @@ const (
 // representing the fragments of erroneous source code). Multiple errors
 // are returned via a scanner.ErrorList which is sorted by source position.
 //
-func parseFile(fset *token.FileSet, filename string, src interface{}, mode Mode) (f *ast.File, err error) {
+func parseFile(fset *token.FileSet, filename string, src interface{}, mode Mode, cfg *Config) (f *ast.File, err error) {
 	if fset == nil {
 		panic("parser.ParseFile: no token.FileSet provided (fset == nil)")
 	}
@@ -84,22 +134,25 @@ func parseFile(fset *token.FileSet, filename string, src interface{}, mode Mode)
 			}
 		}
 		f.Code = text
+		f.FileStart = token.Pos(p.file.Base())
 
 		p.errors.Sort()
 		err = p.errors.Err()
+		if err != nil && mode&ParseDetailedErrors != 0 {
+			err = newDetailedErrorList(p.errors, p.details)
+		}
 	}()
 
 	// parse source
-	p.init(fset, filename, text, mode)
+	p.init(fset, filename, text, mode, cfg)
 	f = p.parseFile()
 
 	return
 }
 
-/*
 // ParseExprFrom is a convenience function for parsing an expression.
 // The arguments have the same meaning as for ParseFile, but the source must
-// be a valid Go (type or value) expression. Specifically, fset must not
+// be a valid Go+ (type or value) expression. Specifically, fset must not
 // be nil.
 //
 // If the source couldn't be read, the returned AST is nil and the error
@@ -108,7 +161,7 @@ func parseFile(fset *token.FileSet, filename string, src interface{}, mode Mode)
 // representing the fragments of erroneous source code). Multiple errors
 // are returned via a scanner.ErrorList which is sorted by source position.
 //
-func parseExprFrom(fset *token.FileSet, filename string, src interface{}, mode Mode) (expr ast.Expr, err error) {
+func ParseExprFrom(fset *token.FileSet, filename string, src interface{}, mode Mode) (expr ast.Expr, err error) {
 	if fset == nil {
 		panic("parser.ParseExprFrom: no token.FileSet provided (fset == nil)")
 	}
@@ -129,10 +182,13 @@ func parseExprFrom(fset *token.FileSet, filename string, src interface{}, mode M
 		}
 		p.errors.Sort()
 		err = p.errors.Err()
+		if err != nil && mode&ParseDetailedErrors != 0 {
+			err = newDetailedErrorList(p.errors, p.details)
+		}
 	}()
 
 	// parse expr
-	p.init(fset, filename, text, mode)
+	p.init(fset, filename, text, mode, &Config{Mode: mode})
 	// Set up pkg-level scopes to avoid nil-pointer errors.
 	// This is not needed for a correct expression x as the
 	// parser will be ok with a nil topScope, but be cautious
@@ -153,15 +209,15 @@ func parseExprFrom(fset *token.FileSet, filename string, src interface{}, mode M
 	return
 }
 
-// ParseExpr is a convenience function for obtaining the AST of an expression x.
-// The position information recorded in the AST is undefined. The filename used
+// ParseExpr is a convenience function for obtaining the AST of a Go+
+// expression x, such as a snippet typed in a REPL or a template. The positions
+// recorded in the AST are relative to x, with a file set of its own. The filename used
 // in error messages is the empty string.
 //
 // If syntax errors were found, the result is a partial AST (with ast.Bad* nodes
 // representing the fragments of erroneous source code). Multiple errors are
 // returned via a scanner.ErrorList which is sorted by source position.
 //
-func parseExpr(x string) (ast.Expr, error) {
-	return parseExprFrom(token.NewFileSet(), "", x, 0)
+func ParseExpr(x string) (ast.Expr, error) {
+	return ParseExprFrom(token.NewFileSet(), "", x, 0)
 }
-*/
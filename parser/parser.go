@@ -32,13 +32,21 @@ import (
 type parser struct {
 	file    *token.File
 	errors  scanner.ErrorList
+	details []*ErrorDetail // in ParseDetailedErrors mode
 	scanner scanner.Scanner
 
+	maxErrors int                                  // see Config.MaxErrors
+	onError   func(pos token.Position, msg string) // see Config.onError
+
 	// Tracing/debugging
 	mode   Mode // parsing mode
 	trace  bool // == (mode & Trace != 0)
 	indent int  // indentation used for tracing output
 
+	debugOutput bool        // see DbgFlagParseOutput
+	debugError  bool        // see DbgFlagParseError
+	logger      *log.Logger // debug output
+
 	// Comments
 	comments    []*ast.CommentGroup
 	leadComment *ast.CommentGroup // last lead comment
@@ -61,6 +69,12 @@ type parser struct {
 	syncPos token.Pos // last synchronization position
 	syncCnt int       // number of parser.advance calls without progress
 
+	// Kinds of the raw blocks of embedded languages
+	rawBlocks map[string]bool
+
+	// Go+ specific features used by the file
+	features ast.FeatureSet
+
 	// Non-syntactic parser control
 	exprLev int  // < 0: in control clause, >= 0: in expression
 	inRHS   bool // if set, the parser is parsing a rhs expression
@@ -77,17 +91,28 @@ type parser struct {
 	targetStack [][]*ast.Ident // stack of unresolved labels
 }
 
-func (p *parser) init(fset *token.FileSet, filename string, src []byte, mode Mode) {
+func (p *parser) init(fset *token.FileSet, filename string, src []byte, mode Mode, cfg *Config) {
 	p.file = fset.AddFile(filename, -1, len(src))
+	setOrigin(p.file, filename, cfg)
 	var m scanner.Mode
 	if mode&ParseComments != 0 {
 		m = scanner.ScanComments
 	}
-	eh := func(pos token.Position, msg string) { p.errors.Add(pos, msg) }
+	eh := func(pos token.Position, msg string) {
+		p.addError(pos, msg)
+		if p.mode&ParseDetailedErrors != 0 {
+			p.details = append(p.details, &ErrorDetail{Pos: pos, Msg: msg, Kind: ErrorKindScanner})
+		}
+	}
 	p.scanner.Init(p.file, src, eh, m)
+	p.scanner.KeywordAliases = cfg.KeywordAliases
+	p.rawBlocks = lookupRawBlocks(filename)
 
 	p.mode = mode
 	p.trace = mode&Trace != 0 // for convenience (p.trace is used frequently)
+	p.maxErrors = cfg.MaxErrors
+	p.onError = cfg.onError
+	p.initDebug(cfg)
 
 	p.next()
 }
@@ -370,25 +395,56 @@ func (p *parser) next() {
 type bailout struct{}
 
 func (p *parser) error(pos token.Pos, msg string) {
+	p.errorDetail(pos, msg, ErrorKindOther, nil)
+}
+
+// errorDetail is like error, but also records an ErrorDetail of the given
+// kind in ParseDetailedErrors mode.
+func (p *parser) errorDetail(pos token.Pos, msg string, kind ErrorKind, expected []token.Token) {
 	epos := p.file.Position(pos)
 
 	// If AllErrors is not set, discard errors reported on the same line
 	// as the last recorded error and stop parsing if there are more than
-	// 10 errors.
+	// 10 errors. Stop parsing anyway after Config.MaxErrors errors.
+	n := len(p.errors)
 	if p.mode&AllErrors == 0 {
-		n := len(p.errors)
 		if n > 0 && p.errors[n-1].Pos.Line == epos.Line {
 			return // discard - likely a spurious error
 		}
-		if n > 10 {
+		if p.maxErrors <= 0 && n > 10 {
 			panic(bailout{})
 		}
 	}
+	if p.maxErrors > 0 && n >= p.maxErrors {
+		panic(bailout{})
+	}
+
+	p.addError(epos, msg)
+	if p.mode&ParseDetailedErrors != 0 {
+		detail := &ErrorDetail{Pos: epos, Msg: msg, Kind: kind, Expected: expected}
+		if pos == p.pos {
+			detail.Found, detail.Lit = p.tok, p.lit
+		}
+		p.details = append(p.details, detail)
+	}
+}
 
-	p.errors.Add(epos, msg)
+// addError records an error, and passes it to p.onError unless MaxErrors
+// errors were reported already.
+func (p *parser) addError(pos token.Position, msg string) {
+	p.errors.Add(pos, msg)
+	if p.onError != nil && (p.maxErrors <= 0 || len(p.errors) <= p.maxErrors) {
+		p.onError(pos, msg)
+	}
 }
 
 func (p *parser) errorExpected(pos token.Pos, msg string, calldepth int) {
+	p.errorExpectedTok(pos, msg, nil, calldepth+1)
+}
+
+// errorExpectedTok is like errorExpected, expected lists the tokens that would
+// have been accepted at pos, if known.
+func (p *parser) errorExpectedTok(pos token.Pos, msg string, expected []token.Token, calldepth int) {
 	msg = "expected " + msg
 	if pos == p.pos {
 		// the error happened at the current position;
@@ -403,16 +459,16 @@ func (p *parser) errorExpected(pos token.Pos, msg string, calldepth int) {
 			msg += ", found '" + p.tok.String() + "'"
 		}
 	}
-	if debugParseError {
-		log.Std.Output("", log.Linfo, calldepth, msg)
+	if p.debugError {
+		p.logger.Output("", log.Linfo, calldepth, msg)
 	}
-	p.error(pos, msg)
+	p.errorDetail(pos, msg, ErrorKindExpected, expected)
 }
 
 func (p *parser) expect(tok token.Token) token.Pos {
 	pos := p.pos
 	if p.tok != tok {
-		p.errorExpected(pos, "'"+tok.String()+"'", 3)
+		p.errorExpectedTok(pos, "'"+tok.String()+"'", []token.Token{tok}, 3)
 	}
 	p.next() // make progress
 	return pos
@@ -424,7 +480,7 @@ func (p *parser) expect2(tok token.Token) (pos token.Pos) {
 	if p.tok == tok {
 		pos = p.pos
 	} else {
-		p.errorExpected(p.pos, "'"+tok.String()+"'", 3)
+		p.errorExpectedTok(p.pos, "'"+tok.String()+"'", []token.Token{tok}, 3)
 	}
 	p.next() // make progress
 	return
@@ -447,12 +503,12 @@ func (p *parser) expectSemi() {
 		switch p.tok {
 		case token.COMMA:
 			// permit a ',' instead of a ';' but complain
-			p.errorExpected(p.pos, "';'", 3)
+			p.errorExpectedTok(p.pos, "';'", []token.Token{token.SEMICOLON}, 3)
 			fallthrough
 		case token.SEMICOLON:
 			p.next()
 		default:
-			p.errorExpected(p.pos, "';'", 3)
+			p.errorExpectedTok(p.pos, "';'", []token.Token{token.SEMICOLON}, 3)
 			p.advance(stmtStart)
 		}
 	}
@@ -468,9 +524,9 @@ func (p *parser) atComma(context string, follow token.Token) bool {
 			msg += " before newline"
 		}
 		msgctx := msg + " in " + context
-		p.error(p.pos, msgctx)
-		if debugParseError {
-			log.Std.Output("", log.Linfo, 2, msgctx)
+		p.errorDetail(p.pos, msgctx, ErrorKindMissingComma, []token.Token{token.COMMA, follow})
+		if p.debugError {
+			p.logger.Output("", log.Linfo, 2, msgctx)
 			panic(msgctx)
 		}
 		return true // "insert" comma and continue
@@ -576,8 +632,8 @@ func (p *parser) parseIdentOrOp() (*ast.Ident, bool) { // function Name
 			pos := p.pos
 			tok := p.tok
 			p.next()
-			if debugParseOutput {
-				log.Printf("ast.Ident{Tok: %v}\n", tok)
+			if p.debugOutput {
+				p.logger.Printf("ast.Ident{Tok: %v}\n", tok)
 			}
 			return &ast.Ident{NamePos: pos, Name: tok.String()}, true
 		}
@@ -647,8 +703,8 @@ func (p *parser) parseIdent() *ast.Ident {
 	} else {
 		p.expect(token.IDENT) // use expect() error handling
 	}
-	if debugParseOutput {
-		log.Printf("ast.Ident{Name: %v}\n", name)
+	if p.debugOutput {
+		p.logger.Printf("ast.Ident{Name: %v}\n", name)
 	}
 	return &ast.Ident{NamePos: pos, Name: name}
 }
@@ -798,15 +854,17 @@ func (p *parser) parseArrayTypeOrSliceLit(state int, slice ast.Expr) (expr ast.E
 			switch p.tok {
 			case token.COMMA: // [a, b, c, d ...]
 				sliceLit := p.parseSliceLit(lbrack, len)
+				p.features |= ast.FeatureSliceLit
 				p.exprLev--
 				return sliceLit, resultSliceLit
 			case token.FOR: // [expr for k, v <- container, cond]
 				phrases := p.parseForPhrases()
 				p.exprLev--
 				rbrack := p.expect(token.RBRACK)
-				if debugParseOutput {
-					log.Printf("ast.ComprehensionExpr{Tok: [, Elt: %v, Fors: %v}\n", len, phrases)
+				if p.debugOutput {
+					p.logger.Printf("ast.ComprehensionExpr{Tok: [, Elt: %v, Fors: %v}\n", len, phrases)
 				}
+				p.features |= ast.FeatureComprehension
 				return &ast.ComprehensionExpr{
 					Lpos: lbrack, Tok: token.LBRACK, Elt: len,
 					Fors: phrases, Rpos: rbrack,
@@ -831,9 +889,10 @@ func (p *parser) parseArrayTypeOrSliceLit(state int, slice ast.Expr) (expr ast.E
 		elt, result = p.tryIdentOrType(stateTypeOrSliceOp, sliceLit)
 		switch result {
 		case resultNone:
-			if debugParseOutput {
-				log.Printf("ast.SliceLit{Elts: %v}\n", sliceLit.Elts)
+			if p.debugOutput {
+				p.logger.Printf("ast.SliceLit{Elts: %v}\n", sliceLit.Elts)
 			}
+			p.features |= ast.FeatureSliceLit
 			return sliceLit, resultSliceLit
 		case resultSliceOp:
 			return elt, resultSliceOp
@@ -845,8 +904,8 @@ func (p *parser) parseArrayTypeOrSliceLit(state int, slice ast.Expr) (expr ast.E
 			if len == nil {
 				log.Panicln("TODO: expect slice index")
 			}
-			if debugParseOutput {
-				log.Printf("ast.IndexExpr{X: %v, Index: %v}\n", slice, len)
+			if p.debugOutput {
+				p.logger.Printf("ast.IndexExpr{X: %v, Index: %v}\n", slice, len)
 			}
 			return &ast.IndexExpr{X: slice, Index: len}, resultSliceOp
 		}
@@ -854,8 +913,8 @@ func (p *parser) parseArrayTypeOrSliceLit(state int, slice ast.Expr) (expr ast.E
 		panic("parseArrayTypeOrSliceLit: unexpected state")
 	}
 
-	if debugParseOutput {
-		log.Printf("ast.ArrayType{Len: %v, Elt: %v}\n", len, elt)
+	if p.debugOutput {
+		p.logger.Printf("ast.ArrayType{Len: %v, Elt: %v}\n", len, elt)
 	}
 	return &ast.ArrayType{Lbrack: lbrack, Len: len, Elt: elt}, resultArrayType
 }
@@ -872,8 +931,8 @@ func (p *parser) parseSliceLit(lbrack token.Pos, len ast.Expr) ast.Expr {
 	}
 	rbrack := p.expect(token.RBRACK)
 
-	if debugParseOutput {
-		log.Printf("ast.SliceLit{Elts: %v}\n", elts)
+	if p.debugOutput {
+		p.logger.Printf("ast.SliceLit{Elts: %v}\n", elts)
 	}
 	return &ast.SliceLit{Lbrack: lbrack, Elts: elts, Rbrack: rbrack}
 }
@@ -1291,6 +1350,10 @@ func (p *parser) parseBody(scope *ast.Scope) *ast.BlockStmt {
 		defer un(trace(p, "Body"))
 	}
 
+	if p.mode&DeclarationsOnly != 0 {
+		return p.skipBody()
+	}
+
 	lbrace := p.expect(token.LBRACE)
 	p.topScope = scope // open function scope
 	p.openLabelScope()
@@ -1380,8 +1443,11 @@ func (p *parser) parseOperand(lhs, allowTuple bool) ast.Expr {
 
 	case token.STRING, token.INT, token.FLOAT, token.IMAG, token.CHAR, token.RAT:
 		x := &ast.BasicLit{ValuePos: p.pos, Kind: p.tok, Value: p.lit}
-		if debugParseOutput {
-			log.Printf("ast.BasicLit{Kind: %v, Value: %v}\n", p.tok, p.lit)
+		if p.tok == token.RAT {
+			p.features |= ast.FeatureRatLit
+		}
+		if p.debugOutput {
+			p.logger.Printf("ast.BasicLit{Kind: %v, Value: %v}\n", p.tok, p.lit)
 		}
 		p.next()
 		return x
@@ -1409,8 +1475,8 @@ func (p *parser) parseOperand(lhs, allowTuple bool) ast.Expr {
 		}
 		p.exprLev--
 		rparen := p.expect(token.RPAREN)
-		if debugParseOutput {
-			log.Printf("ast.ParenExpr{X: %v}\n", x)
+		if p.debugOutput {
+			p.logger.Printf("ast.ParenExpr{X: %v}\n", x)
 		}
 		return &ast.ParenExpr{Lparen: lparen, X: x, Rparen: rparen}
 
@@ -1528,14 +1594,14 @@ func (p *parser) parseIndexOrSliceContinue(x ast.Expr, lbrack token.Pos, idx ast
 				index[2] = &ast.BadExpr{From: colons[1] + 1, To: rbrack}
 			}
 		}
-		if debugParseOutput {
-			log.Printf("ast.SliceExpr{X: %v, Low: %v, High: %v, Max: %v, Slice3: %v}\n", x, index[0], index[1], index[2], slice3)
+		if p.debugOutput {
+			p.logger.Printf("ast.SliceExpr{X: %v, Low: %v, High: %v, Max: %v, Slice3: %v}\n", x, index[0], index[1], index[2], slice3)
 		}
 		return &ast.SliceExpr{X: x, Lbrack: lbrack, Low: index[0], High: index[1], Max: index[2], Slice3: slice3, Rbrack: rbrack}
 	}
 
-	if debugParseOutput {
-		log.Printf("ast.IndexExpr{X: %v, Index: %v}\n", x, index[0])
+	if p.debugOutput {
+		p.logger.Printf("ast.IndexExpr{X: %v, Index: %v}\n", x, index[0])
 	}
 	return &ast.IndexExpr{X: x, Lbrack: lbrack, Index: index[0], Rbrack: rbrack}
 }
@@ -1573,11 +1639,12 @@ func (p *parser) parseCallOrConversion(fun ast.Expr, isCmd bool) *ast.CallExpr {
 	var noParenEnd token.Pos
 	if isCmd {
 		noParenEnd = p.pos
+		p.features |= ast.FeatureCommandCall
 	} else {
 		rparen = p.expectClosing(token.RPAREN, "argument list")
 	}
-	if debugParseOutput {
-		log.Printf("ast.CallExpr{Fun: %v, Ellipsis: %v, isCmd: %v}\n", fun, ellipsis != 0, isCmd)
+	if p.debugOutput {
+		p.logger.Printf("ast.CallExpr{Fun: %v, Ellipsis: %v, isCmd: %v}\n", fun, ellipsis != 0, isCmd)
 	}
 	return &ast.CallExpr{
 		Fun: fun, Lparen: lparen, Args: list, Ellipsis: ellipsis, Rparen: rparen, NoParenEnd: noParenEnd}
@@ -1672,6 +1739,7 @@ func (p *parser) parseElementListOrComprehension() (list []ast.Expr, mce *ast.Co
 
 	if p.tok == token.FOR {
 		phrases := p.parseForPhrases()
+		p.features |= ast.FeatureComprehension
 		return nil, &ast.ComprehensionExpr{Fors: phrases}
 	}
 	for p.tok != token.RBRACE && p.tok != token.EOF {
@@ -1681,6 +1749,7 @@ func (p *parser) parseElementListOrComprehension() (list []ast.Expr, mce *ast.Co
 				log.Panicln("TODO: invalid comprehension: too may elements.")
 			}
 			phrases := p.parseForPhrases()
+			p.features |= ast.FeatureComprehension
 			return nil, &ast.ComprehensionExpr{Elt: list[0], Fors: phrases}
 		}
 		if !p.atComma("composite literal", token.RBRACE) {
@@ -1968,10 +2037,12 @@ func (p *parser) parseErrWrapExpr(lhs, allowTuple, allowCmd bool) ast.Expr {
 	switch p.tok {
 	case token.NOT: // expr!
 		expr := &ast.ErrWrapExpr{X: x, Tok: token.NOT, TokPos: p.pos}
+		p.features |= ast.FeatureErrWrap
 		p.next()
 		return expr
 	case token.QUESTION: // expr? expr?:defval
 		expr := &ast.ErrWrapExpr{X: x, Tok: token.QUESTION, TokPos: p.pos}
+		p.features |= ast.FeatureErrWrap
 		p.next()
 		if p.tok == token.COLON {
 			p.next()
@@ -2031,9 +2102,10 @@ func (p *parser) parseRangeExpr(allowCmd bool) ast.Expr {
 		p.next()
 		expr3 = p.parseBinaryExpr(false, token.LowestPrec+1, false, false)
 	}
-	if debugParseOutput {
-		log.Printf("ast.RangeExpr{First: %v, Last: %v, Expr3: %v}\n", low, high, expr3)
+	if p.debugOutput {
+		p.logger.Printf("ast.RangeExpr{First: %v, Last: %v, Expr3: %v}\n", low, high, expr3)
 	}
+	p.features |= ast.FeatureRangeExpr
 	return &ast.RangeExpr{First: low, To: to, Last: high, Colon2: colon2, Expr3: expr3}
 }
 
@@ -2087,9 +2159,10 @@ func (p *parser) parseLambdaExpr(allowCmd, allowRangeExpr bool) ast.Expr {
 				lhs = []*ast.Ident{x.(*ast.Ident)}
 			}
 		}
-		if debugParseOutput {
-			log.Printf("ast.LambdaExpr{Lhs: %v}\n", lhs)
+		if p.debugOutput {
+			p.logger.Printf("ast.LambdaExpr{Lhs: %v}\n", lhs)
 		}
+		p.features |= ast.FeatureLambda
 		if body != nil {
 			return &ast.LambdaExpr2{
 				First:       first,
@@ -2719,6 +2792,7 @@ func (p *parser) parseForPhraseStmtPart(lhs []ast.Expr) *ast.ForPhraseStmt {
 	}
 
 	stmt := &ast.ForPhraseStmt{ForPhrase: &ast.ForPhrase{TokPos: tokPos, X: x, Cond: cond}}
+	p.features |= ast.FeatureForPhrase
 	switch len(lhs) {
 	case 1:
 		stmt.Value = toIdent(lhs[0])
@@ -3067,6 +3141,23 @@ func (p *parser) parseGenDecl(keyword token.Token, f parseSpecFunction) *ast.Gen
 	}
 }
 
+// skipBody skips a function body up to its matching closing brace, and
+// returns it as an empty block (see DeclarationsOnly).
+func (p *parser) skipBody() *ast.BlockStmt {
+	lbrace := p.expect(token.LBRACE)
+	for depth := 1; p.tok != token.EOF; p.next() {
+		if p.tok == token.LBRACE {
+			depth++
+		} else if p.tok == token.RBRACE {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+	}
+	rbrace := p.expect2(token.RBRACE)
+	return &ast.BlockStmt{Lbrace: lbrace, Rbrace: rbrace}
+}
+
 func (p *parser) parseFuncDecl() *ast.FuncDecl {
 	if p.trace {
 		defer un(trace(p, "FunctionDecl"))
@@ -3117,6 +3208,9 @@ func (p *parser) parseFuncDecl() *ast.FuncDecl {
 		Body:     body,
 		Operator: isOp,
 	}
+	if isOp {
+		p.features |= ast.FeatureOperator
+	}
 	if recv == nil {
 		// Go spec: The scope of an identifier denoting a constant, type,
 		// variable, or function (but not method) declared at top level
@@ -3128,8 +3222,8 @@ func (p *parser) parseFuncDecl() *ast.FuncDecl {
 			p.declare(decl, nil, p.pkgScope, ast.Fun, ident)
 		}
 	}
-	if debugParseOutput {
-		log.Printf("ast.FuncDecl{Name: %v, ...}\n", ident.Name)
+	if p.debugOutput {
+		p.logger.Printf("ast.FuncDecl{Name: %v, ...}\n", ident.Name)
 	}
 	return decl
 }
@@ -3138,6 +3232,12 @@ func (p *parser) parseDecl(sync map[token.Token]bool) ast.Decl {
 	if p.trace {
 		defer un(trace(p, "Declaration"))
 	}
+	if p.tok == token.IDENT && p.rawBlocks[p.lit] {
+		if decl := p.parseRawBlock(); decl != nil {
+			return decl
+		}
+	}
+
 	var f parseSpecFunction
 	pos := p.pos
 	switch p.tok {
@@ -3163,6 +3263,27 @@ func (p *parser) parseDecl(sync map[token.Token]bool) ast.Decl {
 	return p.parseGenDecl(p.tok, f)
 }
 
+// parseRawBlock parses a `kind { ... }` block of an embedded language. It
+// returns nil (consuming nothing) if kind isn't followed by "{".
+func (p *parser) parseRawBlock() ast.Decl {
+	if p.trace {
+		defer un(trace(p, "RawBlock"))
+	}
+
+	pos, kind := p.pos, p.lit
+	p.next()
+	if p.tok != token.LBRACE {
+		p.unget(pos, token.IDENT, kind)
+		return nil
+	}
+	lbrace := p.pos
+	text, rbrace, _ := p.scanner.ScanRawBlock()
+	p.features |= ast.FeatureRawBlock
+	p.next()
+	p.expectSemi()
+	return &ast.RawBlock{KindPos: pos, Kind: kind, Lbrace: lbrace, Text: text, Rbrace: rbrace}
+}
+
 // ----------------------------------------------------------------------------
 // Source files
 
@@ -3235,5 +3356,6 @@ func (p *parser) parseFile() *ast.File {
 		Imports:    p.imports,
 		Unresolved: p.unresolved[0:i],
 		Comments:   p.comments,
+		Features:   p.features,
 	}
 }
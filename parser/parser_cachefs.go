@@ -0,0 +1,153 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"os"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+
+// CachedFS is a FileSystem that memoizes the results of ReadFile and ReadDir
+// of a base FileSystem, e.g. for a tool in watch mode to parse the same tree
+// again without reading the unchanged files again. Only successful results are
+// cached. Call Invalidate when a file or directory changes.
+//
+// CachedFS is safe for concurrent use. The contents it returns are shared:
+// they must not be modified. It is a DirEntryReader and a Stater like base:
+// directories are listed without stat'ing their files if base can do so, and
+// Stat isn't cached, so that it tells whether a file changed.
+type CachedFS struct {
+	base    FileSystem
+	mutex   sync.RWMutex
+	files   map[string][]byte        // filename => content
+	dirs    map[string][]os.FileInfo // dirname => entries
+	entries map[string][]os.DirEntry // dirname => entries, see ReadDirEntries
+}
+
+// NewCachedFS creates a CachedFS memoizing the files and directories of base.
+func NewCachedFS(base FileSystem) *CachedFS {
+	return &CachedFS{
+		base:    base,
+		files:   make(map[string][]byte),
+		dirs:    make(map[string][]os.FileInfo),
+		entries: make(map[string][]os.DirEntry),
+	}
+}
+
+// ReadDir reads the directory dirname from the cache, or from the base
+// FileSystem if it isn't cached yet.
+func (p *CachedFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	p.mutex.RLock()
+	list, ok := p.dirs[dirname]
+	p.mutex.RUnlock()
+	if ok {
+		return list, nil
+	}
+	list, err := p.base.ReadDir(dirname)
+	if err == nil {
+		p.mutex.Lock()
+		p.dirs[dirname] = list
+		p.mutex.Unlock()
+	}
+	return list, err
+}
+
+// ReadDirEntries reads the entries of directory dirname from the cache, or
+// from the base FileSystem if they aren't cached yet: by its ReadDirEntries
+// method if it is a DirEntryReader, else by ReadDir.
+func (p *CachedFS) ReadDirEntries(dirname string) ([]os.DirEntry, error) {
+	r, ok := p.base.(DirEntryReader)
+	if !ok {
+		list, err := p.ReadDir(dirname)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]os.DirEntry, len(list))
+		for i, fi := range list {
+			entries[i] = &fileInfoEntry{info: fi}
+		}
+		return entries, nil
+	}
+	p.mutex.RLock()
+	entries, ok := p.entries[dirname]
+	p.mutex.RUnlock()
+	if ok {
+		return entries, nil
+	}
+	entries, err := r.ReadDirEntries(dirname)
+	if err == nil {
+		p.mutex.Lock()
+		p.entries[dirname] = entries
+		p.mutex.Unlock()
+	}
+	return entries, err
+}
+
+// Stat returns the information of name from the base FileSystem (see Stat):
+// it isn't cached.
+func (p *CachedFS) Stat(name string) (os.FileInfo, error) {
+	return Stat(p.base, name)
+}
+
+// ReadFile reads filename from the cache, or from the base FileSystem if it
+// isn't cached yet.
+func (p *CachedFS) ReadFile(filename string) ([]byte, error) {
+	p.mutex.RLock()
+	data, ok := p.files[filename]
+	p.mutex.RUnlock()
+	if ok {
+		return data, nil
+	}
+	data, err := p.base.ReadFile(filename)
+	if err == nil {
+		p.mutex.Lock()
+		p.files[filename] = data
+		p.mutex.Unlock()
+	}
+	return data, err
+}
+
+// Join joins the path elements like the base FileSystem does.
+func (p *CachedFS) Join(elem ...string) string {
+	return p.base.Join(elem...)
+}
+
+// Invalidate drops the cached content of path, a file or a directory, and the
+// cached entries of its parent directory (a file may have been created or
+// removed), so that they are read again from the base FileSystem.
+func (p *CachedFS) Invalidate(path string) {
+	name := baseName(path)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.files, path)
+	delete(p.dirs, path)
+	delete(p.entries, path)
+	for dirname := range p.dirs {
+		if p.base.Join(dirname, name) == path {
+			delete(p.dirs, dirname)
+		}
+	}
+	for dirname := range p.entries {
+		if p.base.Join(dirname, name) == path {
+			delete(p.entries, dirname)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,134 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/goplus/gop/parser/parsertest"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+type countingFS struct {
+	FileSystem
+	mutex sync.Mutex
+	reads map[string]int
+}
+
+func (p *countingFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	p.count(dirname)
+	return p.FileSystem.ReadDir(dirname)
+}
+
+func (p *countingFS) ReadFile(filename string) ([]byte, error) {
+	p.count(filename)
+	return p.FileSystem.ReadFile(filename)
+}
+
+func (p *countingFS) count(name string) {
+	p.mutex.Lock()
+	p.reads[name]++
+	p.mutex.Unlock()
+}
+
+func TestCachedFS(t *testing.T) {
+	base := &countingFS{FileSystem: parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\nfunc A() {}\n",
+		"/foo/b.gop": "package foo\n\nfunc B() {}\n",
+	}), reads: make(map[string]int)}
+	fs := NewCachedFS(base)
+	for i := 0; i < 2; i++ {
+		pkgs, err := ParseFSDirConcurrent(token.NewFileSet(), fs, "/foo", nil, 0)
+		if err != nil || len(pkgs["foo"].Files) != 2 {
+			t.Fatal("ParseFSDir failed:", err, pkgs)
+		}
+	}
+	if base.reads["/foo"] != 1 || base.reads["/foo/a.gop"] != 1 || base.reads["/foo/b.gop"] != 1 {
+		t.Fatal("TestCachedFS failed: reads =", base.reads)
+	}
+
+	fs.Invalidate("/foo/a.gop")
+	if _, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0); err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	if base.reads["/foo"] != 2 || base.reads["/foo/a.gop"] != 2 || base.reads["/foo/b.gop"] != 1 {
+		t.Fatal("TestCachedFS (Invalidate) failed: reads =", base.reads)
+	}
+
+	if _, err := fs.ReadFile("/foo/c.gop"); err == nil {
+		t.Fatal("ReadFile: no error for a missing file")
+	}
+	if _, err := fs.ReadFile("/foo/c.gop"); err == nil || base.reads["/foo/c.gop"] != 2 {
+		t.Fatal("ReadFile: error cached?", base.reads)
+	}
+}
+
+func TestCachedFSConcurrent(t *testing.T) {
+	mapfs := fstest.MapFS{
+		"foo/a.gop": {Data: []byte("package foo\n")},
+		"foo/b.gop": {Data: []byte("package foo\n\nfunc B() {}\n")},
+	}
+	fs := NewCachedFS(NewFSAdapter(mapfs))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			list, err := fs.ReadDir("/foo")
+			if err != nil || len(list) != 2 {
+				t.Error("ReadDir failed:", err, list)
+				return
+			}
+			for _, fi := range list {
+				if fi.Size() == 0 {
+					t.Error("ReadDir failed:", fi.Name(), fi.Size())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the stat-free listing of the base is kept
+	entries, err := readDirEntries(fs, "/foo")
+	if err != nil || len(entries) != 2 {
+		t.Fatal("readDirEntries failed:", err, entries)
+	}
+	if _, ok := entries[0].(*fileInfoEntry); ok {
+		t.Fatal("readDirEntries: the DirEntryReader of the base isn't used")
+	}
+	if again, _ := fs.ReadDirEntries("/foo"); &again[0] != &entries[0] {
+		t.Fatal("ReadDirEntries: not cached")
+	}
+
+	// Stat isn't cached
+	if fi, err := Stat(fs, "/foo/a.gop"); err != nil || fi.Size() != 12 {
+		t.Fatal("Stat failed:", err, fi)
+	}
+	mapfs["foo/a.gop"] = &fstest.MapFile{Data: []byte("package foo\n\n")}
+	if fi, err := Stat(fs, "/foo/a.gop"); err != nil || fi.Size() != 13 {
+		t.Fatal("Stat cached:", err, fi)
+	}
+}
+
+// -----------------------------------------------------------------------------
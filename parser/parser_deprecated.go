@@ -0,0 +1,80 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/scanner"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// A deprecation describes a deprecated construct. check returns the message
+// and the suggested replacement if node is a use of the construct.
+type deprecation struct {
+	name  string
+	check func(node ast.Node) (msg, suggest string, ok bool)
+}
+
+// deprecations lists the syntax that is deprecated and will be removed in a
+// future version of Go+. Keep it in sync with the language documentation.
+var deprecations = []deprecation{
+	{"legacy octal literal", checkLegacyOctal},
+}
+
+// checkLegacyOctal matches the octal literals without 0o prefix, like 0644.
+func checkLegacyOctal(node ast.Node) (msg, suggest string, ok bool) {
+	lit, isLit := node.(*ast.BasicLit)
+	if !isLit || lit.Kind != token.INT || len(lit.Value) < 2 || lit.Value[0] != '0' {
+		return
+	}
+	for _, c := range lit.Value[1:] {
+		if (c < '0' || c > '7') && c != '_' {
+			return
+		}
+	}
+	suggest = "0o" + lit.Value[1:]
+	if lit.Value[1] == '_' {
+		suggest = "0o" + lit.Value[2:]
+	}
+	return "octal literal " + lit.Value + " is deprecated, use " + suggest, suggest, true
+}
+
+// checkDeprecated reports each use of a construct of deprecations in f to
+// warn, in source order.
+func checkDeprecated(fset *token.FileSet, f *ast.File, warn func(diag Diagnostic)) {
+	ast.Inspect(f, func(node ast.Node) bool {
+		if node == nil {
+			return false
+		}
+		for _, d := range deprecations {
+			if msg, suggest, ok := d.check(node); ok {
+				pos, _ := f.AdjustPos_(fset.Position(node.Pos()))
+				warn(Diagnostic{
+					Category: CategoryDeprecated,
+					Err:      &scanner.Error{Pos: pos, Msg: msg},
+					Pos:      []token.Position{pos},
+					Suggest:  suggest,
+				})
+			}
+		}
+		return true
+	})
+}
+
+// -----------------------------------------------------------------------------
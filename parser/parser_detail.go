@@ -0,0 +1,85 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"sort"
+
+	"github.com/goplus/gop/scanner"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// ErrorKind classifies a syntax error reported in ParseDetailedErrors mode.
+type ErrorKind int
+
+const (
+	// ErrorKindOther - any other syntax error
+	ErrorKindOther ErrorKind = iota
+	// ErrorKindExpected - something else was expected: `expected ')', found ...`
+	ErrorKindExpected
+	// ErrorKindMissingComma - a ',' is missing in a list
+	ErrorKindMissingComma
+	// ErrorKindScanner - a lexical error, such as an invalid literal
+	ErrorKindScanner
+)
+
+// ErrorDetail is the machine-readable form of a syntax error, so that editors
+// can offer fixits. Msg is the message of the respective error of the
+// scanner.ErrorList.
+type ErrorDetail struct {
+	Pos      token.Position // position in the original source
+	Msg      string         // error message
+	Kind     ErrorKind      // kind of error
+	Found    token.Token    // token found at Pos; or token.ILLEGAL if unknown
+	Lit      string         // literal of Found, if any
+	Expected []token.Token  // tokens that would have been accepted at Pos; or nil if unknown
+}
+
+// DetailedErrorList is the error returned in ParseDetailedErrors mode. It
+// holds the usual scanner.ErrorList (so its message is unchanged) and the
+// details of the errors, sorted by position.
+type DetailedErrorList struct {
+	scanner.ErrorList
+	Details []*ErrorDetail
+}
+
+func newDetailedErrorList(errs scanner.ErrorList, details []*ErrorDetail) *DetailedErrorList {
+	sort.SliceStable(details, func(i, j int) bool {
+		return details[i].Pos.Offset < details[j].Pos.Offset
+	})
+	return &DetailedErrorList{ErrorList: errs, Details: details}
+}
+
+// Unwrap returns the underlying scanner.ErrorList.
+func (p *DetailedErrorList) Unwrap() error {
+	return p.ErrorList
+}
+
+// errorList returns the scanner.ErrorList of err, if any.
+func errorList(err error) (scanner.ErrorList, bool) {
+	switch e := err.(type) {
+	case scanner.ErrorList:
+		return e, true
+	case *DetailedErrorList:
+		return e.ErrorList, true
+	}
+	return nil, false
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,77 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/goplus/gop/scanner"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestParseDetailedErrors(t *testing.T) {
+	const src = "package foo\n\nvar a = (1 + 2\n"
+	_, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", src, ParseDetailedErrors)
+	e, ok := err.(*DetailedErrorList)
+	if !ok || len(e.Details) == 0 || len(e.ErrorList) == 0 {
+		t.Fatal("ParseDetailedErrors: unexpected error", err)
+	}
+	detail := e.Details[0]
+	if detail.Kind != ErrorKindExpected || len(detail.Expected) != 1 || detail.Expected[0] != token.RPAREN ||
+		detail.Found != token.SEMICOLON || detail.Msg != e.ErrorList[0].Msg {
+		t.Fatal("ParseDetailedErrors failed:", *detail)
+	}
+	if pos := detail.Pos; pos.Line != 3 || pos.Column != 15 || pos.Offset != len(src)-1 {
+		t.Fatal("ParseDetailedErrors failed: pos =", pos)
+	}
+	var errs scanner.ErrorList
+	if !errors.As(err, &errs) || err.Error() != errs.Error() {
+		t.Fatal("ParseDetailedErrors: no scanner.ErrorList in", err)
+	}
+
+	_, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", src, 0)
+	if _, ok = err.(scanner.ErrorList); !ok {
+		t.Fatal("ParseFile: unexpected error", err)
+	}
+}
+
+func TestParseDetailedErrorsInjected(t *testing.T) {
+	const src = "y := (1 + 2\nprintln y\n"
+	_, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", src, ParseDetailedErrors)
+	e, ok := err.(*DetailedErrorList)
+	if !ok || len(e.Details) == 0 {
+		t.Fatal("ParseDetailedErrors: unexpected error", err)
+	}
+	for _, detail := range e.Details {
+		pos := detail.Pos
+		if pos.Line < 1 || pos.Column < 1 || pos.Offset < 0 || pos.Offset > len(src) {
+			t.Fatal("ParseDetailedErrors: invalid position", pos)
+		}
+		if len(detail.Expected) == 1 && detail.Expected[0] == token.RPAREN {
+			if pos.Line != 1 || pos.Column != 12 || pos.Offset != 11 {
+				t.Fatal("ParseDetailedErrors failed: pos =", pos)
+			}
+			return
+		}
+	}
+	t.Fatal("ParseDetailedErrors: missing ')' not reported")
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,477 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/scanner"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// ErrorCategory classifies the first error of a file.
+type ErrorCategory int
+
+const (
+	// CategoryNone - the file has no error
+	CategoryNone ErrorCategory = iota
+	// CategorySyntax - a syntax error, including in a file whose package
+	// clause or entrypoint was injected
+	CategorySyntax
+	// CategoryMissingPackage - a file without a package clause, which wasn't
+	// injected (see DisableAutoPkgDecl)
+	CategoryMissingPackage
+	// CategoryMissingEntry - statements outside of a function, which weren't
+	// wrapped into an entrypoint (see DisableAutoEntry), or couldn't be since
+	// the entrypoint is already declared
+	CategoryMissingEntry
+	// CategoryEncoding - an invalid encoding (UTF-8, BOM or NUL) in the source
+	CategoryEncoding
+	// CategoryRead - the file couldn't be read
+	CategoryRead
+	// CategoryDuplicateDecl - a name declared more than once at package scope
+	CategoryDuplicateDecl
+	// CategoryLineTooLong - a line longer than Config.MaxLineLength (warning)
+	CategoryLineTooLong
+	// CategoryDeprecated - a use of deprecated syntax (warning, see
+	// ParseWarnDeprecated)
+	CategoryDeprecated
+	// CategoryIdentTooLong - a declared identifier longer than
+	// Config.MaxIdentLength (warning)
+	CategoryIdentTooLong
+	// CategoryReceiverName - methods of a type with different receiver names
+	CategoryReceiverName
+)
+
+var categoryNames = [...]string{
+	CategoryNone:           "none",
+	CategorySyntax:         "syntax",
+	CategoryMissingPackage: "missing-package",
+	CategoryMissingEntry:   "missing-entry",
+	CategoryEncoding:       "encoding",
+	CategoryRead:           "read",
+	CategoryDuplicateDecl:  "duplicate-decl",
+	CategoryLineTooLong:    "line-too-long",
+	CategoryDeprecated:     "deprecated",
+	CategoryIdentTooLong:   "ident-too-long",
+	CategoryReceiverName:   "receiver-name",
+}
+
+func (c ErrorCategory) String() string {
+	if c >= 0 && int(c) < len(categoryNames) {
+		return categoryNames[c]
+	}
+	return "unknown"
+}
+
+// Diagnostic describes the outcome of parsing a file.
+type Diagnostic struct {
+	Category ErrorCategory // category of Err
+	Err      error         // first error of the file; or nil
+	Injected bool          // a package clause or an entrypoint was injected
+
+	// Pos lists the positions (in the original source) of all declarations
+	// involved in a CategoryDuplicateDecl diagnostic, of all receivers
+	// involved in a CategoryReceiverName diagnostic, or the position of the
+	// line of a CategoryLineTooLong warning, or the position of the construct
+	// of a CategoryDeprecated warning or of the identifier of a
+	// CategoryIdentTooLong warning; nil otherwise.
+	Pos []token.Position
+
+	// Suggest is the suggested replacement of the construct of a
+	// CategoryDeprecated warning; "" otherwise.
+	Suggest string
+}
+
+func newDiagnostic(err error, noPkgDecl, noEntrypoint, stmtsOutside bool) Diagnostic {
+	diag := Diagnostic{Injected: noPkgDecl || noEntrypoint}
+	if err == nil {
+		return diag
+	}
+	diag.Err = err
+	if errs, ok := errorList(err); ok && len(errs) > 0 {
+		diag.Err = errs[0]
+		if noEntrypoint && len(errs) > 1 && isDeclExpected(errs[0]) {
+			// the injected entrypoint is reported as a bad declaration when
+			// its statements have errors: the error is in the statements
+			diag.Err = errs[1]
+		}
+	}
+	switch {
+	case isEncodingError(diag.Err):
+		diag.Category = CategoryEncoding
+	case isPackageExpected(diag.Err):
+		diag.Category = CategoryMissingPackage
+	case stmtsOutside:
+		diag.Category = CategoryMissingEntry
+	default:
+		diag.Category = CategorySyntax
+	}
+	return diag
+}
+
+func isDeclExpected(err error) bool {
+	e, ok := err.(*scanner.Error)
+	return ok && strings.HasPrefix(e.Msg, "expected declaration")
+}
+
+func isPackageExpected(err error) bool {
+	e, ok := err.(*scanner.Error)
+	return ok && strings.HasPrefix(e.Msg, "expected 'package'")
+}
+
+func isEncodingError(err error) bool {
+	if e, ok := err.(*scanner.Error); ok {
+		return strings.HasPrefix(e.Msg, "illegal UTF-8 encoding") ||
+			strings.HasPrefix(e.Msg, "illegal byte order mark") ||
+			strings.HasPrefix(e.Msg, "illegal character NUL")
+	}
+	return false
+}
+
+// ParseFSDirDiagnostics parses the files ParseFSDir would parse and reports a
+// Diagnostic for each of them, keyed by filename. The category of a file is
+// the one of its first error.
+//
+// If the directory couldn't be read, a nil map and the respective error are
+// returned.
+func ParseFSDirDiagnostics(fset *token.FileSet, fs FileSystem, path string, filter func(os.FileInfo) bool, mode Mode) (diags map[string]Diagnostic, err error) {
+	list, err := readDirEntries(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{Mode: mode}
+	diags = make(map[string]Diagnostic)
+	for _, d := range list {
+		ft, isOk := dirFileType(d, filter, mode)
+		if !isOk {
+			continue
+		}
+		filename := fs.Join(path, d.Name())
+		code, err := fs.ReadFile(filename)
+		if err != nil {
+			diags[filename] = Diagnostic{Category: CategoryRead, Err: err}
+			continue
+		}
+		var diag Diagnostic
+		parseFileEx(fset, filename, code, cfg, ft, &diag)
+		diags[filename] = diag
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// CheckDuplicateDecls reports the names declared more than once at package
+// scope across the files of pkg, one Diagnostic per name, ordered by the
+// position of the first redeclaration (files are visited in filename order).
+// Err is reported at the first redeclaration and Pos lists all declarations.
+//
+// Methods are keyed by receiver type, so a method never collides with a
+// function of the same name. Functions and variables of class files (such as
+// .spx) belong to their class. `init` functions, blank identifiers and the
+// entrypoints injected for headless scripts are ignored (the latter are
+// checked when merging scripts, see MergeScript).
+func CheckDuplicateDecls(fset *token.FileSet, pkg *ast.Package) []Diagnostic {
+	filenames := sortedFilenames(pkg)
+
+	type declInfo struct {
+		name  string
+		decls []token.Position
+	}
+	var dups []*declInfo
+	seen := make(map[string]*declInfo)
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		var class string
+		if f.FileType == ast.FileTypeSpx || f.FileType == ast.FileTypeGmx {
+			base := baseName(filename)
+			class = strings.TrimSuffix(base, nameExt(base)) + "."
+		}
+		declare := func(key string, name *ast.Ident) {
+			if name.Name == "_" {
+				return
+			}
+			pos, _ := f.AdjustPos_(fset.Position(name.Pos()))
+			if info, ok := seen[key]; ok {
+				if len(info.decls) == 1 {
+					dups = append(dups, info)
+				}
+				info.decls = append(info.decls, pos)
+				return
+			}
+			seen[key] = &declInfo{name: strings.TrimPrefix(key, class), decls: []token.Position{pos}}
+		}
+		synthetic := entrypointDecl(f)
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.ValueSpec:
+						prefix := ""
+						if d.Tok == token.VAR {
+							prefix = class
+						}
+						for _, name := range s.Names {
+							declare(prefix+name.Name, name)
+						}
+					case *ast.TypeSpec:
+						declare(s.Name.Name, s.Name)
+					}
+				}
+			case *ast.FuncDecl:
+				switch {
+				case d == synthetic || (d.Recv == nil && d.Name.Name == "init"):
+				case d.Recv != nil && len(d.Recv.List) == 1:
+					declare(recvTypeName(d.Recv.List[0].Type)+"."+d.Name.Name, d.Name)
+				default:
+					declare(class+d.Name.Name, d.Name)
+				}
+			}
+		}
+	}
+
+	diags := make([]Diagnostic, len(dups))
+	for i, info := range dups {
+		diags[i] = Diagnostic{
+			Category: CategoryDuplicateDecl,
+			Err:      &scanner.Error{Pos: info.decls[1], Msg: info.name + " redeclared in this package"},
+			Pos:      info.decls,
+		}
+	}
+	return diags
+}
+
+// ReceiverNameInconsistencies reports the types of pkg whose methods don't
+// all use the same receiver name, one Diagnostic per type, ordered by the
+// position of the first method of the type (files are visited in filename
+// order). Pointer and value receivers of a type are grouped together. Err
+// is reported at the first receiver whose name differs from the one of the
+// first method, and Pos lists the receivers of all methods of the type.
+// Unnamed and blank receivers, and the receivers of the entrypoints injected
+// for headless class files (see RegisterMethodEntry), are ignored.
+func ReceiverNameInconsistencies(fset *token.FileSet, pkg *ast.Package) []Diagnostic {
+	filenames := sortedFilenames(pkg)
+
+	type recvInfo struct {
+		typ   string
+		names []string
+		pos   []token.Position
+	}
+	var types []*recvInfo
+	seen := make(map[string]*recvInfo)
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		synthetic := entrypointDecl(f)
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn == synthetic || fn.Recv == nil || len(fn.Recv.List) != 1 {
+				continue
+			}
+			recv := fn.Recv.List[0]
+			typ := recvTypeName(recv.Type)
+			if typ == "" || len(recv.Names) != 1 || recv.Names[0].Name == "_" {
+				continue
+			}
+			info, ok := seen[typ]
+			if !ok {
+				info = &recvInfo{typ: typ}
+				seen[typ] = info
+				types = append(types, info)
+			}
+			pos, _ := f.AdjustPos_(fset.Position(recv.Names[0].Pos()))
+			info.names = append(info.names, recv.Names[0].Name)
+			info.pos = append(info.pos, pos)
+		}
+	}
+
+	var diags []Diagnostic
+	for _, info := range types {
+		var names []string
+		var first int
+		for i, name := range info.names {
+			if !contains(names, name) {
+				if names = append(names, name); len(names) == 2 {
+					first = i
+				}
+			}
+		}
+		if len(names) > 1 {
+			diags = append(diags, Diagnostic{
+				Category: CategoryReceiverName,
+				Err: &scanner.Error{Pos: info.pos[first],
+					Msg: "methods of " + info.typ + " use different receiver names: " + strings.Join(names, ", ")},
+				Pos: info.pos,
+			})
+		}
+	}
+	return diags
+}
+
+func contains(names []string, name string) bool {
+	for _, v := range names {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// recvTypeName returns the name of the base type of a receiver type.
+func recvTypeName(typ ast.Expr) string {
+	for {
+		switch t := typ.(type) {
+		case *ast.StarExpr:
+			typ = t.X
+		case *ast.ParenExpr:
+			typ = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// checkLineLength reports the lines of src longer than cfg.MaxLineLength to
+// cfg.Warn, at positions relative to cfg.Origin like the ones of the parser.
+func checkLineLength(filename string, src []byte, cfg *Config) {
+	file := token.NewFileSet().AddFile(filename, -1, len(src))
+	file.SetLinesForContent(src)
+	setOrigin(file, filename, cfg)
+	tabWidth := cfg.TabWidth
+	if tabWidth < 1 {
+		tabWidth = 1
+	}
+	for offset := 0; offset < len(src); {
+		end := bytes.IndexByte(src[offset:], '\n')
+		if end < 0 {
+			end = len(src)
+		} else {
+			end += offset
+		}
+		cols := 0
+		for _, ch := range string(bytes.TrimSuffix(src[offset:end], []byte{'\r'})) {
+			if ch == '\t' {
+				cols = (cols/tabWidth + 1) * tabWidth
+			} else {
+				cols++
+			}
+		}
+		if cols > cfg.MaxLineLength {
+			pos := file.Position(file.Pos(offset))
+			cfg.Warn(Diagnostic{
+				Category: CategoryLineTooLong,
+				Err:      &scanner.Error{Pos: pos, Msg: fmt.Sprintf("line is %d columns long (max %d)", cols, cfg.MaxLineLength)},
+				Pos:      []token.Position{pos},
+			})
+		}
+		offset = end + 1
+	}
+}
+
+// checkIdentLength reports the declared identifiers of f longer than
+// cfg.MaxIdentLength to cfg.Warn, in source order.
+func checkIdentLength(fset *token.FileSet, f *ast.File, cfg *Config) {
+	var idents []*ast.Ident
+	declare := func(names ...*ast.Ident) {
+		for _, name := range names {
+			if name != nil && name.Name != "_" && utf8.RuneCountInString(name.Name) > cfg.MaxIdentLength {
+				idents = append(idents, name)
+			}
+		}
+	}
+	if !f.NoPkgDecl {
+		declare(f.Name)
+	}
+	synthetic := entrypointDecl(f)
+	var visit func(node ast.Node) bool
+	visit = func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.ImportSpec:
+			if n.Name != nil && n.Name.Name != "." {
+				declare(n.Name)
+			}
+		case *ast.ValueSpec:
+			declare(n.Names...)
+		case *ast.TypeSpec:
+			declare(n.Name)
+		case *ast.FuncDecl:
+			if n == synthetic {
+				ast.Inspect(n.Body, visit)
+				return false
+			}
+			declare(n.Name)
+		case *ast.Field:
+			declare(n.Names...)
+		case *ast.AssignStmt:
+			if n.Tok == token.DEFINE {
+				for _, lhs := range n.Lhs {
+					// a variable redeclared by := refers to the object of its
+					// first declaration: it is reported there only
+					if ident, ok := lhs.(*ast.Ident); ok && ident.Obj != nil && ident.Obj.Decl == n {
+						declare(ident)
+					}
+				}
+			}
+		case *ast.RangeStmt:
+			if n.Tok == token.DEFINE {
+				if key, ok := n.Key.(*ast.Ident); ok {
+					declare(key)
+				}
+				if value, ok := n.Value.(*ast.Ident); ok {
+					declare(value)
+				}
+			}
+		case *ast.LabeledStmt:
+			declare(n.Label)
+		case *ast.ForPhrase:
+			declare(n.Key, n.Value)
+		case *ast.LambdaExpr:
+			declare(n.Lhs...)
+		case *ast.LambdaExpr2:
+			declare(n.Lhs...)
+		}
+		return true
+	}
+	for _, decl := range f.Decls {
+		ast.Inspect(decl, visit)
+	}
+	sort.SliceStable(idents, func(i, j int) bool {
+		return idents[i].Pos() < idents[j].Pos()
+	})
+	for _, ident := range idents {
+		pos, _ := f.AdjustPos_(fset.Position(ident.Pos()))
+		cfg.Warn(Diagnostic{
+			Category: CategoryIdentTooLong,
+			Err: &scanner.Error{Pos: pos, Msg: fmt.Sprintf("identifier %s is %d characters long (max %d)",
+				ident.Name, utf8.RuneCountInString(ident.Name), cfg.MaxIdentLength)},
+			Pos: []token.Position{pos},
+		})
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,316 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/parser/parsertest"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestParseFSDirDiagnostics(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"ok.gop", "script.gop", "syntax.gop", "nopkg.gop", "entry.gop", "enc.gop", "lost.gop"},
+	}, map[string]string{
+		"/foo/ok.gop":     "package foo\n\nfunc Foo() {}\n",
+		"/foo/script.gop": "println \"Hi\"\n",
+		"/foo/syntax.gop": "package foo\n\nvar a = )\n",
+		"/foo/nopkg.gop":  "import \"fmt\"\n\nvar a = )\n",
+		"/foo/entry.gop":  "x := 1\ny := )\n",
+		"/foo/enc.gop":    "package foo\n\nvar s = \"\xff\"\n",
+	})
+	diags, err := ParseFSDirDiagnostics(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil || len(diags) != 7 {
+		t.Fatal("ParseFSDirDiagnostics failed:", err, len(diags))
+	}
+	expected := map[string]struct {
+		category ErrorCategory
+		injected bool
+	}{
+		"/foo/ok.gop":     {CategoryNone, false},
+		"/foo/script.gop": {CategoryNone, true},
+		"/foo/syntax.gop": {CategorySyntax, false},
+		"/foo/nopkg.gop":  {CategorySyntax, true},
+		"/foo/entry.gop":  {CategorySyntax, true},
+		"/foo/enc.gop":    {CategoryEncoding, false},
+		"/foo/lost.gop":   {CategoryRead, false},
+	}
+	for filename, diag := range diags {
+		exp := expected[filename]
+		if diag.Category != exp.category || diag.Injected != exp.injected || (diag.Err == nil) != (exp.category == CategoryNone) {
+			t.Fatal("ParseFSDirDiagnostics failed:", filename, diag.Category, diag.Injected, diag.Err)
+		}
+	}
+	if err := diags["/foo/entry.gop"].Err; err == nil || err.Error() != "/foo/entry.gop:2:6: expected operand, found ')'" {
+		t.Fatal("ParseFSDirDiagnostics failed: entry.gop:", err)
+	}
+	if s := CategoryMissingEntry.String(); s != "missing-entry" {
+		t.Fatal("ErrorCategory.String failed:", s)
+	}
+
+	// the package clause or entrypoint is really missing
+	fs = parsertest.NewMemFS(map[string][]string{
+		"/foo": {"nopkg.gop", "noentry.gop", "syntax.gop", "conflict.spx"},
+	}, map[string]string{
+		"/foo/nopkg.gop":    "import \"fmt\"\n\nfmt.Println 1\n",
+		"/foo/noentry.gop":  "package foo\n\nimport \"fmt\"\n\nfmt.Println 1\n",
+		"/foo/syntax.gop":   "package foo\n\nfunc f() {\n\tx := )\n}\n",
+		"/foo/conflict.spx": "func Main() {\n}\n\nprintln 1\n",
+	})
+	diags, err = ParseFSDirDiagnostics(token.NewFileSet(), fs, "/foo", nil, DisableAutoPkgDecl|DisableAutoEntry)
+	if err != nil {
+		t.Fatal("ParseFSDirDiagnostics failed:", err)
+	}
+	for filename, category := range map[string]ErrorCategory{
+		"/foo/nopkg.gop": CategoryMissingPackage, "/foo/noentry.gop": CategoryMissingEntry,
+		"/foo/syntax.gop": CategorySyntax, "/foo/conflict.spx": CategoryMissingPackage,
+	} {
+		if diag := diags[filename]; diag.Category != category {
+			t.Fatal("ParseFSDirDiagnostics failed:", filename, diag.Category, diag.Err)
+		}
+	}
+	diags, _ = ParseFSDirDiagnostics(token.NewFileSet(), fs, "/foo", nil, 0)
+	if diag := diags["/foo/conflict.spx"]; diag.Category != CategoryMissingEntry {
+		t.Fatal("ParseFSDirDiagnostics failed: conflict.spx:", diag.Category, diag.Err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func TestCheckDuplicateDecls(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "c.gop", "d.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package main\n\ntype T int\n\nfunc (T) Foo() {}\n\nfunc Foo() {}\n\nfunc init() {}\n",
+		"/foo/b.gop": "package main\n\nvar _, Bar = 1, 2\n\nfunc (p *T) Foo() {}\n\nfunc init() {}\n",
+		"/foo/c.gop": "package main\n\nconst Bar = 3\n\nfunc Foo() {}\n",
+		"/foo/d.gop": "x := 1\nprintln x\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	diags := CheckDuplicateDecls(fset, pkgs["main"])
+	expected := []struct {
+		msg   string
+		files []string
+	}{
+		{"/foo/b.gop:5:13: T.Foo redeclared in this package", []string{"/foo/a.gop", "/foo/b.gop"}},
+		{"/foo/c.gop:3:7: Bar redeclared in this package", []string{"/foo/b.gop", "/foo/c.gop"}},
+		{"/foo/c.gop:5:6: Foo redeclared in this package", []string{"/foo/a.gop", "/foo/c.gop"}},
+	}
+	if len(diags) != len(expected) {
+		t.Fatal("CheckDuplicateDecls failed: len(diags) =", len(diags), diags)
+	}
+	for i, diag := range diags {
+		exp := expected[i]
+		if diag.Category != CategoryDuplicateDecl || diag.Err.Error() != exp.msg || len(diag.Pos) != len(exp.files) {
+			t.Fatal("CheckDuplicateDecls failed:", diag.Category, diag.Err, diag.Pos)
+		}
+		for j, pos := range diag.Pos {
+			if pos.Filename != exp.files[j] {
+				t.Fatal("CheckDuplicateDecls failed:", pos)
+			}
+		}
+	}
+}
+
+func TestCheckDuplicateDeclsClass(t *testing.T) {
+	RegisterFileType(".dup.gox", ast.FileTypeSpx)
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"Kai.dup.gox", "b.gop"},
+	}, map[string]string{
+		"/foo/Kai.dup.gox": "func Foo() {}\n",
+		"/foo/b.gop":       "package main\n\nfunc (p *Kai) Foo() {}\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	// the functions of a class file are the methods of its class
+	diags := CheckDuplicateDecls(fset, pkgs["main"])
+	if len(diags) != 1 || diags[0].Err.Error() != "/foo/b.gop:3:15: Foo redeclared in this package" {
+		t.Fatal("CheckDuplicateDecls failed:", diags)
+	}
+}
+
+func TestReceiverNameInconsistencies(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\ntype Cat struct{}\n\nfunc (c *Cat) Meow() {}\n\nfunc (Cat) Purr() {}\n\ntype Dog struct{}\n\nfunc (d Dog) Bark() {}\n",
+		"/foo/b.gop": "package foo\n\nfunc (self Cat) Name() string { return \"cat\" }\n\nfunc (c *Cat) Sleep() {}\n\nfunc (d *Dog) Sit() {}\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	diags := ReceiverNameInconsistencies(fset, pkgs["foo"])
+	if len(diags) != 1 {
+		t.Fatal("TestReceiverNameInconsistencies failed: len(diags) =", len(diags))
+	}
+	diag := diags[0]
+	if diag.Category != CategoryReceiverName || diag.Err.Error() != "/foo/b.gop:3:7: methods of Cat use different receiver names: c, self" {
+		t.Fatal("TestReceiverNameInconsistencies failed:", diag.Category, diag.Err)
+	}
+	var ret []string
+	for _, pos := range diag.Pos {
+		ret = append(ret, pos.String())
+	}
+	if !reflect.DeepEqual(ret, []string{"/foo/a.gop:5:7", "/foo/b.gop:3:7", "/foo/b.gop:5:7"}) {
+		t.Fatal("TestReceiverNameInconsistencies failed:", ret)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	const src = "x := 1 // 12345678\n\tprintln x\r\ny := \"héllo\"\n"
+	var diags []Diagnostic
+	cfg := &Config{MaxLineLength: 12, TabWidth: 4, Warn: func(diag Diagnostic) {
+		diags = append(diags, diag)
+	}}
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	if len(diags) != 2 {
+		t.Fatal("TestMaxLineLength failed: len(diags) =", len(diags))
+	}
+	if diag := diags[0]; diag.Category != CategoryLineTooLong || diag.Pos[0].Line != 1 || diag.Pos[0].Offset != 0 ||
+		diag.Err.Error() != "/foo/bar.gop:1:1: line is 18 columns long (max 12)" {
+		t.Fatal("TestMaxLineLength failed:", diag.Category, diag.Err)
+	}
+	if diag := diags[1]; diag.Pos[0].Line != 2 || diag.Err.Error() != "/foo/bar.gop:2:1: line is 13 columns long (max 12)" {
+		t.Fatal("TestMaxLineLength failed:", diag.Err)
+	}
+
+	diags = nil
+	cfg.MaxLineLength = 13
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil || len(diags) != 1 {
+		t.Fatal("TestMaxLineLength failed:", err, len(diags))
+	}
+
+	// positions are relative to the enclosing document
+	diags = nil
+	cfg.Origin = token.Position{Filename: "/doc/README.md", Line: 10, Column: 5}
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil || len(diags) != 1 {
+		t.Fatal("TestMaxLineLength failed:", err, len(diags))
+	}
+	if diag := diags[0]; diag.Pos[0].Offset != 0 || diag.Err.Error() != "/doc/README.md:10:5: line is 18 columns long (max 13)" {
+		t.Fatal("TestMaxLineLength failed:", diag.Err)
+	}
+}
+
+func TestWarnDeprecated(t *testing.T) {
+	const src = "os.Chmod \"a\", 0644\nx := [0, 07, 0o7, 0x7, 0_600]\n"
+	var diags []Diagnostic
+	cfg := &Config{Warn: func(diag Diagnostic) {
+		diags = append(diags, diag)
+	}}
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil || diags != nil {
+		t.Fatal("ParseFileConfig failed:", err, diags)
+	}
+	cfg.Mode = ParseWarnDeprecated
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	if len(diags) != 3 {
+		t.Fatal("TestWarnDeprecated failed: len(diags) =", len(diags))
+	}
+	if diag := diags[0]; diag.Category != CategoryDeprecated || diag.Suggest != "0o644" || diag.Pos[0].Offset != 14 ||
+		diag.Err.Error() != "/foo/bar.gop:1:15: octal literal 0644 is deprecated, use 0o644" {
+		t.Fatal("TestWarnDeprecated failed:", diag.Category, diag.Suggest, diag.Pos, diag.Err)
+	}
+	if diag := diags[1]; diag.Suggest != "0o7" || diag.Pos[0].Line != 2 || diag.Pos[0].Column != 10 {
+		t.Fatal("TestWarnDeprecated failed:", diag.Suggest, diag.Pos)
+	}
+	if diag := diags[2]; diag.Suggest != "0o600" || diag.Pos[0].Column != 24 {
+		t.Fatal("TestWarnDeprecated failed:", diag.Suggest, diag.Pos)
+	}
+}
+
+func TestMaxIdentLength(t *testing.T) {
+	const src = `import strs "strings"
+
+func upper(input string) (output string) {
+	output = strs.ToUpper(input)
+	return
+}
+
+result := upper("hello")
+for index, char := range result {
+	println index, char
+}
+println [number * 2 for number <- [1, 2], number > 1]
+`
+	var names []string
+	cfg := &Config{MaxIdentLength: 5, Warn: func(diag Diagnostic) {
+		if diag.Category != CategoryIdentTooLong {
+			t.Fatal("TestMaxIdentLength failed:", diag.Category)
+		}
+		names = append(names, fmt.Sprintf("%d:%d", diag.Pos[0].Line, diag.Pos[0].Column))
+	}}
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	expected := []string{"3:27", "8:1", "12:25"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatal("TestMaxIdentLength failed:", names)
+	}
+
+	var diags []Diagnostic
+	cfg = &Config{MaxIdentLength: 6, Warn: func(diag Diagnostic) {
+		diags = append(diags, diag)
+	}}
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg); err != nil || len(diags) != 0 {
+		t.Fatal("TestMaxIdentLength failed:", err, diags)
+	}
+	cfg.MaxIdentLength = 4
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", "package foo\n\nvar abcde int\n", cfg); err != nil || len(diags) != 1 ||
+		diags[0].Err.Error() != "/foo/bar.gop:3:5: identifier abcde is 5 characters long (max 4)" {
+		t.Fatal("TestMaxIdentLength failed:", err, diags)
+	}
+
+	// a variable redeclared by := is only reported where it is declared
+	const reused = `a, errTooLong := f()
+b, errTooLong := f()
+if a == b {
+	c, errTooLong := f()
+	println c, errTooLong
+}
+println errTooLong
+`
+	names = nil
+	cfg = &Config{MaxIdentLength: 5, Warn: func(diag Diagnostic) {
+		names = append(names, fmt.Sprintf("%d:%d", diag.Pos[0].Line, diag.Pos[0].Column))
+	}}
+	if _, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", reused, cfg); err != nil {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	if expected := []string{"1:4", "4:5"}; !reflect.DeepEqual(names, expected) {
+		t.Fatal("TestMaxIdentLength failed: reused:", names)
+	}
+}
+
+// -----------------------------------------------------------------------------
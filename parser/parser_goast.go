@@ -0,0 +1,381 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"fmt"
+	goast "go/ast"
+	gotoken "go/token"
+	"go/types"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// UnsupportedNodeError is returned by ToGoAST for a Go+ construct that has no
+// equivalent in Go.
+type UnsupportedNodeError struct {
+	Node ast.Node
+}
+
+func (e *UnsupportedNodeError) Error() string {
+	return fmt.Sprintf("Go+ construct %T isn't supported by go/ast", e.Node)
+}
+
+// ToGoAST converts f into the go/ast representation, so that tools based on
+// go/ast can process the Go compatible subset of Go+. Positions are kept
+// unchanged (they refer to f.Code, see ast.File.ByteOffset), comments are
+// converted too, but objects and scopes are not: the result should be
+// type-checked (e.g. by go/types) instead of relying on ast.Object.
+//
+// Go+ syntax that only differs from Go in its notation is lowered: a command
+// call such as `println "Hi"` becomes a regular call. Other Go+ constructs
+// (slice literals without type, lambdas, comprehensions, `for <-` loops,
+// range expressions, error wrapping, rational literals, operator methods and
+// raw blocks) can't be expressed in Go: ToGoAST returns an
+// *UnsupportedNodeError for the first of them.
+func ToGoAST(f *ast.File) (ret *goast.File, err error) {
+	p := &goConverter{comments: make(map[*ast.CommentGroup]*goast.CommentGroup)}
+	defer func() {
+		if e := recover(); e != nil {
+			if ue, ok := e.(*UnsupportedNodeError); ok {
+				ret, err = nil, ue
+				return
+			}
+			panic(e)
+		}
+	}()
+	comments := make([]*goast.CommentGroup, len(f.Comments))
+	for i, cg := range f.Comments {
+		comments[i] = p.commentGroup(cg)
+	}
+	decls := make([]goast.Decl, len(f.Decls))
+	for i, decl := range f.Decls {
+		decls[i] = p.decl(decl)
+	}
+	imports := make([]*goast.ImportSpec, 0, len(f.Imports))
+	for _, decl := range decls {
+		if d, ok := decl.(*goast.GenDecl); ok && d.Tok == gotoken.IMPORT {
+			for _, spec := range d.Specs {
+				imports = append(imports, spec.(*goast.ImportSpec))
+			}
+		}
+	}
+	return &goast.File{
+		Doc:      p.commentGroup(f.Doc),
+		Package:  f.Package,
+		Name:     p.ident(f.Name),
+		Decls:    decls,
+		Imports:  imports,
+		Comments: comments,
+	}, nil
+}
+
+// exprString returns the compact string form of x (see go/types.ExprString),
+// or "" if x can't be expressed in Go.
+func exprString(x ast.Expr) (ret string) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(*UnsupportedNodeError); !ok {
+				panic(e)
+			}
+		}
+	}()
+	p := &goConverter{comments: make(map[*ast.CommentGroup]*goast.CommentGroup)}
+	return types.ExprString(p.expr(x))
+}
+
+type goConverter struct {
+	comments map[*ast.CommentGroup]*goast.CommentGroup
+}
+
+func unsupported(node ast.Node) {
+	panic(&UnsupportedNodeError{Node: node})
+}
+
+// goToken converts tok to a go/token token. Go+ shares the numbering of Go
+// tokens, except for its own tokens (RAT, RARROW and QUESTION), which never
+// reach this function.
+func goToken(tok token.Token) gotoken.Token {
+	return gotoken.Token(tok)
+}
+
+func (p *goConverter) commentGroup(cg *ast.CommentGroup) *goast.CommentGroup {
+	if cg == nil {
+		return nil
+	}
+	if ret, ok := p.comments[cg]; ok {
+		return ret
+	}
+	ret := &goast.CommentGroup{List: make([]*goast.Comment, len(cg.List))}
+	for i, c := range cg.List {
+		ret.List[i] = &goast.Comment{Slash: c.Slash, Text: c.Text}
+	}
+	p.comments[cg] = ret
+	return ret
+}
+
+func (p *goConverter) ident(x *ast.Ident) *goast.Ident {
+	if x == nil {
+		return nil
+	}
+	return &goast.Ident{NamePos: x.NamePos, Name: x.Name}
+}
+
+func (p *goConverter) idents(list []*ast.Ident) []*goast.Ident {
+	if list == nil {
+		return nil
+	}
+	ret := make([]*goast.Ident, len(list))
+	for i, x := range list {
+		ret[i] = p.ident(x)
+	}
+	return ret
+}
+
+func (p *goConverter) basicLit(x *ast.BasicLit) *goast.BasicLit {
+	if x == nil {
+		return nil
+	}
+	if x.Kind == token.RAT {
+		unsupported(x)
+	}
+	return &goast.BasicLit{ValuePos: x.ValuePos, Kind: goToken(x.Kind), Value: x.Value}
+}
+
+func (p *goConverter) fieldList(x *ast.FieldList) *goast.FieldList {
+	if x == nil {
+		return nil
+	}
+	ret := &goast.FieldList{Opening: x.Opening, Closing: x.Closing}
+	if x.List != nil {
+		ret.List = make([]*goast.Field, len(x.List))
+		for i, f := range x.List {
+			ret.List[i] = &goast.Field{
+				Doc:     p.commentGroup(f.Doc),
+				Names:   p.idents(f.Names),
+				Type:    p.expr(f.Type),
+				Tag:     p.basicLit(f.Tag),
+				Comment: p.commentGroup(f.Comment),
+			}
+		}
+	}
+	return ret
+}
+
+func (p *goConverter) funcType(x *ast.FuncType) *goast.FuncType {
+	if x == nil {
+		return nil
+	}
+	return &goast.FuncType{Func: x.Func, Params: p.fieldList(x.Params), Results: p.fieldList(x.Results)}
+}
+
+func (p *goConverter) exprs(list []ast.Expr) []goast.Expr {
+	if list == nil {
+		return nil
+	}
+	ret := make([]goast.Expr, len(list))
+	for i, x := range list {
+		ret[i] = p.expr(x)
+	}
+	return ret
+}
+
+func (p *goConverter) expr(x ast.Expr) goast.Expr {
+	switch v := x.(type) {
+	case nil:
+		return nil
+	case *ast.BadExpr:
+		return &goast.BadExpr{From: v.From, To: v.To}
+	case *ast.Ident:
+		return p.ident(v)
+	case *ast.Ellipsis:
+		return &goast.Ellipsis{Ellipsis: v.Ellipsis, Elt: p.expr(v.Elt)}
+	case *ast.BasicLit:
+		return p.basicLit(v)
+	case *ast.FuncLit:
+		return &goast.FuncLit{Type: p.funcType(v.Type), Body: p.blockStmt(v.Body)}
+	case *ast.CompositeLit:
+		return &goast.CompositeLit{
+			Type: p.expr(v.Type), Lbrace: v.Lbrace, Elts: p.exprs(v.Elts), Rbrace: v.Rbrace, Incomplete: v.Incomplete}
+	case *ast.ParenExpr:
+		return &goast.ParenExpr{Lparen: v.Lparen, X: p.expr(v.X), Rparen: v.Rparen}
+	case *ast.SelectorExpr:
+		return &goast.SelectorExpr{X: p.expr(v.X), Sel: p.ident(v.Sel)}
+	case *ast.IndexExpr:
+		return &goast.IndexExpr{X: p.expr(v.X), Lbrack: v.Lbrack, Index: p.expr(v.Index), Rbrack: v.Rbrack}
+	case *ast.SliceExpr:
+		return &goast.SliceExpr{
+			X: p.expr(v.X), Lbrack: v.Lbrack, Low: p.expr(v.Low), High: p.expr(v.High), Max: p.expr(v.Max),
+			Slice3: v.Slice3, Rbrack: v.Rbrack}
+	case *ast.TypeAssertExpr:
+		return &goast.TypeAssertExpr{X: p.expr(v.X), Lparen: v.Lparen, Type: p.expr(v.Type), Rparen: v.Rparen}
+	case *ast.CallExpr:
+		ret := &goast.CallExpr{
+			Fun: p.expr(v.Fun), Lparen: v.Lparen, Args: p.exprs(v.Args), Ellipsis: v.Ellipsis, Rparen: v.Rparen}
+		if v.NoParenEnd != token.NoPos { // command call: `println "Hi"`
+			ret.Lparen, ret.Rparen = v.Fun.End(), v.NoParenEnd
+		}
+		return ret
+	case *ast.StarExpr:
+		return &goast.StarExpr{Star: v.Star, X: p.expr(v.X)}
+	case *ast.UnaryExpr:
+		return &goast.UnaryExpr{OpPos: v.OpPos, Op: goToken(v.Op), X: p.expr(v.X)}
+	case *ast.BinaryExpr:
+		return &goast.BinaryExpr{X: p.expr(v.X), OpPos: v.OpPos, Op: goToken(v.Op), Y: p.expr(v.Y)}
+	case *ast.KeyValueExpr:
+		return &goast.KeyValueExpr{Key: p.expr(v.Key), Colon: v.Colon, Value: p.expr(v.Value)}
+	case *ast.ArrayType:
+		return &goast.ArrayType{Lbrack: v.Lbrack, Len: p.expr(v.Len), Elt: p.expr(v.Elt)}
+	case *ast.StructType:
+		return &goast.StructType{Struct: v.Struct, Fields: p.fieldList(v.Fields), Incomplete: v.Incomplete}
+	case *ast.FuncType:
+		return p.funcType(v)
+	case *ast.InterfaceType:
+		return &goast.InterfaceType{Interface: v.Interface, Methods: p.fieldList(v.Methods), Incomplete: v.Incomplete}
+	case *ast.MapType:
+		return &goast.MapType{Map: v.Map, Key: p.expr(v.Key), Value: p.expr(v.Value)}
+	case *ast.ChanType:
+		return &goast.ChanType{Begin: v.Begin, Arrow: v.Arrow, Dir: goast.ChanDir(v.Dir), Value: p.expr(v.Value)}
+	}
+	unsupported(x)
+	return nil
+}
+
+func (p *goConverter) blockStmt(x *ast.BlockStmt) *goast.BlockStmt {
+	if x == nil {
+		return nil
+	}
+	return &goast.BlockStmt{Lbrace: x.Lbrace, List: p.stmts(x.List), Rbrace: x.Rbrace}
+}
+
+func (p *goConverter) callExpr(x *ast.CallExpr) *goast.CallExpr {
+	if x == nil {
+		return nil
+	}
+	return p.expr(x).(*goast.CallExpr)
+}
+
+func (p *goConverter) stmts(list []ast.Stmt) []goast.Stmt {
+	if list == nil {
+		return nil
+	}
+	ret := make([]goast.Stmt, len(list))
+	for i, s := range list {
+		ret[i] = p.stmt(s)
+	}
+	return ret
+}
+
+func (p *goConverter) stmt(s ast.Stmt) goast.Stmt {
+	switch v := s.(type) {
+	case nil:
+		return nil
+	case *ast.BadStmt:
+		return &goast.BadStmt{From: v.From, To: v.To}
+	case *ast.DeclStmt:
+		return &goast.DeclStmt{Decl: p.decl(v.Decl)}
+	case *ast.EmptyStmt:
+		return &goast.EmptyStmt{Semicolon: v.Semicolon, Implicit: v.Implicit}
+	case *ast.LabeledStmt:
+		return &goast.LabeledStmt{Label: p.ident(v.Label), Colon: v.Colon, Stmt: p.stmt(v.Stmt)}
+	case *ast.ExprStmt:
+		return &goast.ExprStmt{X: p.expr(v.X)}
+	case *ast.SendStmt:
+		return &goast.SendStmt{Chan: p.expr(v.Chan), Arrow: v.Arrow, Value: p.expr(v.Value)}
+	case *ast.IncDecStmt:
+		return &goast.IncDecStmt{X: p.expr(v.X), TokPos: v.TokPos, Tok: goToken(v.Tok)}
+	case *ast.AssignStmt:
+		return &goast.AssignStmt{Lhs: p.exprs(v.Lhs), TokPos: v.TokPos, Tok: goToken(v.Tok), Rhs: p.exprs(v.Rhs)}
+	case *ast.GoStmt:
+		return &goast.GoStmt{Go: v.Go, Call: p.callExpr(v.Call)}
+	case *ast.DeferStmt:
+		return &goast.DeferStmt{Defer: v.Defer, Call: p.callExpr(v.Call)}
+	case *ast.ReturnStmt:
+		return &goast.ReturnStmt{Return: v.Return, Results: p.exprs(v.Results)}
+	case *ast.BranchStmt:
+		return &goast.BranchStmt{TokPos: v.TokPos, Tok: goToken(v.Tok), Label: p.ident(v.Label)}
+	case *ast.BlockStmt:
+		return p.blockStmt(v)
+	case *ast.IfStmt:
+		return &goast.IfStmt{If: v.If, Init: p.stmt(v.Init), Cond: p.expr(v.Cond), Body: p.blockStmt(v.Body), Else: p.stmt(v.Else)}
+	case *ast.CaseClause:
+		return &goast.CaseClause{Case: v.Case, List: p.exprs(v.List), Colon: v.Colon, Body: p.stmts(v.Body)}
+	case *ast.SwitchStmt:
+		return &goast.SwitchStmt{Switch: v.Switch, Init: p.stmt(v.Init), Tag: p.expr(v.Tag), Body: p.blockStmt(v.Body)}
+	case *ast.TypeSwitchStmt:
+		return &goast.TypeSwitchStmt{Switch: v.Switch, Init: p.stmt(v.Init), Assign: p.stmt(v.Assign), Body: p.blockStmt(v.Body)}
+	case *ast.CommClause:
+		return &goast.CommClause{Case: v.Case, Comm: p.stmt(v.Comm), Colon: v.Colon, Body: p.stmts(v.Body)}
+	case *ast.SelectStmt:
+		return &goast.SelectStmt{Select: v.Select, Body: p.blockStmt(v.Body)}
+	case *ast.ForStmt:
+		return &goast.ForStmt{For: v.For, Init: p.stmt(v.Init), Cond: p.expr(v.Cond), Post: p.stmt(v.Post), Body: p.blockStmt(v.Body)}
+	case *ast.RangeStmt:
+		return &goast.RangeStmt{
+			For: v.For, Key: p.expr(v.Key), Value: p.expr(v.Value), TokPos: v.TokPos, Tok: goToken(v.Tok),
+			X: p.expr(v.X), Body: p.blockStmt(v.Body)}
+	}
+	unsupported(s)
+	return nil
+}
+
+func (p *goConverter) spec(s ast.Spec) goast.Spec {
+	switch v := s.(type) {
+	case *ast.ImportSpec:
+		return &goast.ImportSpec{
+			Doc: p.commentGroup(v.Doc), Name: p.ident(v.Name), Path: p.basicLit(v.Path),
+			Comment: p.commentGroup(v.Comment), EndPos: v.EndPos}
+	case *ast.ValueSpec:
+		return &goast.ValueSpec{
+			Doc: p.commentGroup(v.Doc), Names: p.idents(v.Names), Type: p.expr(v.Type), Values: p.exprs(v.Values),
+			Comment: p.commentGroup(v.Comment)}
+	case *ast.TypeSpec:
+		return &goast.TypeSpec{
+			Doc: p.commentGroup(v.Doc), Name: p.ident(v.Name), Assign: v.Assign, Type: p.expr(v.Type),
+			Comment: p.commentGroup(v.Comment)}
+	}
+	unsupported(s)
+	return nil
+}
+
+func (p *goConverter) decl(d ast.Decl) goast.Decl {
+	switch v := d.(type) {
+	case *ast.BadDecl:
+		return &goast.BadDecl{From: v.From, To: v.To}
+	case *ast.GenDecl:
+		specs := make([]goast.Spec, len(v.Specs))
+		for i, s := range v.Specs {
+			specs[i] = p.spec(s)
+		}
+		return &goast.GenDecl{
+			Doc: p.commentGroup(v.Doc), TokPos: v.TokPos, Tok: goToken(v.Tok), Lparen: v.Lparen, Specs: specs, Rparen: v.Rparen}
+	case *ast.FuncDecl:
+		if v.Operator {
+			unsupported(v)
+		}
+		return &goast.FuncDecl{
+			Doc: p.commentGroup(v.Doc), Recv: p.fieldList(v.Recv), Name: p.ident(v.Name),
+			Type: p.funcType(v.Type), Body: p.blockStmt(v.Body)}
+	}
+	unsupported(d)
+	return nil
+}
+
+// -----------------------------------------------------------------------------
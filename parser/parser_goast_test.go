@@ -0,0 +1,81 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"go/format"
+	goparser "go/parser"
+	"strings"
+	"testing"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestToGoAST(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", `import "fmt"
+
+// Point is a point.
+type Point struct {
+	X, Y int
+}
+
+for i := 0; i < 3; i++ {
+	fmt.Println(Point{i, i * 2})
+}
+println "Hi"
+`, ParseComments)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	gof, err := ToGoAST(f)
+	if err != nil {
+		t.Fatal("ToGoAST failed:", err)
+	}
+	if len(gof.Imports) != 1 || len(gof.Decls) != 3 {
+		t.Fatal("ToGoAST failed:", len(gof.Imports), len(gof.Decls))
+	}
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, gof); err != nil {
+		t.Fatal("format.Node failed:", err)
+	}
+	src := buf.String()
+	for _, s := range []string{"// Point is a point.", "func main() {", `println("Hi")`} {
+		if !strings.Contains(src, s) {
+			t.Fatalf("ToGoAST: %q not found in\n%s", s, src)
+		}
+	}
+	if _, err = goparser.ParseFile(token.NewFileSet(), "bar.go", src, 0); err != nil {
+		t.Fatal("ToGoAST: invalid Go source:", err, "\n"+src)
+	}
+}
+
+func TestToGoASTUnsupported(t *testing.T) {
+	f := parseTestFile(t, "/foo/bar.gop", "a := [1, 2, 3]\n", 0)
+	_, err := ToGoAST(f)
+	if e, ok := err.(*UnsupportedNodeError); !ok {
+		t.Fatal("ToGoAST: unexpected error", err)
+	} else if _, ok = e.Node.(*ast.SliceLit); !ok {
+		t.Fatalf("ToGoAST: unexpected node %T\n", e.Node)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -18,17 +18,29 @@ package parser
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
+	goparser "go/parser"
+	gotoken "go/token"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/goplus/gop/ast"
 	"github.com/goplus/gop/scanner"
 	"github.com/goplus/gop/token"
+	"github.com/qiniu/x/log"
 )
 
 const (
@@ -42,14 +54,34 @@ var (
 	debugParseError  bool
 )
 
+// SetDebug sets the default debug flags, used by the calls whose Config has no
+// Logger: their debug output is written to the standard logger (log.Std). By
+// default there is no debug output.
 func SetDebug(dbgFlags int) {
 	debugParseOutput = (dbgFlags & DbgFlagParseOutput) != 0
 	debugParseError = (dbgFlags & DbgFlagParseError) != 0
 }
 
+func (p *parser) initDebug(cfg *Config) {
+	if cfg.Logger != nil {
+		p.debugOutput = (cfg.DebugFlags & DbgFlagParseOutput) != 0
+		p.debugError = (cfg.DebugFlags & DbgFlagParseError) != 0
+		p.logger = log.New(cfg.Logger, "", log.Ldefault)
+	} else {
+		p.debugOutput, p.debugError = debugParseOutput, debugParseError
+		p.logger = log.Std
+	}
+}
+
 // -----------------------------------------------------------------------------
 
 // FileSystem represents a file system.
+//
+// The implementation controls the style of its paths: the functions parsing
+// a directory build the name of each file by Join (such as the keys of the
+// Files map of ast.Package), and pass it back to ReadFile as is. Both '/' and
+// '\\' are taken as separators to get the base name and the extension of a
+// file, whatever the OS.
 type FileSystem interface {
 	ReadDir(dirname string) ([]os.FileInfo, error)
 	ReadFile(filename string) ([]byte, error)
@@ -62,6 +94,10 @@ func (p localFS) ReadDir(dirname string) ([]os.FileInfo, error) {
 	return ioutil.ReadDir(dirname)
 }
 
+func (p localFS) ReadDirEntries(dirname string) ([]os.DirEntry, error) {
+	return os.ReadDir(dirname)
+}
+
 func (p localFS) ReadFile(filename string) ([]byte, error) {
 	return ioutil.ReadFile(filename)
 }
@@ -70,6 +106,85 @@ func (p localFS) Join(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
+func (p localFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Stater is implemented by a FileSystem that can report the information of a
+// single file, such as its modification time, without reading its directory.
+// It is optional, so that existing FileSystem implementations keep working:
+// see Stat.
+type Stater interface {
+	Stat(name string) (os.FileInfo, error)
+}
+
+// DirEntryReader is implemented by a FileSystem that can list a directory
+// without getting the information (os.FileInfo) of each entry, which costs a
+// stat call per entry on a local file system. It is optional, so that existing
+// FileSystem implementations keep working: the functions parsing directories
+// call ReadDirEntries if available, and ReadDir otherwise.
+type DirEntryReader interface {
+	ReadDirEntries(dirname string) ([]os.DirEntry, error)
+}
+
+// readDirEntries reads the directory dirname of fs, by fs.ReadDirEntries if
+// fs is a DirEntryReader. The entries are sorted by name, whatever the order
+// of fs, so that the files of a directory are always parsed in the same order
+// and the first error reported is reproducible.
+func readDirEntries(fs FileSystem, dirname string) ([]os.DirEntry, error) {
+	if r, ok := fs.(DirEntryReader); ok {
+		entries, err := r.ReadDirEntries(dirname)
+		if err != nil {
+			return nil, err
+		}
+		less := func(i, j int) bool { return entries[i].Name() < entries[j].Name() }
+		if !sort.SliceIsSorted(entries, less) {
+			// don't sort in place: fs may have cached its result
+			entries = append([]os.DirEntry(nil), entries...)
+			sort.Slice(entries, less)
+		}
+		return entries, nil
+	}
+	list, err := fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]os.DirEntry, len(list))
+	for i, fi := range list {
+		entries[i] = &fileInfoEntry{info: fi}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat returns the information of the file name of fs, e.g. to tell whether
+// a cached AST is stale. It calls fs.Stat if fs is a Stater, otherwise it
+// looks up name in the result of fs.ReadDir on its directory.
+//
+// ParseFSDir itself never calls Stat: it passes the information returned by
+// fs.ReadDir to the filter.
+func Stat(fs FileSystem, name string) (os.FileInfo, error) {
+	if s, ok := fs.(Stater); ok {
+		return s.Stat(name)
+	}
+	dir, base := ".", baseName(name)
+	if i := len(name) - len(base) - 1; i > 0 {
+		dir = name[:i]
+	} else if i == 0 {
+		dir = name[:1]
+	}
+	list, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range list {
+		if fi.Name() == base {
+			return fi, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
 var local FileSystem = localFS{}
 
 // Parse parses a single Go+ source file. The target specifies the Go+ source file.
@@ -113,125 +228,1180 @@ func ParseDir(fset *token.FileSet, path string, filter func(os.FileInfo) bool, m
 //
 // If the directory couldn't be read, a nil map and the respective error are
 // returned. If a parse error occurred, a non-nil but incomplete map and the
-// first error encountered are returned.
+// first error encountered are returned, files being parsed in name order
+// whatever the order of fs.ReadDir. Two files that fs.Join maps to the
+// same path are an error too: only the first one is in the map.
 //
 func ParseFSDir(fset *token.FileSet, fs FileSystem, path string, filter func(os.FileInfo) bool, mode Mode) (pkgs map[string]*ast.Package, first error) {
-	list, err := fs.ReadDir(path)
+	return ParseFSDirContext(context.Background(), fset, fs, path, filter, mode)
+}
+
+// ParseFSDirContext calls ParseFSDir, but stops parsing the files of the
+// directory as soon as ctx is done (ctx is checked before each file): then the
+// packages of the files parsed so far and ctx.Err() are returned.
+func ParseFSDirContext(
+	ctx context.Context, fset *token.FileSet, fs FileSystem, path string,
+	filter func(os.FileInfo) bool, mode Mode) (pkgs map[string]*ast.Package, first error) {
+	return parseFSDirConfig(ctx, fset, fs, path, filter, &Config{Mode: mode})
+}
+
+// ParseFSDirConfig calls ParseFSDir with the options specified by cfg, which
+// apply to each file parsed.
+func ParseFSDirConfig(fset *token.FileSet, fs FileSystem, path string, filter func(os.FileInfo) bool, cfg *Config) (pkgs map[string]*ast.Package, first error) {
+	return parseFSDirConfig(context.Background(), fset, fs, path, filter, cfg)
+}
+
+// ParseFSDirFileType is like ParseFSDir, but filter also receives the file
+// type detected from the extension of each file, e.g. to parse the class
+// files only. filter is only called for the files that ParseFSDir would
+// parse otherwise, so ft is never the type of an unknown extension.
+func ParseFSDirFileType(
+	fset *token.FileSet, fs FileSystem, path string,
+	filter func(fi os.FileInfo, ft ast.FileType) bool, mode Mode) (pkgs map[string]*ast.Package, first error) {
+	var fiFilter func(os.FileInfo) bool
+	if filter != nil {
+		fiFilter = func(fi os.FileInfo) bool {
+			ft, _ := lookupFileType(nameExt(fi.Name()))
+			return filter(fi, ft)
+		}
+	}
+	return ParseFSDir(fset, fs, path, fiFilter, mode)
+}
+
+func parseFSDirConfig(
+	ctx context.Context, fset *token.FileSet, fs FileSystem, path string,
+	filter func(os.FileInfo) bool, cfg *Config) (pkgs map[string]*ast.Package, first error) {
+	pkgs, err := parseFSDir(ctx, fset, fs, path, filter, cfg, func(filename string, err error) {
+		if first == nil {
+			first = err
+		}
+	})
+	if err != nil {
+		return pkgs, err
+	}
+	return
+}
+
+// ParseFSDirAll calls ParseFSDir, but reports the errors of all files instead
+// of the first one only: if parse errors occurred, a non-nil but incomplete
+// map and a scanner.ErrorList holding the errors of all files are returned,
+// sorted by filename and position. An error that isn't a syntax error (such as
+// a file that couldn't be read) is reported at the beginning of its file.
+//
+// If the directory couldn't be read, a nil map and the respective error are
+// returned.
+func ParseFSDirAll(fset *token.FileSet, fs FileSystem, path string, filter func(os.FileInfo) bool, mode Mode) (pkgs map[string]*ast.Package, err error) {
+	var errs scanner.ErrorList
+	pkgs, err = parseFSDir(context.Background(), fset, fs, path, filter, &Config{Mode: mode}, func(filename string, err error) {
+		if list, ok := errorList(err); ok {
+			errs = append(errs, list...)
+		} else {
+			errs.Add(token.Position{Filename: filename}, err.Error())
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
+	errs.Sort()
+	return pkgs, errs.Err()
+}
+
+// ParseFSDirErrors calls ParseFSDir, but also returns the error of each file
+// that couldn't be read or parsed, keyed by file path, so that callers can
+// tell an I/O failure (such as an *os.PathError) from a syntax error (a
+// scanner.ErrorList) for each file. first is the error ParseFSDir returns. If
+// the directory couldn't be read, nil maps and the respective error are
+// returned.
+func ParseFSDirErrors(
+	fset *token.FileSet, fs FileSystem, path string,
+	filter func(os.FileInfo) bool, mode Mode) (pkgs map[string]*ast.Package, errs map[string]error, first error) {
+	errs = make(map[string]error)
+	pkgs, err := parseFSDir(context.Background(), fset, fs, path, filter, &Config{Mode: mode}, func(filename string, err error) {
+		if first == nil {
+			first = err
+		}
+		errs[filename] = err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func parseFSDir(
+	ctx context.Context, fset *token.FileSet, fs FileSystem, path string, filter func(os.FileInfo) bool, cfg *Config,
+	onError func(filename string, err error)) (pkgs map[string]*ast.Package, err error) {
+	if pattern := cfg.FilePattern; pattern != "" {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		next := filter
+		filter = func(d os.FileInfo) bool {
+			matched, _ := filepath.Match(pattern, d.Name())
+			return matched && (next == nil || next(d))
+		}
+	}
+	list, err := readDirEntries(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	return parseFSDirList(ctx, fset, fs, path, list, filter, cfg, onError)
+}
+
+// parseFSDirList parses the files of list, the entries of directory path. If
+// ctx is done before all files are parsed, it returns the packages parsed so
+// far and ctx.Err().
+func parseFSDirList(
+	ctx context.Context, fset *token.FileSet, fs FileSystem, path string, list []os.DirEntry, filter func(os.FileInfo) bool, cfg *Config,
+	onError func(filename string, err error)) (pkgs map[string]*ast.Package, err error) {
 	pkgs = make(map[string]*ast.Package)
 	for _, d := range list {
-		if d.IsDir() {
-			continue
+		if _, isOk := dirFileType(d, filter, cfg.Mode); isOk {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			filename := fs.Join(path, d.Name())
+			start := time.Now()
+			filedata, err := fs.ReadFile(filename)
+			var src *ast.File
+			if err == nil {
+				src, err = parseFSFileConfig(fset, fs, filename, filedata, cfg)
+			}
+			if err == nil {
+				err = addPkgFile(pkgs, filename, src, cfg.Mode)
+			}
+			if err != nil {
+				onError(filename, err)
+				src = nil
+			}
+			if cfg.FileParsed != nil {
+				cfg.FileParsed(filename, src, err, time.Since(start))
+			}
 		}
-		fname := d.Name()
-		ext := filepath.Ext(fname)
-		ft, isOk := extGopFiles[ext]
-		if ft == ast.FileTypeGo && (mode&ParseGoFiles) == 0 {
-			isOk = false
-		}
-		if isOk && !strings.HasPrefix(fname, "_") && (filter == nil || filter(d)) {
-			filename := fs.Join(path, fname)
-			if filedata, err := fs.ReadFile(filename); err == nil {
-				if src, err := ParseFSFile(fset, fs, filename, filedata, mode); err == nil {
-					name := src.Name.Name
-					pkg, found := pkgs[name]
-					if !found {
-						pkg = &ast.Package{
-							Name:  name,
-							Files: make(map[string]*ast.File),
-						}
-						pkgs[name] = pkg
-					}
-					pkg.Files[filename] = src
-				} else if first == nil {
-					first = err
+	}
+	return
+}
+
+// ParseFSDirConcurrent is like ParseFSDir, but parses the files concurrently
+// using up to runtime.GOMAXPROCS(0) goroutines. The result is the same as the
+// one of ParseFSDir: the first error is the one of the first file in filename
+// order, whatever the order the files are parsed in. Only the bases of the
+// files added to fset depend on the scheduling.
+func ParseFSDirConcurrent(fset *token.FileSet, fs FileSystem, path string, filter func(os.FileInfo) bool, mode Mode) (pkgs map[string]*ast.Package, first error) {
+	list, err := readDirEntries(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, d := range list {
+		if _, isOk := dirFileType(d, filter, mode); isOk {
+			filenames = append(filenames, fs.Join(path, d.Name()))
+		}
+	}
+	sort.Strings(filenames)
+
+	type result struct {
+		f   *ast.File
+		err error
+	}
+	results := make([]result, len(filenames))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	cfg := &Config{Mode: mode}
+	for n := runtime.GOMAXPROCS(0); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				filename := filenames[i]
+				filedata, err := fs.ReadFile(filename)
+				if err == nil {
+					results[i].f, err = parseFSFileConfig(fset, fs, filename, filedata, cfg)
 				}
-			} else if first == nil {
-				first = err
+				results[i].err = err
 			}
+		}()
+	}
+	for i := range filenames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	pkgs = make(map[string]*ast.Package)
+	for i, ret := range results {
+		err := ret.err
+		if err == nil {
+			err = addPkgFile(pkgs, filenames[i], ret.f, mode)
+		}
+		if err != nil && first == nil {
+			first = err
 		}
 	}
 	return
 }
 
+// ParseFSDirRecursive calls ParseFSDir for the directory specified by path
+// and all its subdirectories, and returns a map of directory -> package name
+// -> package AST. Only the directories holding packages are in the map.
+// Subdirectories whose name begins with "_" or "." are skipped, like files
+// whose name begins with "_" are. filter and mode apply to the files of all
+// directories; filter isn't called for directories.
+//
+// If path couldn't be read, a nil map and the respective error are returned.
+// Otherwise, if an error occurred (including a subdirectory that couldn't be
+// read), a non-nil but incomplete map and the first error encountered are
+// returned, directories being visited in name order.
+func ParseFSDirRecursive(
+	fset *token.FileSet, fs FileSystem, path string,
+	filter func(os.FileInfo) bool, mode Mode) (dirs map[string]map[string]*ast.Package, first error) {
+	return ParseFSDirRecursiveFilter(fset, fs, path, nil, filter, mode)
+}
+
+// ParseFSDirRecursiveFilter is like ParseFSDirRecursive, but only descends
+// into the subdirectories d (whose path is dirname) for which dirFilter
+// returns true, e.g. to skip vendor directories: a directory pruned this way
+// isn't read at all. If dirFilter is nil, the subdirectories whose name begins
+// with "_" or "." are skipped, as ParseFSDirRecursive does; a dirFilter
+// replaces this default.
+func ParseFSDirRecursiveFilter(
+	fset *token.FileSet, fs FileSystem, path string, dirFilter func(dirname string, d os.FileInfo) bool,
+	filter func(os.FileInfo) bool, mode Mode) (dirs map[string]map[string]*ast.Package, first error) {
+	list, err := readDirEntries(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	dirs = make(map[string]map[string]*ast.Package)
+	onError := func(filename string, err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	if dirFilter == nil {
+		dirFilter = defaultDirFilter
+	}
+	parseFSDirRecursive(fset, fs, path, list, dirFilter, filter, &Config{Mode: mode}, dirs, onError)
+	return
+}
+
+// defaultDirFilter skips the directories whose name begins with "_" or ".",
+// like ParseFSDir skips the files whose name begins with "_".
+func defaultDirFilter(dirname string, d os.FileInfo) bool {
+	name := d.Name()
+	return !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".")
+}
+
+func parseFSDirRecursive(
+	fset *token.FileSet, fs FileSystem, path string, list []os.DirEntry,
+	dirFilter func(dirname string, d os.FileInfo) bool, filter func(os.FileInfo) bool, cfg *Config,
+	dirs map[string]map[string]*ast.Package, onError func(filename string, err error)) {
+	if pkgs, _ := parseFSDirList(context.Background(), fset, fs, path, list, filter, cfg, onError); len(pkgs) > 0 {
+		dirs[path] = pkgs
+	}
+	for _, d := range list {
+		if !d.IsDir() {
+			continue
+		}
+		if dir := fs.Join(path, d.Name()); dirFilter(dir, entryInfo(d)) {
+			sub, err := readDirEntries(fs, dir)
+			if err != nil {
+				onError(dir, err)
+				continue
+			}
+			parseFSDirRecursive(fset, fs, dir, sub, dirFilter, filter, cfg, dirs, onError)
+		}
+	}
+}
+
+// ParseFiles calls ParseFile for each file of filenames and returns a map of
+// package name -> package AST with all the packages found, like ParseFSDir
+// does for the files of a directory.
+//
+// If a parse error occurred, the remaining files are parsed anyway: a non-nil
+// but incomplete map and the first error encountered are returned.
+func ParseFiles(fset *token.FileSet, filenames []string, mode Mode) (pkgs map[string]*ast.Package, first error) {
+	return ParseFSFiles(fset, local, filenames, mode)
+}
+
+// ParseFSFiles is like ParseFiles, but reads the files from fs. The filenames
+// are passed to fs.ReadFile as given, and are the keys of the files in the
+// returned packages.
+func ParseFSFiles(fset *token.FileSet, fs FileSystem, filenames []string, mode Mode) (pkgs map[string]*ast.Package, first error) {
+	pkgs = make(map[string]*ast.Package)
+	for _, filename := range filenames {
+		src, err := ParseFSFile(fset, fs, filename, nil, mode)
+		if err == nil {
+			err = addPkgFile(pkgs, filename, src, mode)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return
+}
+
+// addPkgFile adds the file src to its package in pkgs. It is an error if
+// pkgs already holds a file named filename, such as two files of a directory
+// that a FileSystem joins into the same path: the first one is kept.
+func addPkgFile(pkgs map[string]*ast.Package, filename string, src *ast.File, mode Mode) error {
+	for _, pkg := range pkgs {
+		if _, ok := pkg.Files[filename]; ok {
+			return fmt.Errorf("%s: duplicate file path", filename)
+		}
+	}
+	name := src.Name.Name
+	if mode&ParseTestFiles != 0 && strings.HasSuffix(filename, testFileSuffix) && !strings.HasSuffix(name, "_test") {
+		name += "_test"
+	}
+	pkg, found := pkgs[name]
+	if !found {
+		pkg = &ast.Package{
+			Name:  name,
+			Files: make(map[string]*ast.File),
+		}
+		pkgs[name] = pkg
+	}
+	pkg.Files[filename] = src
+	return nil
+}
+
+// SplitGoFiles splits the files of pkg, as returned by ParseFSDir with the
+// ParseGoFiles mode, into the Go files (of FileTypeGo) and the Go+ files (of
+// any other file type, including class files), both keyed by filename. A map
+// without files is nil.
+func SplitGoFiles(pkg *ast.Package) (goFiles, gopFiles map[string]*ast.File) {
+	for filename, f := range pkg.Files {
+		if f.FileType == ast.FileTypeGo {
+			if goFiles == nil {
+				goFiles = make(map[string]*ast.File)
+			}
+			goFiles[filename] = f
+		} else {
+			if gopFiles == nil {
+				gopFiles = make(map[string]*ast.File)
+			}
+			gopFiles[filename] = f
+		}
+	}
+	return
+}
+
+// testFileSuffix is the suffix of the name of a test file.
+const testFileSuffix = "_test.gop"
+
+// dirFileType reports whether ParseFSDir parses the directory entry d, and
+// the file type of d if so. The information of d is only got for filter.
+func dirFileType(d os.DirEntry, filter func(os.FileInfo) bool, mode Mode) (ft ast.FileType, isOk bool) {
+	if d.IsDir() {
+		return
+	}
+	fname := d.Name()
+	ft, isOk = lookupFileType(nameExt(fname))
+	if ft == ast.FileTypeGo && (mode&ParseGoFiles) == 0 {
+		isOk = false
+	}
+	isOk = isOk && !strings.HasPrefix(fname, "_") && (filter == nil || filter(entryInfo(d)))
+	return
+}
+
 var (
+	// extMutex guards extGopFiles, extEntrypoints, extRawBlocks and
+	// extMethodEntries, which can be registered while files are parsed.
+	extMutex sync.RWMutex
+
+	extEntrypoints = map[string]string{} // see RegisterFileTypeEx
+
 	extGopFiles = map[string]ast.FileType{
-		".go":  ast.FileTypeGo,
-		".gop": ast.FileTypeGop,
-		".spx": ast.FileTypeSpx,
-		".gmx": ast.FileTypeGmx,
-		".spc": ast.FileTypeGmx, // TODO: dynamic register
+		".go":     ast.FileTypeGo,
+		".gop":    ast.FileTypeGop,
+		".spx":    ast.FileTypeSpx,
+		".gmx":    ast.FileTypeGmx,
+		".spc":    ast.FileTypeGmx, // TODO: dynamic register
+		".gop.go": ast.FileTypeGop, // Go+ code generated as a .go file
 	}
 )
 
-// RegisterFileType registers a new Go+ class file type.
-func RegisterFileType(ext string, format ast.FileType) {
-	if format != ast.FileTypeSpx && format != ast.FileTypeGmx {
-		panic("RegisterFileType: format should be FileTypeSpx or FileTypeGmx")
+// RegisterFileType registers a new Go+ file type: files with extension ext
+// are parsed as files of type format, such as FileTypeGop for plain Go+
+// scripts, or FileTypeSpx and FileTypeGmx for class files. It returns an error
+// if ext is already registered, and panics if format isn't a valid file type.
+// ext may have several dots, such as .spx.go: the file type of a
+// file is selected by the longest registered suffix of its name.
+func RegisterFileType(ext string, format ast.FileType) error {
+	return RegisterFileTypeEx(ext, format, "")
+}
+
+// MustRegisterFileType is like RegisterFileType, but panics if ext is already
+// registered.
+func MustRegisterFileType(ext string, format ast.FileType) {
+	if err := RegisterFileType(ext, format); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterFileTypeEx registers a new Go+ file type, whose headless files get
+// the statements wrapped into entrypoint (such as `func Run()`) instead of
+// the entrypoint of format (`func Main()` for FileTypeSpx, `func MainEntry()`
+// for FileTypeGmx and `func main()` otherwise). An empty entrypoint selects the one of
+// format. RegisterMethodEntry takes precedence over entrypoint. Like
+// RegisterFileType, it returns an error if ext is already registered.
+func RegisterFileTypeEx(ext string, format ast.FileType, entrypoint string) error {
+	return registerFileType(ext, format, entrypoint, false)
+}
+
+// RegisterFileTypeForce is like RegisterFileTypeEx, but if ext is already
+// registered, its file type and entrypoint are replaced instead of failing,
+// e.g. for a plugin to change the interpretation of .spc files. It still
+// panics if ext is a built-in file type (.go, .gop, .spx, .gmx or .gop.go).
+func RegisterFileTypeForce(ext string, format ast.FileType, entrypoint string) {
+	switch ext {
+	case ".go", ".gop", ".spx", ".gmx", ".gop.go":
+		panic("RegisterFileTypeForce: can't override built-in file type " + ext)
 	}
-	if _, ok := extGopFiles[ext]; ok {
-		panic("RegisterFileType: file type exists")
+	registerFileType(ext, format, entrypoint, true)
+}
+
+func registerFileType(ext string, format ast.FileType, entrypoint string, force bool) error {
+	switch format {
+	case ast.FileTypeGo, ast.FileTypeGop, ast.FileTypeSpx, ast.FileTypeGmx:
+	default:
+		panic(fmt.Sprintf("RegisterFileType: invalid format %s", fileTypeName(format)))
+	}
+	extMutex.Lock()
+	defer extMutex.Unlock()
+	if ft, ok := extGopFiles[ext]; ok && !force {
+		return fmt.Errorf("RegisterFileType: file type %s exists (%s)", ext, fileTypeName(ft))
 	}
 	extGopFiles[ext] = format
+	if entrypoint != "" {
+		extEntrypoints[ext] = entrypoint
+	} else {
+		delete(extEntrypoints, ext)
+	}
+	return nil
+}
+
+// fileTypeName returns the name of the constant of ft, such as FileTypeSpx.
+func fileTypeName(ft ast.FileType) string {
+	switch ft {
+	case ast.FileTypeGo:
+		return "FileTypeGo"
+	case ast.FileTypeGop:
+		return "FileTypeGop"
+	case ast.FileTypeSpx:
+		return "FileTypeSpx"
+	case ast.FileTypeGmx:
+		return "FileTypeGmx"
+	}
+	return fmt.Sprintf("FileType(%d)", ft)
+}
+
+// UnregisterFileType removes the file type ext registered by
+// RegisterFileType (or RegisterFileTypeEx), and its method entrypoint (see RegisterMethodEntry) if
+// any. Files with extension ext are then parsed as .gop files. It does nothing
+// if ext isn't registered, and panics if ext is a built-in file type (.go,
+// .gop, .spx, .gmx or .gop.go).
+func UnregisterFileType(ext string) {
+	switch ext {
+	case ".go", ".gop", ".spx", ".gmx", ".gop.go":
+		panic("UnregisterFileType: can't unregister built-in file type " + ext)
+	}
+	extMutex.Lock()
+	defer extMutex.Unlock()
+	delete(extGopFiles, ext)
+	delete(extEntrypoints, ext)
+	delete(extMethodEntries, ext)
+}
+
+// RegisteredFileTypes returns the extensions of the files recognized by the
+// parser (built-in ones and those registered by RegisterFileType and its
+// variants), with their file types. The result is a copy: changing it
+// doesn't change the registrations.
+func RegisteredFileTypes() map[string]ast.FileType {
+	extMutex.RLock()
+	defer extMutex.RUnlock()
+	ret := make(map[string]ast.FileType, len(extGopFiles))
+	for ext, ft := range extGopFiles {
+		ret[ext] = ft
+	}
+	return ret
+}
+
+// DetectFileType returns the file type ParseFile gives to filename by
+// default: the one registered for its extension (the longest registered
+// suffix of its name, ignoring a .gz suffix), or FileTypeGop if the extension
+// isn't registered. It is safe to call while file types are registered.
+func DetectFileType(filename string) ast.FileType {
+	ft, _ := lookupFileType(fileExt(filename))
+	return ft
+}
+
+func lookupEntrypoint(ext string) string {
+	extMutex.RLock()
+	defer extMutex.RUnlock()
+	return extEntrypoints[ext]
+}
+
+func lookupFileType(ext string) (ft ast.FileType, ok bool) {
+	extMutex.RLock()
+	ft, ok = extGopFiles[ext]
+	extMutex.RUnlock()
+	return
+}
+
+var (
+	extRawBlocks = map[string]map[string]bool{}
+)
+
+// RegisterRawBlock registers kind as a block of an embedded language in files
+// with extension ext. A top-level `kind { ... }` block of such files isn't
+// parsed as Go+: its raw text is captured into an ast.RawBlock declaration
+// instead (see scanner.Scanner.ScanRawBlock for how nesting and escaping of
+// braces are handled).
+func RegisterRawBlock(ext, kind string) {
+	extMutex.Lock()
+	defer extMutex.Unlock()
+	// copy on write: the kinds returned by lookupRawBlocks are read unlocked
+	old := extRawBlocks[ext]
+	kinds := make(map[string]bool, len(old)+1)
+	for k := range old {
+		kinds[k] = true
+	}
+	kinds[kind] = true
+	extRawBlocks[ext] = kinds
+}
+
+func lookupRawBlocks(filename string) map[string]bool {
+	extMutex.RLock()
+	defer extMutex.RUnlock()
+	return extRawBlocks[fileExt(filename)]
+}
+
+var (
+	extMethodEntries = map[string]string{}
+)
+
+// RegisterMethodEntry makes the statements of a headless class file with
+// extension ext a method of the class: they are wrapped into
+// `func (this *T) Main()` instead of a plain entrypoint function, so that
+// they can operate on `this`. T is recvType, or the name of the file
+// (without extension) if recvType is empty. The receiver is recorded in
+// ast.NoEntry_.Recv.
+//
+// ext must be registered as a class file type by RegisterFileType.
+func RegisterMethodEntry(ext, recvType string) {
+	extMutex.Lock()
+	defer extMutex.Unlock()
+	if _, ok := extGopFiles[ext]; !ok || ext == ".go" || ext == ".gop" {
+		panic("RegisterMethodEntry: " + ext + " isn't a class file type")
+	}
+	extMethodEntries[ext] = recvType
+}
+
+// methodEntryRecv returns the receiver of the entrypoint injected into
+// filename, such as `this *T`, if its extension is registered by
+// RegisterMethodEntry.
+func methodEntryRecv(filename string) (recv string, ok bool) {
+	ext := fileExt(filename)
+	extMutex.RLock()
+	typ, ok := extMethodEntries[ext]
+	extMutex.RUnlock()
+	if !ok {
+		return
+	}
+	if typ == "" {
+		typ = strings.TrimSuffix(baseName(strings.TrimSuffix(filename, gzipExt)), ext)
+	}
+	return "this *" + typ, true
 }
 
 // -----------------------------------------------------------------------------
 
+// Config represents the options of parsing Go+ source files (see
+// Config.ParseFile, ParseFileConfig and ParseFSDirConfig). The Mode based
+// functions are shorthands for a Config with Mode set only: a zero Config
+// parses the same way as ParseFile with mode 0. New options are added as
+// fields of Config.
+type Config struct {
+	Mode Mode // parsing mode
+
+	// FileSystem is the file system Config.ParseFile reads a file from if no
+	// source is given. The default (nil) is the local file system.
+	FileSystem FileSystem
+
+	// DefaultFileType is the file type of a file whose extension isn't
+	// registered (see RegisterFileType). The default is ast.FileTypeGop.
+	DefaultFileType ast.FileType
+
+	// FilePattern, if not empty, is a filepath.Match pattern (such as
+	// `game_*.gop`) that the names of the files of a directory parsed by
+	// ParseFSDirConfig must match. It is checked before the filter callback,
+	// which still applies to the matching files. Files whose name begins with
+	// "_" or whose extension isn't recognized are skipped, even if they match.
+	FilePattern string
+
+	// FileParsed, if not nil, is called by ParseFSDirConfig after each
+	// candidate file of the directory is parsed (e.g. to report progress or
+	// to cache the ASTs), in directory order, with the time spent reading and
+	// parsing the file. If the file couldn't be read or parsed, f is nil and
+	// err is the respective error.
+	FileParsed func(filename string, f *ast.File, err error, elapsed time.Duration)
+
+	// ErrorHandler, if not nil, is called for each error of a file as it is
+	// found, with its position in the original source, so that an editor can
+	// show the errors of a large file while it's being parsed. It is called
+	// at most MaxErrors times (if MaxErrors > 0), in the order the errors are
+	// found: the error list returned is sorted by position. A file that may
+	// be a headless script is parsed twice (see ast.File.NoEntrypoint): the
+	// errors of the first pass may be replaced by the ones of the second, so
+	// they are only reported once that pass is over, if they are the errors
+	// of the file.
+	ErrorHandler func(pos token.Position, msg string)
+
+	// MaxErrors, if > 0, is the maximum number of errors reported for a file:
+	// parsing stops after MaxErrors errors, even in AllErrors mode. The
+	// default (0) stops after 10 errors, or never in AllErrors mode.
+	MaxErrors int
+
+	// AllowedImports restricts the packages a file may import. If it isn't
+	// nil, importing a package not in AllowedImports is reported as an error
+	// (so an empty map allows no imports at all). Aliased and dot imports are
+	// checked by their import path.
+	AllowedImports map[string]bool
+
+	// KeywordAliases maps alias lexemes to the keyword tokens they stand for,
+	// e.g. to parse a localized dialect. Only the lexing of the aliased words
+	// changes. The default (nil) recognizes the standard keywords only.
+	KeywordAliases map[string]token.Token
+
+	// MaxLineLength, if > 0, is the maximum number of columns of a line of
+	// the original source. Each longer line is reported to Warn with category
+	// CategoryLineTooLong. Columns count characters, a tab advancing to the
+	// next multiple of TabWidth.
+	MaxLineLength int
+
+	// MaxIdentLength, if > 0, is the maximum number of characters of a
+	// declared identifier (the name of a package, import, type, function,
+	// variable, constant, field, parameter, label, ...). Each longer one is reported to Warn with
+	// category CategoryIdentTooLong; references to identifiers aren't checked,
+	// so that a name is only reported where it is declared.
+	MaxIdentLength int
+
+	// Logger, if not nil, receives the debug output of the calls using this
+	// Config, as selected by DebugFlags, instead of the standard logger. This
+	// scopes the debug output to these calls: the flags set by SetDebug are
+	// ignored by them.
+	Logger io.Writer
+
+	// DebugFlags is a combination of DbgFlagParseOutput and DbgFlagParseError,
+	// selecting the debug output written to Logger. It is ignored if Logger is
+	// nil.
+	DebugFlags int
+
+	// TabWidth is the width of a tab stop, in columns. The default (0) counts
+	// a tab as one column, like token.Position.Column does.
+	TabWidth int
+
+	// Warn, if not nil, is called for each warning (such as a line that is too
+	// long), in source order. Warnings don't make parsing fail.
+	Warn func(diag Diagnostic)
+
+	// ImportClassifier, if not nil, is called with the path of each import
+	// (whatever its local name, including `_` and `.` imports) of a parsed
+	// file, and the result is stored in ast.ImportSpec.Kind. By default all
+	// imports are ast.ImportUnknown.
+	ImportClassifier func(path string) ast.ImportKind
+
+	// IdentRewriter, if not nil, is called with the name and the position (in
+	// the original source) of each identifier of a parsed file, in source
+	// order. If it returns true, the name of the identifier is replaced by the
+	// returned one; its position is kept. It sees the identifiers declaring or
+	// referring to objects of the file, including field and method names in
+	// selectors (x.f), but not the package name of the package clause, the
+	// local names of imports, the package-qualified identifiers (fmt.Println:
+	// neither fmt nor Println) and the identifiers of injected entrypoints.
+	// By default no identifier is rewritten.
+	IdentRewriter func(name string, pos token.Position) (string, bool)
+
+	// Origin is the position of the source in an enclosing document, e.g. for
+	// a code fragment of a literate program: if Origin.Line > 0, the positions
+	// reported by the file set and in errors are relative to the document, the
+	// first byte of the source being at line Origin.Line, column Origin.Column
+	// (1 if 0) of Origin.Filename (the name of the parsed file if empty). The
+	// offsets, and so the token.Pos values, are unchanged: fragments of a
+	// document parsed into a file set keep consistent positions. By default,
+	// positions are relative to the source.
+	Origin token.Position
+
+	// onError is ErrorHandler, with positions mapped to the original source,
+	// for the parse pass whose errors are the ones of the file.
+	onError func(pos token.Position, msg string)
+}
+
 // ParseFile parses the source code of a single Go+ source file and returns the corresponding ast.File node.
+//
+// The source of a file whose name ends in .gz (such as foo.gop.gz) is
+// decompressed with gzip first; its file type is the one of the name without
+// .gz, and positions are in the decompressed source. Directories are parsed
+// without such files.
+//
+// The metadata fields of the returned file are set for any file type, a .go
+// file included: FileType is the file type of filename (or
+// Config.DefaultFileType for an unregistered extension); NoPkgDecl and
+// NoEntrypoint report whether a package clause and an entrypoint were
+// injected; NoEntry_ describes the injected entrypoint if NoEntrypoint is
+// true, and is nil otherwise. A valid .go file needs no injection: both flags
+// are false and NoEntry_ is nil.
 func ParseFile(fset *token.FileSet, filename string, src interface{}, mode Mode) (f *ast.File, err error) {
-	return ParseFSFile(fset, local, filename, src, mode)
+	cfg := &Config{Mode: mode}
+	return cfg.ParseFile(fset, filename, src)
+}
+
+// ParseFile parses the source code of a single Go+ source file with the
+// options specified by cfg. If src is nil, the file is read from
+// cfg.FileSystem; see the ParseFile function for the other kinds of src.
+func (cfg *Config) ParseFile(fset *token.FileSet, filename string, src interface{}) (f *ast.File, err error) {
+	fs := cfg.FileSystem
+	if fs == nil {
+		fs = local
+	}
+	return parseFSFileConfig(fset, fs, filename, src, cfg)
+}
+
+// ParseFileConfig parses the source code of a single Go+ source file with
+// the options specified by cfg.
+func ParseFileConfig(fset *token.FileSet, filename string, src interface{}, cfg *Config) (f *ast.File, err error) {
+	return cfg.ParseFile(fset, filename, src)
 }
 
 // ParseFSFile parses the source code of a single Go+ source file and returns the corresponding ast.File node.
 func ParseFSFile(fset *token.FileSet, fs FileSystem, filename string, src interface{}, mode Mode) (f *ast.File, err error) {
-	ext := filepath.Ext(filename)
-	ft, isOk := extGopFiles[ext]
+	cfg := &Config{FileSystem: fs, Mode: mode}
+	return cfg.ParseFile(fset, filename, src)
+}
+
+// ParseFileType is like ParseFile, but parses the file as a file of type ft
+// whatever the extension of filename, e.g. to parse a class file generated in
+// memory as FileTypeSpx: ft selects the entrypoint injected into a headless
+// file and is the FileType of the returned file.
+func ParseFileType(fset *token.FileSet, filename string, src interface{}, mode Mode, ft ast.FileType) (f *ast.File, err error) {
+	return parseFSFileEx(fset, local, filename, src, &Config{Mode: mode}, ft)
+}
+
+// ParsePackageName parses the package clause of a single Go+ source file and
+// returns the package name, without parsing the rest of the file. The source
+// is read like ParseFile does. A headless file (without package clause) is in
+// package main, as ParseFile would inject `package main` into it; no
+// entrypoint is injected.
+func ParsePackageName(fset *token.FileSet, filename string, src interface{}) (string, error) {
+	var code []byte
+	var err error
+	if src == nil {
+		code, err = local.ReadFile(filename)
+	} else {
+		code, err = readSource(src)
+	}
+	if err != nil {
+		return "", err
+	}
+	f, err := parseFile(fset, filename, code, PackageClauseOnly, &Config{})
+	if err != nil {
+		if errs, ok := errorList(err); ok && strings.HasPrefix(errs[0].Msg, "expected 'package'") {
+			return "main", nil
+		}
+		return "", err
+	}
+	return f.Name.Name, nil
+}
+
+// ParseImports parses the package clause and the import declarations of a
+// single Go+ source file and returns its import specs, without parsing the
+// rest of the file. The source is read like ParseFile does. Like ParseFile, it
+// accepts a headless file (without package clause): positions of the specs
+// and of the errors are in the original source anyway.
+func ParseImports(fset *token.FileSet, filename string, src interface{}) ([]*ast.ImportSpec, error) {
+	var code []byte
+	var err error
+	if src == nil {
+		code, err = local.ReadFile(filename)
+	} else {
+		code, err = readSource(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if _, err = parseFile(token.NewFileSet(), filename, code, PackageClauseOnly, cfg); err == nil {
+		f, err := parseFile(fset, filename, code, ImportsOnly, cfg)
+		return f.Imports, err
+	}
+
+	// parse with an injected package clause, then move the specs to a file of
+	// fset holding the original source
+	injected := append([]byte(injectedPkgDecl), code...)
+	fsetTmp := token.NewFileSet()
+	f, err := parseFile(fsetTmp, filename, injected, ImportsOnly, cfg)
+	if errs, ok := err.(scanner.ErrorList); ok {
+		stub := &ast.File{Code: injected, NoPkgDecl: true, PkgDeclLen: len(injectedPkgDecl)}
+		for _, e := range errs {
+			e.Pos, _ = stub.AdjustPos_(e.Pos)
+		}
+	}
+	file := fset.AddFile(filename, -1, len(code))
+	file.SetLinesForContent(code)
+	var tmpFile *token.File
+	fsetTmp.Iterate(func(f *token.File) bool {
+		tmpFile = f
+		return false
+	})
+	move := func(pos token.Pos) token.Pos {
+		if !pos.IsValid() {
+			return pos
+		}
+		return file.Pos(tmpFile.Offset(pos) - len(injectedPkgDecl))
+	}
+	for _, spec := range f.Imports {
+		if spec.Name != nil {
+			spec.Name.NamePos = move(spec.Name.NamePos)
+		}
+		spec.Path.ValuePos = move(spec.Path.ValuePos)
+		spec.EndPos = move(spec.EndPos)
+	}
+	return f.Imports, err
+}
+
+func parseFSFileConfig(fset *token.FileSet, fs FileSystem, filename string, src interface{}, cfg *Config) (f *ast.File, err error) {
+	ext := fileExt(filename)
+	ft, isOk := lookupFileType(ext)
 	if !isOk {
-		ft = ast.FileTypeGop
+		if cfg.Mode&StrictFileType != 0 {
+			return nil, &os.PathError{Op: "parse", Path: filename, Err: ErrUnknownFileType}
+		}
+		ft = cfg.DefaultFileType
 	}
-	return parseFSFileEx(fset, fs, filename, src, mode, ft)
+	return parseFSFileEx(fset, fs, filename, src, cfg, ft)
 }
 
-func parseFSFileEx(fset *token.FileSet, fs FileSystem, filename string, src interface{}, mode Mode, ft ast.FileType) (f *ast.File, err error) {
+func parseFSFileEx(fset *token.FileSet, fs FileSystem, filename string, src interface{}, cfg *Config, ft ast.FileType) (f *ast.File, err error) {
 	var code []byte
 	if src == nil {
 		code, err = fs.ReadFile(filename)
 	} else {
 		code, err = readSource(src)
 	}
+	if err == nil && strings.HasSuffix(filename, gzipExt) {
+		code, err = gunzip(code)
+	}
 	if err != nil {
 		return
 	}
-	return parseFileEx(fset, filename, code, mode, ft)
+	return parseFileEx(fset, filename, code, cfg, ft, nil)
+}
+
+// gzipExt is the extension of a gzip-compressed source file, such as
+// foo.gop.gz: it is parsed as foo.gop, once decompressed.
+const gzipExt = ".gz"
+
+// sortedFilenames returns the names of the files of pkg in sorted order, the
+// order in which the functions reporting on a package visit its files.
+func sortedFilenames(pkg *ast.Package) []string {
+	filenames := make([]string, 0, len(pkg.Files))
+	for filename := range pkg.Files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// fileExt returns the extension that selects the file type of filename,
+// ignoring gzipExt.
+func fileExt(filename string) string {
+	return nameExt(baseName(strings.TrimSuffix(filename, gzipExt)))
+}
+
+// nameExt returns the extension of the file name fname that selects its file
+// type: the longest registered multi-dot suffix, such as .gop.go for
+// foo.gop.go, or else the last extension.
+func nameExt(fname string) string {
+	extMutex.RLock()
+	defer extMutex.RUnlock()
+	for i := 1; i < len(fname); i++ {
+		if fname[i] == '.' {
+			if _, ok := extGopFiles[fname[i:]]; ok {
+				return fname[i:]
+			}
+		}
+	}
+	return path.Ext(fname)
+}
+
+// baseName returns the last element of name, a path built by the Join method
+// of any FileSystem: both '/' and '\\' are separators, whatever the OS.
+func baseName(name string) string {
+	return name[strings.LastIndexAny(name, `/\`)+1:]
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// topLevelScanner scans the tokens of a source file to tell its top-level
+// declarations and statements apart without parsing it: it keeps track of
+// the nesting of brackets and skips the raw blocks (see RegisterRawBlock).
+type topLevelScanner struct {
+	scanner.Scanner
+	file      *token.File
+	rawBlocks map[string]bool
+	depth     int    // nesting depth after the last token
+	lit       string // literal of the last token
+
+	// token scanned ahead of a raw block name not followed by a block
+	peeked  bool
+	peekPos token.Pos
+	peekTok token.Token
+	peekLit string
+}
+
+func newTopLevelScanner(filename string, code []byte, cfg *Config) *topLevelScanner {
+	s := &topLevelScanner{
+		file:      token.NewFileSet().AddFile("", -1, len(code)),
+		rawBlocks: lookupRawBlocks(filename),
+	}
+	s.Init(s.file, code, nil, 0)
+	s.KeywordAliases = cfg.KeywordAliases
+	return s
+}
+
+// next returns the next token. A raw block is skipped along with its name:
+// the semicolon after it is returned instead.
+func (s *topLevelScanner) next() (pos token.Pos, tok token.Token) {
+	if s.peeked {
+		s.peeked = false
+		pos, tok, s.lit = s.peekPos, s.peekTok, s.peekLit
+	} else {
+		pos, tok, s.lit = s.Scan()
+		if tok == token.IDENT && s.rawBlocks[s.lit] {
+			s.peekPos, s.peekTok, s.peekLit = s.Scan()
+			if s.peekTok == token.LBRACE {
+				s.ScanRawBlock()
+				return s.next()
+			}
+			s.peeked = true
+		}
+	}
+	switch tok {
+	case token.LPAREN, token.LBRACK, token.LBRACE:
+		s.depth++
+	case token.RPAREN, token.RBRACK, token.RBRACE:
+		s.depth--
+	}
+	return
+}
+
+// funcHeader scans the header of a function after its func keyword, up to
+// the name of the function: func name(, func (recv) name(, func op(, func
+// (recv) op(. It returns the name ("" for an operator) and whether there is
+// a receiver; ok is false if it's a function literal (`func() {...}()`).
+func (s *topLevelScanner) funcHeader() (name string, hasRecv, ok bool) {
+	_, tok := s.next()
+	hasRecv = tok == token.LPAREN // receiver or parameters
+	if hasRecv {
+		for s.depth > 0 && tok != token.EOF {
+			_, tok = s.next()
+		}
+		_, tok = s.next()
+	}
+	ok = tok == token.IDENT && !hasRecv
+	if tok == token.IDENT || isOverloadOp(tok) {
+		if tok == token.IDENT {
+			name = s.lit
+		}
+		_, tok = s.next()
+		ok = ok || tok == token.LPAREN
+	}
+	return
+}
+
+// firstStmtOffset returns the offset in code of the first top-level token
+// that neither starts a declaration nor the package clause, i.e. where the
+// statements of a headless script start. A function literal at top level
+// (`func() {...}()`) starts a statement, unlike a function or method
+// declaration. The parser can't tell it: it reports an error inside the
+// literal instead of an "expected declaration" one.
+func firstStmtOffset(filename string, code []byte, cfg *Config) (offset int, ok bool) {
+	s := newTopLevelScanner(filename, code, cfg)
+	for {
+		pos, tok := s.next()
+		switch tok {
+		case token.EOF:
+			return 0, false
+		case token.SEMICOLON:
+			continue
+		case token.PACKAGE, token.IMPORT, token.CONST, token.VAR, token.TYPE:
+		case token.FUNC:
+			if _, _, isDecl := s.funcHeader(); !isDecl {
+				return s.file.Offset(pos), true
+			}
+		default:
+			return s.file.Offset(pos), true
+		}
+		// skip the rest of the declaration
+		for s.depth > 0 || tok != token.SEMICOLON && tok != token.EOF {
+			if _, tok = s.next(); tok == token.EOF {
+				break
+			}
+		}
+	}
+}
+
+// hasFuncDecl reports whether code declares the function name at top level,
+// or the method name if isMethod is true.
+func hasFuncDecl(filename string, code []byte, cfg *Config, name string, isMethod bool) bool {
+	s := newTopLevelScanner(filename, code, cfg)
+	for {
+		switch _, tok := s.next(); {
+		case tok == token.EOF:
+			return false
+		case tok == token.FUNC && s.depth == 0:
+			if fn, hasRecv, isDecl := s.funcHeader(); isDecl && hasRecv == isMethod && fn == name {
+				return true
+			}
+		}
+	}
+}
+
+// entrypointName returns the name of the function declared by entrypoint,
+// such as `func main()` or `func (this *T) Main()`.
+func entrypointName(entrypoint string) string {
+	name := strings.TrimSuffix(entrypoint, "()")
+	return name[strings.LastIndexAny(name, " )")+1:]
+}
+
+// isOverloadOp reports whether tok may be the name of an overloaded operator.
+func isOverloadOp(tok token.Token) bool {
+	switch tok {
+	case token.LPAREN, token.LBRACK, token.LBRACE:
+		return false
+	}
+	return tok.IsOperator()
+}
+
+// stripShebang returns a copy of code with its leading `#!` line replaced by
+// spaces, so that offsets, lines and columns are kept. It returns code itself
+// if there is no such line.
+func stripShebang(code []byte) []byte {
+	if !bytes.HasPrefix(code, []byte("#!")) {
+		return code
+	}
+	n := bytes.IndexByte(code, '\n')
+	if n < 0 {
+		n = len(code)
+	}
+	ret := make([]byte, len(code))
+	for i := 0; i < n; i++ {
+		ret[i] = ' '
+	}
+	copy(ret[n:], code[n:])
+	return ret
+}
+
+// injectedPkgDecl is the package clause injected into a file without one.
+const injectedPkgDecl = "package main;"
+
+// setOrigin makes the positions of file, the one of filename, relative to
+// cfg.Origin (see Config.Origin).
+func setOrigin(file *token.File, filename string, cfg *Config) {
+	if o := cfg.Origin; o.Line > 0 {
+		if o.Filename == "" {
+			o.Filename = filename
+		}
+		if o.Column < 1 {
+			o.Column = 1
+		}
+		file.AddLineColumnInfo(0, o.Filename, o.Line, o.Column)
+	}
 }
 
 // TODO: should not add package info and init|main function.
 // If do this, parsing will display error line number when error occur
-func parseFileEx(fset *token.FileSet, filename string, code []byte, mode Mode, ft ast.FileType) (f *ast.File, err error) {
+func parseFileEx(fset *token.FileSet, filename string, code []byte, cfg *Config, ft ast.FileType, diag *Diagnostic) (f *ast.File, err error) {
+	mode := cfg.Mode
+	code = stripBOM(code)
+	if mode&StripShebang != 0 {
+		if _, isOk := lookupFileType(fileExt(filename)); !isOk {
+			code = stripShebang(code)
+		}
+	}
+	if cfg.MaxLineLength > 0 && cfg.Warn != nil {
+		checkLineLength(filename, code, cfg)
+	}
 	var b bytes.Buffer
 	var isMod, noEntrypoint, noPkgDecl bool
 	var noEntry *ast.NoEntry_
-	var noEntryPos int
+	var noEntryPos, pkgDeclLen int
+	var stmtsOutside bool // statements outside of a function are reported
 	var fsetTmp = token.NewFileSet()
-	f, err = parseFile(fsetTmp, filename, code, PackageClauseOnly)
-	if err != nil {
-		fmt.Fprintf(&b, "package main;%s", code)
+	// The scanner skips comments, so a file starting with a license header
+	// followed by its package clause isn't mistaken for a headless one.
+	f, err = parseFile(fsetTmp, filename, code, PackageClauseOnly, cfg)
+	if err != nil && mode&DisableAutoPkgDecl == 0 {
+		fmt.Fprintf(&b, "%s%s", injectedPkgDecl, code)
 		code = b.Bytes()
-		noPkgDecl = true
+		noPkgDecl, pkgDeclLen = true, len(injectedPkgDecl)
 	} else {
 		isMod = f.Name.Name != "main"
 	}
-	_, err = parseFile(fsetTmp, filename, code, mode)
-	if err != nil {
-		if errlist, ok := err.(scanner.ErrorList); ok {
-			if e := errlist[0]; strings.HasPrefix(e.Msg, "expected declaration") {
+	autoEntry := mode&DisableAutoEntry == 0
+	// without top-level statement, no entrypoint is injected
+	mayInject := autoEntry
+	if mayInject {
+		_, mayInject = firstStmtOffset(filename, code, cfg)
+	}
+	// reported tells whether the errors of err were passed to ErrorHandler
+	var reported bool
+	detectCfg := cfg
+	if cfg.ErrorHandler != nil && !mayInject {
+		// the errors of the detection pass are the ones of the file
+		detectCfg = withErrorHandler(cfg, &ast.File{Code: code, NoPkgDecl: noPkgDecl, PkgDeclLen: pkgDeclLen})
+		reported = true
+	}
+	// A file that needs no rewriting is parsed into fset directly, so that
+	// it's parsed once only. The others are parsed again once rewritten:
+	// detect the rewriting using fsetTmp, not to leave a stale file in fset.
+	fsetDetect := fsetTmp
+	if !noPkgDecl && !mayInject {
+		fsetDetect = fset
+	}
+	f, err = parseFile(fsetDetect, filename, code, mode, detectCfg)
+	reported = reported && err != nil
+	if err != nil && autoEntry {
+		if errlist, ok := errorList(err); ok {
+			// the statements start at the first top-level statement if there
+			// is no error before it, else at the first error if it's due to a
+			// statement; without statement, the errors are in declarations
+			// (such as a function with a broken body): none is injected
+			e := errlist[0]
+			idx, isStmt := firstStmtOffset(filename, code, cfg)
+			if isStmt && idx > e.Pos.Offset {
+				idx, isStmt = e.Pos.Offset, strings.HasPrefix(e.Msg, "expected declaration")
+			}
+			if isStmt {
 				var entrypoint string
-				switch ft {
-				case ast.FileTypeSpx:
+				recv, isMethod := methodEntryRecv(filename)
+				custom := lookupEntrypoint(fileExt(filename))
+				switch {
+				case isMethod:
+					entrypoint = "func (" + recv + ") Main()"
+				case custom != "":
+					entrypoint = custom
+				case ft == ast.FileTypeSpx:
 					entrypoint = "func Main()"
-				case ast.FileTypeGmx:
+				case ft == ast.FileTypeGmx:
 					entrypoint = "func MainEntry()"
 				default:
 					if isMod {
@@ -240,42 +1410,246 @@ func parseFileEx(fset *token.FileSet, filename string, code []byte, mode Mode, f
 						entrypoint = "func main()"
 					}
 				}
-				b.Reset()
-				idx := e.Pos.Offset
-				fmt.Fprintf(&b, "%s %s{%s\n}", code[:idx], entrypoint, code[idx:])
-				code = b.Bytes()
-				size := len(entrypoint) + 2
-				noEntryPos = idx + size
-				noEntry = &ast.NoEntry_{
-					Entry: entrypoint,
-					Size:  size,
+				// the statements can't be moved into an entrypoint that is
+				// already declared: report them instead of redeclaring it
+				if name := entrypointName(entrypoint); name != "init" && hasFuncDecl(filename, code, cfg, name, isMethod) {
+					err = scanner.ErrorList{{
+						Pos: fsetDetect.Position(f.FileStart + token.Pos(idx)),
+						Msg: "statements outside of func " + name + ", which is already declared",
+					}}
+					stmtsOutside = true
+				} else {
+					// the entrypoint is injected on the line of the first
+					// statement: a newline after it would shift the lines of
+					// all the statements, while only the columns of that line
+					// are shifted this way (see ast.File.AdjustPos_)
+					b.Reset()
+					fmt.Fprintf(&b, "%s %s{%s\n}", code[:idx], entrypoint, code[idx:])
+					code = b.Bytes()
+					size := len(entrypoint) + 2
+					noEntryPos = idx + size
+					noEntry = &ast.NoEntry_{
+						Entry:  entrypoint,
+						Line:   bytes.Count(code[:noEntryPos], []byte{'\n'}) + 1,
+						Size:   size,
+						Offset: idx,
+						Recv:   recv,
+					}
+					noEntrypoint = true
+					err = nil
 				}
-				noEntrypoint = true
-				err = nil
 			}
 		}
 	}
+	if err != nil && !autoEntry && diag != nil {
+		// the statements of a headless script are reported as is: the first
+		// error is at the first statement
+		if errlist, ok := errorList(err); ok {
+			idx, isStmt := firstStmtOffset(filename, code, cfg)
+			e := errlist[0]
+			stmtsOutside = isStmt && idx == e.Pos.Offset && strings.HasPrefix(e.Msg, "expected declaration")
+		}
+	}
+	if err == nil && (noPkgDecl || noEntrypoint) {
+		finalCfg := cfg
+		if cfg.ErrorHandler != nil {
+			finalCfg = withErrorHandler(cfg, &ast.File{Code: code, NoPkgDecl: noPkgDecl, PkgDeclLen: pkgDeclLen, NoEntrypoint: noEntrypoint, NoEntry_: noEntry})
+		}
+		f, err = parseFile(fset, filename, code, mode, finalCfg)
+		reported = err != nil
+	} else if err != nil && fsetDetect != fset && mode&RecoverErrors != 0 {
+		// the partial AST must be positioned in fset, not in fsetTmp
+		f, _ = parseFile(fset, filename, code, mode, cfg)
+	}
+	if err == nil || mode&RecoverErrors != 0 && f != nil {
+		f.NoEntrypoint = noEntrypoint
+		f.NoEntry_ = noEntry
+		f.NoPkgDecl = noPkgDecl
+		f.PkgDeclLen = pkgDeclLen
+		if noEntry != nil {
+			noEntry.EntryPos = f.FileStart + token.Pos(noEntry.Offset)
+			noEntry.EntryEnd = noEntry.EntryPos + token.Pos(noEntry.Size)
+			noEntry.Rbrace = f.FileStart + token.Pos(len(code)-1)
+		}
+		f.FileType = ft
+	}
 	if err == nil {
-		f, err = parseFile(fset, filename, code, mode)
-		if err == nil {
-			if noEntry != nil {
-				pos := fset.Position(f.Pos() + token.Pos(noEntryPos))
-				noEntry.Line = pos.Line
+		if noEntry != nil && mode&ParseCaptureLast != 0 {
+			noEntry.LastExprPos = lastExprPos(f)
+		}
+		if cfg.ImportClassifier != nil {
+			classifyImports(f, cfg.ImportClassifier)
+		}
+		if cfg.IdentRewriter != nil {
+			rewriteIdents(fset, f, cfg.IdentRewriter)
+		}
+		if cfg.AllowedImports != nil {
+			err = checkImports(fset, f, cfg.AllowedImports)
+		}
+		if cfg.MaxIdentLength > 0 && cfg.Warn != nil {
+			checkIdentLength(fset, f, cfg)
+		}
+		if mode&ParseWarnDeprecated != 0 && cfg.Warn != nil {
+			checkDeprecated(fset, f, cfg.Warn)
+		}
+	}
+	if noPkgDecl || noEntrypoint {
+		// report the errors in the coordinates of the original source, as if
+		// there was no `package main;` prefix nor injected entrypoint
+		injected := &ast.File{Code: code, NoPkgDecl: noPkgDecl, PkgDeclLen: pkgDeclLen, NoEntrypoint: noEntrypoint, NoEntry_: noEntry}
+		if e, ok := err.(*DetailedErrorList); ok {
+			for _, detail := range e.Details {
+				detail.Pos, _ = injected.AdjustPos_(detail.Pos)
 			}
-			f.NoEntrypoint = noEntrypoint
-			f.NoEntry_ = noEntry
-			f.NoPkgDecl = noPkgDecl
-			f.FileType = extGopFiles[filepath.Ext(filename)]
 		}
+		if errs, ok := errorList(err); ok {
+			for _, e := range errs {
+				e.Pos, _ = injected.AdjustPos_(e.Pos)
+			}
+		}
+	}
+	if cfg.ErrorHandler != nil && !reported {
+		if errs, ok := errorList(err); ok {
+			for _, e := range errs {
+				cfg.ErrorHandler(e.Pos, e.Msg)
+			}
+		}
+	}
+	if diag != nil {
+		*diag = newDiagnostic(err, noPkgDecl, noEntrypoint, stmtsOutside)
 	}
 	return
 }
 
+// withErrorHandler returns a copy of cfg whose onError calls cfg.ErrorHandler
+// with the positions of a parse of injected.Code mapped to the original
+// source (see ast.File.AdjustPos_).
+func withErrorHandler(cfg *Config, injected *ast.File) *Config {
+	ret := *cfg
+	ret.onError = func(pos token.Position, msg string) {
+		if injected.NoPkgDecl || injected.NoEntrypoint {
+			pos, _ = injected.AdjustPos_(pos)
+		}
+		cfg.ErrorHandler(pos, msg)
+	}
+	return &ret
+}
+
+func classifyImports(f *ast.File, classify func(path string) ast.ImportKind) {
+	for _, spec := range f.Imports {
+		if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+			spec.Kind = classify(path)
+		}
+	}
+}
+
+func rewriteIdents(fset *token.FileSet, f *ast.File, rewrite func(name string, pos token.Position) (string, bool)) {
+	pkgNames := make(map[string]bool, len(f.Imports))
+	for _, spec := range f.Imports {
+		if spec.Name != nil {
+			pkgNames[spec.Name.Name] = true
+		} else if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+			pkgNames[path[strings.LastIndex(path, "/")+1:]] = true
+		}
+	}
+	synthetic := entrypointDecl(f)
+	var visit func(node ast.Node) bool
+	visit = func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.Ident:
+			pos, _ := f.AdjustPos_(fset.Position(n.Pos()))
+			if name, ok := rewrite(n.Name, pos); ok {
+				n.Name = name
+			}
+		case *ast.ImportSpec:
+			return false
+		case *ast.SelectorExpr:
+			if x, ok := n.X.(*ast.Ident); ok && x.Obj == nil && pkgNames[x.Name] {
+				return false
+			}
+		case *ast.FuncDecl:
+			if n == synthetic {
+				ast.Inspect(n.Body, visit)
+				return false
+			}
+		}
+		return true
+	}
+	for _, decl := range f.Decls {
+		ast.Inspect(decl, visit)
+	}
+}
+
+// checkImports returns the errors of the imports of f not allowed, at their
+// positions in fset: like the syntax errors, they are mapped to the original
+// source by parseFileEx.
+func checkImports(fset *token.FileSet, f *ast.File, allowed map[string]bool) error {
+	var errs scanner.ErrorList
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || !allowed[path] {
+			errs.Add(fset.Position(spec.Path.Pos()), fmt.Sprintf("import %s is not allowed", spec.Path.Value))
+		}
+	}
+	return errs.Err()
+}
+
+// IsPureGo reports whether src is a Go+ source file that go/parser accepts
+// unchanged, i.e. it has a package clause and uses no Go+ specific syntax,
+// so that it can be renamed from .gop to .go safely. It is conservative: it
+// only returns true when both the Go+ and the Go parser accept src as is.
+// If src isn't a valid Go+ source file, the Go+ syntax error is returned.
+func IsPureGo(src []byte) (bool, error) {
+	f, err := parseFileEx(token.NewFileSet(), "", src, &Config{}, ast.FileTypeGop, nil)
+	if err != nil {
+		return false, err
+	}
+	if f.NoPkgDecl || f.NoEntrypoint {
+		return false, nil
+	}
+	_, err = goparser.ParseFile(gotoken.NewFileSet(), "", src, 0)
+	return err == nil, nil
+}
+
 var (
-	errInvalidSource = errors.New("invalid source")
+	// ErrInvalidSource is the error of a source that couldn't be read because
+	// of its type or size. The error returned for an unsupported type is a
+	// *SourceTypeError, which errors.Is reports as ErrInvalidSource.
+	ErrInvalidSource = errors.New("invalid source")
+
+	// ErrUnknownFileType is the error of a file whose extension isn't the one
+	// of a Go+ file type, parsed with the StrictFileType mode. It is returned
+	// as the Err of an *os.PathError.
+	ErrUnknownFileType = errors.New("unknown file type")
 )
 
+// SourceTypeError is the error returned for a src argument (see ParseFile)
+// whose type isn't supported.
+type SourceTypeError struct {
+	Type reflect.Type // the type of src, nil if src is a nil interface
+}
+
+func (e *SourceTypeError) Error() string {
+	return fmt.Sprintf("invalid source of type %v", e.Type)
+}
+
+// Is reports whether target is ErrInvalidSource.
+func (e *SourceTypeError) Is(target error) bool {
+	return target == ErrInvalidSource
+}
+
 func readSource(src interface{}) ([]byte, error) {
+	text, err := readSourceRaw(src)
+	return stripBOM(text), err
+}
+
+// readSourceRaw returns the content of src without copying it when it is
+// already available as bytes. A string source is copied once: the result is
+// kept as ast.File.Code, a []byte its users may write to, and the scanner
+// doesn't promise to leave its buffer alone, so aliasing the immutable memory
+// of the string (which needs package unsafe) could break either of them.
+// No other copy is made, unless the source needs an injected package clause.
+func readSourceRaw(src interface{}) ([]byte, error) {
 	switch s := src.(type) {
 	case string:
 		return []byte(s), nil
@@ -286,10 +1660,65 @@ func readSource(src interface{}) ([]byte, error) {
 		if s != nil {
 			return s.Bytes(), nil
 		}
+	case sizedReaderAt:
+		// like ioutil.ReadAll, read a reader from its current position on
+		// and consume it
+		seeker, ok := s.(io.Seeker)
+		if !ok {
+			return readAt(s, 0, s.Size())
+		}
+		off, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		size := s.Size()
+		if off > size {
+			off = size
+		}
+		code, err := readAt(s, off, size-off)
+		if err == nil {
+			_, err = seeker.Seek(0, io.SeekEnd)
+		}
+		return code, err
 	case io.Reader:
 		return ioutil.ReadAll(s)
 	}
-	return nil, errInvalidSource
+	return nil, &SourceTypeError{Type: reflect.TypeOf(src)}
+}
+
+// utf8BOM is the UTF-8 encoding of the byte order mark.
+const utf8BOM = "\xef\xbb\xbf"
+
+// stripBOM returns code without its leading UTF-8 byte order mark, if any, so
+// that the positions in code are the ones shown by an editor and the package
+// clause injected into a headless file isn't followed by a BOM, which is
+// illegal there.
+func stripBOM(code []byte) []byte {
+	return bytes.TrimPrefix(code, []byte(utf8BOM))
+}
+
+// sizedReaderAt is an io.ReaderAt that knows the size of its content, such as
+// *io.SectionReader, *bytes.Reader or *strings.Reader.
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// readAt reads the size bytes of r at offset off into a buffer of the exact
+// size.
+func readAt(r io.ReaderAt, off, size int64) ([]byte, error) {
+	if size < 0 || int64(int(size)) != size {
+		return nil, ErrInvalidSource
+	}
+	buf := make([]byte, size)
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
 }
 
 // -----------------------------------------------------------------------------
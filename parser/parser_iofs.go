@@ -0,0 +1,158 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"archive/zip"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+
+// NewFSAdapter returns a FileSystem reading files from fsys, such as an
+// embed.FS or a fstest.MapFS, so that they can be parsed by ParseFSDir.
+//
+// Paths are slash-separated, as io/fs requires: Join uses path.Join, and the
+// paths passed to ReadDir and ReadFile are converted to slashes and cleaned,
+// a leading slash being dropped (so "/foo", "./foo" and "foo" all name the
+// same directory of fsys).
+func NewFSAdapter(fsys fs.FS) FileSystem {
+	return &fsAdapter{fsys: fsys}
+}
+
+// NewZipFS returns a FileSystem reading files from the zip archive r, so that
+// a package distributed as a .zip file can be parsed directly by ParseFSDir.
+// Paths are the slash-separated paths of the archive entries, like for
+// NewFSAdapter; the os.FileInfo values returned by ReadDir come from the zip
+// headers (size, modification time, directory bit). Directories without an
+// entry of their own in the archive are listed too.
+func NewZipFS(r *zip.Reader) FileSystem {
+	return NewFSAdapter(r)
+}
+
+type fsAdapter struct {
+	fsys fs.FS
+}
+
+func (p *fsAdapter) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(p.fsys, fsPath(dirname))
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		fis[i] = &dirEntryInfo{entry: entry}
+	}
+	return fis, nil
+}
+
+func (p *fsAdapter) ReadDirEntries(dirname string) ([]os.DirEntry, error) {
+	return fs.ReadDir(p.fsys, fsPath(dirname))
+}
+
+func (p *fsAdapter) ReadFile(filename string) ([]byte, error) {
+	return fs.ReadFile(p.fsys, fsPath(filename))
+}
+
+func (p *fsAdapter) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(p.fsys, fsPath(name))
+}
+
+func (p *fsAdapter) Join(elem ...string) string {
+	elems := make([]string, len(elem))
+	for i, e := range elem {
+		elems[i] = filepath.ToSlash(e)
+	}
+	return path.Join(elems...)
+}
+
+// fsPath converts name to a path valid for io/fs.
+func fsPath(name string) string {
+	name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// dirEntryInfo is the os.FileInfo of a fs.DirEntry. Name, Mode and IsDir are
+// answered by the entry; the other methods call entry.Info() on first use,
+// which is safe for concurrent use (a listing may be shared, see CachedFS).
+type dirEntryInfo struct {
+	entry fs.DirEntry
+	once  sync.Once
+	info  fs.FileInfo
+}
+
+func (p *dirEntryInfo) Name() string      { return p.entry.Name() }
+func (p *dirEntryInfo) Mode() os.FileMode { return p.entry.Type() }
+func (p *dirEntryInfo) IsDir() bool       { return p.entry.IsDir() }
+
+func (p *dirEntryInfo) Size() int64 {
+	if fi := p.stat(); fi != nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+func (p *dirEntryInfo) ModTime() time.Time {
+	if fi := p.stat(); fi != nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func (p *dirEntryInfo) Sys() interface{} {
+	if fi := p.stat(); fi != nil {
+		return fi.Sys()
+	}
+	return nil
+}
+
+func (p *dirEntryInfo) stat() fs.FileInfo {
+	p.once.Do(func() {
+		p.info, _ = p.entry.Info()
+	})
+	return p.info
+}
+
+// fileInfoEntry is the fs.DirEntry of an os.FileInfo.
+type fileInfoEntry struct {
+	info os.FileInfo
+}
+
+func (p *fileInfoEntry) Name() string               { return p.info.Name() }
+func (p *fileInfoEntry) IsDir() bool                { return p.info.IsDir() }
+func (p *fileInfoEntry) Type() os.FileMode          { return p.info.Mode().Type() }
+func (p *fileInfoEntry) Info() (os.FileInfo, error) { return p.info, nil }
+
+// entryInfo returns the os.FileInfo of the directory entry d, whose methods
+// other than Name, Mode and IsDir get it from the file system on first use.
+func entryInfo(d fs.DirEntry) os.FileInfo {
+	if e, ok := d.(*fileInfoEntry); ok {
+		return e.info
+	}
+	return &dirEntryInfo{entry: d}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,121 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+//go:embed _testdata/rational
+var testdataFS embed.FS
+
+func TestFSAdapterEmbed(t *testing.T) {
+	fs := NewFSAdapter(testdataFS)
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "_testdata/rational", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	pkg, ok := pkgs["main"]
+	if !ok || len(pkg.Files) != 1 || pkg.Files["_testdata/rational/rational.gop"] == nil {
+		t.Fatal("ParseFSDir failed:", pkgs)
+	}
+}
+
+func TestFSAdapterMapFS(t *testing.T) {
+	mtime := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"foo/a.gop":     {Data: []byte("package foo\n\nvar A = 1\n"), ModTime: mtime},
+		"foo/b.gop":     {Data: []byte("package foo\n\nvar B = A\n")},
+		"foo/_skip.gop": {Data: []byte("syntax error")},
+		"foo/sub/c.gop": {Data: []byte("package sub\n")},
+	}
+	fs := NewFSAdapter(fsys)
+	if name := fs.Join("/foo", "sub", "c.gop"); name != "/foo/sub/c.gop" {
+		t.Fatal("Join failed:", name)
+	}
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	if pkg, ok := pkgs["foo"]; !ok || len(pkgs) != 1 || len(pkg.Files) != 2 || pkg.Files["/foo/b.gop"] == nil {
+		t.Fatal("ParseFSDir failed:", pkgs)
+	}
+
+	fis, err := fs.ReadDir("./foo/")
+	if err != nil || len(fis) != 4 {
+		t.Fatal("ReadDir failed:", err, len(fis))
+	}
+	if fi := fis[1]; fi.Name() != "a.gop" || fi.IsDir() || fi.Size() != 23 || !fi.ModTime().Equal(mtime) {
+		t.Fatal("ReadDir failed:", fi.Name(), fi.IsDir(), fi.Size(), fi.ModTime())
+	}
+	if fi := fis[3]; fi.Name() != "sub" || !fi.IsDir() || !fi.Mode().IsDir() {
+		t.Fatal("ReadDir failed:", fi.Name(), fi.IsDir(), fi.Mode())
+	}
+	if fi, err := Stat(fs, "/foo/a.gop"); err != nil || fi.Size() != 23 || !fi.ModTime().Equal(mtime) {
+		t.Fatal("Stat failed:", err, fi)
+	}
+	if _, err = fs.ReadFile("foo/missing.gop"); err == nil {
+		t.Fatal("ReadFile: no error")
+	}
+}
+
+func TestZipFS(t *testing.T) {
+	mtime := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, file := range []struct{ name, src string }{
+		{"foo/a.gop", "package foo\n\nvar A = 1\n"},
+		{"foo/b.gop", "package foo\n\nvar B = A\n"},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: mtime})
+		if err != nil {
+			t.Fatal("CreateHeader failed:", err)
+		}
+		w.Write([]byte(file.src))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal("zip.Writer.Close failed:", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal("zip.NewReader failed:", err)
+	}
+	fs := NewZipFS(zr)
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil || len(pkgs) != 1 || len(pkgs["foo"].Files) != 2 || pkgs["foo"].Files["/foo/b.gop"] == nil {
+		t.Fatal("ParseFSDir failed:", err, pkgs)
+	}
+	list, err := fs.ReadDir("/")
+	if err != nil || len(list) != 1 || list[0].Name() != "foo" || !list[0].IsDir() {
+		t.Fatal("ReadDir failed:", err, list)
+	}
+	fi, err := Stat(fs, "foo/a.gop")
+	if err != nil || fi.Size() != 23 || !fi.ModTime().Equal(mtime) || fi.IsDir() {
+		t.Fatal("Stat failed:", err, fi)
+	}
+}
+
+// -----------------------------------------------------------------------------
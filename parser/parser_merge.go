@@ -0,0 +1,119 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"fmt"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// MergeScript combines all files of pkg (in filename order) into a single
+// file that can be printed as one runnable Go+ source file:
+//   - imports are merged into one import declaration, dropping duplicates;
+//   - other declarations are concatenated, keeping their doc comments;
+//   - the statements of the entrypoints injected for headless scripts are
+//     merged into one explicit entrypoint function, placed last.
+//
+// It is an error if two files declare an explicit entrypoint (`func main()`),
+// if an explicit entrypoint conflicts with the statements of a script, or if
+// scripts need different entrypoints. Only doc comments are kept, so the
+// result should be printed without free-floating comments.
+func MergeScript(fset *token.FileSet, pkg *ast.Package) (*ast.File, error) {
+	filenames := sortedFilenames(pkg)
+
+	var imports []*ast.ImportSpec
+	var importDecl *ast.GenDecl
+	var decls []ast.Decl
+	var entry, explicit *ast.FuncDecl
+	var stmts []ast.Stmt
+	seen := make(map[string]bool)
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		synthetic := entrypointDecl(f)
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				if d.Tok == token.IMPORT {
+					if importDecl == nil {
+						importDecl = &ast.GenDecl{Doc: d.Doc, TokPos: d.TokPos, Tok: token.IMPORT, Lparen: d.Lparen, Rparen: d.Rparen}
+						decls = append(decls, importDecl)
+					}
+					for _, spec := range d.Specs {
+						imp := spec.(*ast.ImportSpec)
+						key := imp.Path.Value
+						if imp.Name != nil {
+							key = imp.Name.Name + " " + key
+						}
+						if !seen[key] {
+							seen[key] = true
+							imports = append(imports, imp)
+							importDecl.Specs = append(importDecl.Specs, imp)
+						}
+					}
+					continue
+				}
+			case *ast.FuncDecl:
+				if d == synthetic {
+					if entry == nil {
+						entry = d
+					} else if entry.Name.Name != d.Name.Name {
+						return nil, fmt.Errorf("%v: entrypoint %s conflicts with entrypoint %s at %v",
+							fset.Position(d.Pos()), d.Name.Name, entry.Name.Name, fset.Position(entry.Pos()))
+					}
+					stmts = append(stmts, d.Body.List...)
+					continue
+				}
+				if d.Recv == nil && d.Name.Name == "main" {
+					if explicit != nil {
+						return nil, fmt.Errorf("%v: entrypoint main redeclared, previous declaration at %v",
+							fset.Position(d.Pos()), fset.Position(explicit.Pos()))
+					}
+					explicit = d
+				}
+			}
+			decls = append(decls, decl)
+		}
+	}
+	if entry != nil {
+		if entry.Name.Name != "init" {
+			for _, decl := range decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == entry.Name.Name {
+					return nil, fmt.Errorf("%v: entrypoint %s conflicts with the statements of script at %v",
+						fset.Position(fn.Pos()), fn.Name.Name, fset.Position(entry.Pos()))
+				}
+			}
+		}
+		decls = append(decls, &ast.FuncDecl{
+			Name: ast.NewIdent(entry.Name.Name),
+			Type: &ast.FuncType{Func: entry.Type.Func, Params: &ast.FieldList{}},
+			Body: &ast.BlockStmt{Lbrace: entry.Body.Lbrace, List: stmts, Rbrace: entry.Body.Rbrace},
+		})
+	}
+	return &ast.File{
+		Name:     ast.NewIdent(pkg.Name),
+		Decls:    decls,
+		Scope:    ast.NewScope(nil),
+		Imports:  imports,
+		FileType: ast.FileTypeGop,
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,85 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/parser/parsertest"
+	"github.com/goplus/gop/printer"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestMergeScript(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "lib.gop"},
+	}, map[string]string{
+		"/foo/a.gop":   "import \"fmt\"\n\nfmt.Println(\"a\")\n",
+		"/foo/b.gop":   "import (\n\t\"fmt\"\n\t\"os\"\n)\n\nfmt.Println(\"b\", os.Args)\n",
+		"/foo/lib.gop": "package main\n\nimport \"fmt\"\n\n// Hello says hello.\nfunc Hello() {\n\tfmt.Println(\"Hello\")\n}\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, ParseComments)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	f, err := MergeScript(fset, pkgs["main"])
+	if err != nil {
+		t.Fatal("MergeScript failed:", err)
+	}
+	if len(f.Imports) != 2 || len(f.Decls) != 3 {
+		t.Fatal("MergeScript failed:", len(f.Imports), len(f.Decls))
+	}
+	if entry := f.Decls[2].(*ast.FuncDecl); entry.Name.Name != "main" || len(entry.Body.List) != 2 {
+		t.Fatal("MergeScript failed: entry =", entry.Name.Name, len(entry.Body.List))
+	}
+
+	var b bytes.Buffer
+	if err = printer.Fprint(&b, fset, f); err != nil {
+		t.Fatal("printer.Fprint failed:", err)
+	}
+	f2, err := ParseFile(token.NewFileSet(), "/foo/merged.gop", b.Bytes(), ParseComments)
+	if err != nil || f2.NoEntrypoint || len(f2.Decls) != 3 {
+		t.Fatal("ParseFile merged failed:", err, b.String())
+	}
+	if doc := f2.Decls[1].(*ast.FuncDecl).Doc; doc == nil || doc.Text() != "Hello says hello.\n" {
+		t.Fatal("MergeScript failed: doc not preserved -", b.String())
+	}
+}
+
+func TestMergeScriptConflict(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "println \"a\"\n",
+		"/foo/b.gop": "package main\n\nfunc main() {\n}\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	if _, err = MergeScript(fset, pkgs["main"]); err == nil {
+		t.Fatal("MergeScript failed: no error?")
+	}
+}
+
+// -----------------------------------------------------------------------------
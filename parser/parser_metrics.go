@@ -0,0 +1,97 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+
+	"github.com/goplus/gop/scanner"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// Metrics holds line counts of a source file.
+type Metrics struct {
+	Code    int // lines holding code (possibly followed by a comment)
+	Comment int // lines holding comments only
+	Blank   int // lines holding white space only
+	Total   int // all lines: Code + Comment + Blank
+}
+
+const (
+	lineBlank = iota
+	lineComment
+	lineCode
+)
+
+// SourceMetrics counts the lines of code, comments and blank lines of src,
+// which is the original source of a file (not the one with injected package
+// clause or entrypoint). It only scans src, so it is much cheaper than a
+// parse, and it works for files with syntax errors too.
+//
+// A line holding both code and a comment counts as code; every line spanned
+// by a multi-line comment (or raw string) counts as a comment (or code) line.
+// A final line without newline counts only if it isn't empty, so an empty
+// src has no lines at all.
+func SourceMetrics(src []byte) Metrics {
+	n := bytes.Count(src, []byte{'\n'})
+	if len(src) > 0 && src[len(src)-1] != '\n' {
+		n++
+	}
+	lines := make([]int, n+1) // lines[0] is unused
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" { // automatically inserted
+			continue
+		}
+		kind := lineCode
+		if tok == token.COMMENT {
+			kind = lineComment
+		}
+		from := file.Line(pos)
+		to := from
+		if len(lit) > 1 {
+			to = file.Line(pos + token.Pos(len(lit)-1))
+		}
+		for line := from; line <= to && line <= n; line++ {
+			if kind > lines[line] {
+				lines[line] = kind
+			}
+		}
+	}
+	m := Metrics{Total: n}
+	for _, kind := range lines[1:] {
+		switch kind {
+		case lineCode:
+			m.Code++
+		case lineComment:
+			m.Comment++
+		default:
+			m.Blank++
+		}
+	}
+	return m
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,52 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestSourceMetrics(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected Metrics
+	}{
+		{"", Metrics{}},
+		{"\n\n", Metrics{Blank: 2, Total: 2}},
+		{"// only\n/* comments\n   here */\n", Metrics{Comment: 3, Total: 3}},
+		{`package foo // trailing comment
+
+/*
+ block comment
+*/
+var s = ` + "`raw\n\nstring`" + `
+
+# Go+ comment
+func foo() {
+	println s
+}`, Metrics{Code: 7, Comment: 4, Blank: 2, Total: 13}},
+	}
+	for _, c := range cases {
+		if m := SourceMetrics([]byte(c.src)); m != c.expected {
+			t.Fatalf("SourceMetrics(%q) = %+v\n", c.src, m)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
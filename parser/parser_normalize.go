@@ -0,0 +1,105 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"reflect"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+var (
+	tyPos          = reflect.TypeOf(token.NoPos)
+	tyObject       = reflect.TypeOf((*ast.Object)(nil))
+	tyScope        = reflect.TypeOf((*ast.Scope)(nil))
+	tyCommentGroup = reflect.TypeOf((*ast.CommentGroup)(nil))
+)
+
+// NormalizedAST returns a deep copy of f for semantic diffing: all positions
+// are zeroed, and comments, objects and scopes are dropped, so that two
+// normalized files can be compared with reflect.DeepEqual (see
+// EqualIgnoringPos). The result shares no position information with f and
+// can't be mapped back to its source.
+//
+// A headless script is normalized like the equivalent file with explicit
+// package clause and entrypoint: the NoPkgDecl, PkgDeclLen, NoEntrypoint,
+// NoEntry_ and Code fields are cleared. Likewise, a command-style call
+// (`println "Hi"`) normalizes like a regular one (`println("Hi")`), and
+// Features, which records such syntactic choices, is cleared too.
+func NormalizedAST(f *ast.File) *ast.File {
+	ret := normalizeValue(reflect.ValueOf(f)).Interface().(*ast.File)
+	ret.NoPkgDecl, ret.PkgDeclLen, ret.NoEntrypoint, ret.NoEntry_ = false, 0, false, nil
+	ret.Code, ret.Unresolved, ret.Features = nil, nil, 0
+	ret.Imports = nil
+	for _, decl := range ret.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			for _, spec := range d.Specs {
+				ret.Imports = append(ret.Imports, spec.(*ast.ImportSpec))
+			}
+		}
+	}
+	return ret
+}
+
+// EqualIgnoringPos reports whether x and y are the same once normalized (see
+// NormalizedAST), i.e. whether they only differ in formatting and comments.
+func EqualIgnoringPos(x, y *ast.File) bool {
+	return reflect.DeepEqual(NormalizedAST(x), NormalizedAST(y))
+}
+
+func normalizeValue(v reflect.Value) reflect.Value {
+	t := v.Type()
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || t == tyObject || t == tyScope || t == tyCommentGroup {
+			return reflect.Zero(t)
+		}
+		ret := reflect.New(t.Elem())
+		ret.Elem().Set(normalizeValue(v.Elem()))
+		return ret
+	case reflect.Interface:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		ret := reflect.New(t).Elem()
+		ret.Set(normalizeValue(v.Elem()))
+		return ret
+	case reflect.Struct:
+		ret := reflect.New(t).Elem()
+		for i, n := 0, t.NumField(); i < n; i++ {
+			if field := ret.Field(i); field.CanSet() && field.Type() != tyPos {
+				field.Set(normalizeValue(v.Field(i)))
+			}
+		}
+		return ret
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		ret := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i, n := 0, v.Len(); i < n; i++ {
+			ret.Index(i).Set(normalizeValue(v.Index(i)))
+		}
+		return ret
+	}
+	return v
+}
+
+// -----------------------------------------------------------------------------
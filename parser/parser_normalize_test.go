@@ -0,0 +1,72 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/goplus/gop/ast"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestNormalizedAST(t *testing.T) {
+	script := parseTestFile(t, "/foo/a.gop", `import "fmt"
+
+// sum of squares
+s := 0
+for x <- [1, 2, 3], x > 1 {
+	s += x * x
+}
+fmt.Println "sum:", s
+`, ParseComments)
+	explicit := parseTestFile(t, "/foo/b.gop", `package main
+
+import (
+	"fmt"
+)
+
+func main() {
+	s := 0
+	for x <- [1, 2, 3], x > 1 { s += x*x }  // squares
+	fmt.Println("sum:", s)
+}
+`, ParseComments)
+	if !EqualIgnoringPos(script, explicit) {
+		t.Fatal("EqualIgnoringPos: script and explicit entrypoint differ")
+	}
+	changed := parseTestFile(t, "/foo/c.gop", "import \"fmt\"\n\ns := 0\nfor x <- [1, 2, 3], x > 2 {\n\ts += x * x\n}\nfmt.Println \"sum:\", s\n", 0)
+	if EqualIgnoringPos(script, changed) {
+		t.Fatal("EqualIgnoringPos: semantic change not detected")
+	}
+
+	f := NormalizedAST(script)
+	if f == script || f.NoEntrypoint || f.Code != nil || len(f.Imports) != 1 || f.Imports[0] != f.Decls[0].(*ast.GenDecl).Specs[0] {
+		t.Fatal("NormalizedAST failed:", f)
+	}
+	if script.Decls[1].Pos() == 0 || !script.NoEntrypoint {
+		t.Fatal("NormalizedAST: original modified")
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if node != nil && node.Pos().IsValid() {
+			t.Fatalf("NormalizedAST: %T has position %v\n", node, node.Pos())
+		}
+		return true
+	})
+}
+
+// -----------------------------------------------------------------------------
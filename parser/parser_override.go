@@ -0,0 +1,167 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// ParseFSDirWithOverride calls ParseFSDir, but the files of directory path
+// listed in override (keyed by file name, not by full path) are parsed from
+// the given bytes instead of being read from fs:
+//   - a file both on disk and in override is parsed from override;
+//   - a file only in override (a new unsaved file) is parsed as if it was in
+//     the directory, the filter and the file type rules still apply;
+//   - a file only on disk is read from fs as usual;
+//   - a file in override with a nil value is treated as deleted: it isn't
+//     parsed even if it exists on disk.
+//
+// If the directory couldn't be read, a nil map and the respective error are
+// returned, regardless of override. See OverlayFS to override files of
+// several directories.
+func ParseFSDirWithOverride(
+	fset *token.FileSet, fs FileSystem, path string, override map[string][]byte,
+	filter func(os.FileInfo) bool, mode Mode) (pkgs map[string]*ast.Package, first error) {
+	files := make(map[string][]byte, len(override))
+	for name, data := range override {
+		files[fs.Join(path, name)] = data
+	}
+	return ParseFSDir(fset, NewOverlayFS(fs, files), path, filter, mode)
+}
+
+// OverlayFS is a FileSystem that reads the files of Overlay from memory, and
+// the other ones from Base, e.g. for a language server to parse a directory
+// with the unsaved buffers of an editor applied. The keys of Overlay are full
+// paths, as built by Base.Join:
+//   - a file both in Base and in Overlay is read from Overlay;
+//   - a file only in Overlay (a new unsaved file) is listed by ReadDir of its
+//     directory, if that directory exists in Base;
+//   - a file in Overlay with a nil value is treated as deleted: it is neither
+//     listed by ReadDir nor read from Base.
+type OverlayFS struct {
+	Base    FileSystem
+	Overlay map[string][]byte // full path => content
+}
+
+// NewOverlayFS creates an OverlayFS reading the files of overlay from memory
+// and the other ones from base.
+func NewOverlayFS(base FileSystem, overlay map[string][]byte) *OverlayFS {
+	return &OverlayFS{Base: base, Overlay: overlay}
+}
+
+// ReadDir reads the directory dirname of Base, adding the files of Overlay
+// in it and removing the deleted ones.
+func (p *OverlayFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := p.Base.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	override := p.dirOverlay(dirname)
+	if len(override) == 0 {
+		return list, nil
+	}
+	ret := make([]os.FileInfo, 0, len(list)+len(override))
+	onDisk := make(map[string]bool, len(list))
+	for _, d := range list {
+		name := d.Name()
+		onDisk[name] = true
+		if data, ok := override[name]; ok && !d.IsDir() {
+			if data != nil {
+				ret = append(ret, &overrideFileInfo{name: name, size: len(data)})
+			}
+			continue
+		}
+		ret = append(ret, d)
+	}
+	var added []string
+	for name, data := range override {
+		if data != nil && !onDisk[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		ret = append(ret, &overrideFileInfo{name: name, size: len(override[name])})
+	}
+	return ret, nil
+}
+
+// dirOverlay returns the files of Overlay in directory dirname, keyed by
+// file name.
+func (p *OverlayFS) dirOverlay(dirname string) map[string][]byte {
+	var ret map[string][]byte
+	for filename, data := range p.Overlay {
+		name := baseName(filename)
+		if name != "" && p.Base.Join(dirname, name) == filename {
+			if ret == nil {
+				ret = make(map[string][]byte)
+			}
+			ret[name] = data
+		}
+	}
+	return ret
+}
+
+// ReadFile reads filename from Overlay if it's there, else from Base. It
+// returns an os.ErrNotExist error for a deleted file.
+func (p *OverlayFS) ReadFile(filename string) ([]byte, error) {
+	if data, ok := p.Overlay[filename]; ok {
+		if data == nil {
+			return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+		}
+		return data, nil
+	}
+	return p.Base.ReadFile(filename)
+}
+
+// Join joins the path elements like Base does.
+func (p *OverlayFS) Join(elem ...string) string {
+	return p.Base.Join(elem...)
+}
+
+// Stat returns the information of name from Overlay if it's there, else from
+// Base (see Stat).
+func (p *OverlayFS) Stat(name string) (os.FileInfo, error) {
+	if data, ok := p.Overlay[name]; ok {
+		if data == nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		return &overrideFileInfo{name: baseName(name), size: len(data)}, nil
+	}
+	return Stat(p.Base, name)
+}
+
+type overrideFileInfo struct {
+	name string
+	size int
+}
+
+func (p *overrideFileInfo) Name() string       { return p.name }
+func (p *overrideFileInfo) Size() int64        { return int64(p.size) }
+func (p *overrideFileInfo) Mode() os.FileMode  { return 0644 }
+func (p *overrideFileInfo) ModTime() time.Time { return time.Time{} }
+func (p *overrideFileInfo) IsDir() bool        { return false }
+func (p *overrideFileInfo) Sys() interface{}   { return nil }
+
+// -----------------------------------------------------------------------------
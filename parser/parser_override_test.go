@@ -0,0 +1,109 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"os"
+	"testing"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/parser/parsertest"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestParseFSDirWithOverride(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "c.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\nfunc A() {}\n",
+		"/foo/b.gop": "package foo\n\nvar b = )\n",
+		"/foo/c.gop": "package foo\n\nfunc C() {}\n",
+	})
+	override := map[string][]byte{
+		"b.gop": []byte("package foo\n\nfunc B() {}\n"),
+		"c.gop": nil,
+		"d.gop": []byte("package foo\n\nfunc D() {}\n"),
+		"e.txt": []byte("not Go+ source"),
+	}
+	pkgs, err := ParseFSDirWithOverride(token.NewFileSet(), fs, "/foo", override, nil, 0)
+	if err != nil || len(pkgs) != 1 {
+		t.Fatal("ParseFSDirWithOverride failed:", err, len(pkgs))
+	}
+	files := pkgs["foo"].Files
+	if len(files) != 3 {
+		t.Fatal("ParseFSDirWithOverride failed: len(files) =", len(files))
+	}
+	for _, name := range []string{"A", "B", "D"} {
+		filename := "/foo/" + string(name[0]+'a'-'A') + ".gop"
+		f, ok := files[filename]
+		if !ok || f.Decls[0].(*ast.FuncDecl).Name.Name != name {
+			t.Fatal("ParseFSDirWithOverride failed:", filename)
+		}
+	}
+
+	_, err = ParseFSDirWithOverride(token.NewFileSet(), fs, "/bar", override, nil, 0)
+	if err == nil {
+		t.Fatal("ParseFSDirWithOverride: no error for a missing directory")
+	}
+}
+
+func TestOverlayFS(t *testing.T) {
+	base := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+		"/bar": {"c.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\nfunc A() {}\n",
+		"/foo/b.gop": "package foo\n\nfunc B() {\n",
+		"/bar/c.gop": "package bar\n\nfunc C() {}\n",
+	})
+	fs := NewOverlayFS(base, map[string][]byte{
+		"/foo/b.gop": []byte("package foo\n\nfunc B() {}\n"),
+		"/foo/n.gop": []byte("package foo\n\nfunc N() {}\n"),
+		"/bar/c.gop": nil,
+	})
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil || len(pkgs) != 1 {
+		t.Fatal("ParseFSDir failed:", err, len(pkgs))
+	}
+	files := pkgs["foo"].Files
+	for filename, name := range map[string]string{"/foo/a.gop": "A", "/foo/b.gop": "B", "/foo/n.gop": "N"} {
+		f, ok := files[filename]
+		if !ok || f.Decls[0].(*ast.FuncDecl).Name.Name != name {
+			t.Fatal("ParseFSDir failed:", filename)
+		}
+	}
+	if len(files) != 3 {
+		t.Fatal("ParseFSDir failed: len(files) =", len(files))
+	}
+
+	if pkgs, err = ParseFSDir(token.NewFileSet(), fs, "/bar", nil, 0); err != nil || len(pkgs) != 0 {
+		t.Fatal("ParseFSDir (deleted file) failed:", err, pkgs)
+	}
+	if _, err = fs.ReadFile("/bar/c.gop"); !os.IsNotExist(err) {
+		t.Fatal("ReadFile (deleted file): err =", err)
+	}
+	if fi, err := Stat(fs, "/foo/n.gop"); err != nil || fi.Name() != "n.gop" || fi.Size() != 25 {
+		t.Fatal("Stat failed:", err, fi)
+	}
+	if fi, err := Stat(fs, "/foo/a.gop"); err != nil || fi.Name() != "a.gop" {
+		t.Fatal("Stat failed:", err, fi)
+	}
+}
+
+// -----------------------------------------------------------------------------
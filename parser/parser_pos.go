@@ -0,0 +1,165 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// InsertionPoint returns the byte offset in the original source of f just
+// after its package clause and import declarations, where generated code can
+// be inserted safely. A comment trailing the last import (or the package
+// clause) on the same line is skipped.
+//
+// If the package clause of f was injected (see ast.File.NoPkgDecl), there is
+// no real clause to insert after: InsertionPoint returns 0 (the very top of
+// the user's content) and ok = false.
+func InsertionPoint(f *ast.File) (offset int, ok bool) {
+	if f.NoPkgDecl {
+		return 0, false
+	}
+	end := f.Name.End()
+	for _, decl := range f.Decls {
+		d, isGen := decl.(*ast.GenDecl)
+		if !isGen || d.Tok != token.IMPORT {
+			break
+		}
+		end = d.End()
+	}
+	offset = int(end - f.FileStart)
+	return skipLineComment(f.Code, offset), true
+}
+
+// PackageClauseRange returns the byte range [start, end) in src, the original
+// source of f, covered by the package clause of f and its doc comment, e.g.
+// to insert a license header or rewrite the package doc. A block comment that
+// ends on the line of the package clause (`/* ... */ package foo`) is part of
+// the range, as is the doc comment it may be attached to. Comments are only
+// known if f was parsed with ParseComments.
+//
+// If the package clause of f was injected (see ast.File.NoPkgDecl), or if src
+// doesn't hold the clause at the expected offset, ok = false.
+func PackageClauseRange(f *ast.File, src []byte) (start, end int, ok bool) {
+	if f.NoPkgDecl {
+		return 0, 0, false
+	}
+	start, end = f.ByteOffset(f.Package), f.ByteOffset(f.Name.End())
+	if end > len(src) || !bytes.HasPrefix(src[start:], []byte("package")) {
+		return 0, 0, false
+	}
+	if f.Doc != nil {
+		start = f.ByteOffset(f.Doc.Pos())
+	} else {
+		var last *ast.CommentGroup
+		for _, g := range f.Comments {
+			if g.End() > f.Package {
+				break
+			}
+			last = g
+		}
+		if last != nil {
+			gend := f.ByteOffset(last.End())
+			if len(bytes.TrimLeft(src[gend:start], " \t")) == 0 {
+				start = f.ByteOffset(last.Pos())
+			}
+		}
+	}
+	return start, end, true
+}
+
+// RemapPos translates the position p of the parsed file f back to the
+// coordinates of the original source, i.e. without the `package main;` prefix
+// and the entrypoint injected into a headless script (see ast.File.NoPkgDecl
+// and ast.File.NoEntrypoint). The result is f.FileStart plus the byte offset
+// of p in the original source, so it is only meaningful relative to a
+// token.File built from that source. A position inside injected text maps to
+// the point of injection. For a file without injected text, p is returned as
+// is.
+//
+// To get the original line and column of p, use ast.File.AdjustPos_ on the
+// position reported by the file set f was parsed with.
+func RemapPos(f *ast.File, p token.Pos) token.Pos {
+	if !p.IsValid() || !(f.NoPkgDecl || f.NoEntrypoint) {
+		return p
+	}
+	return f.FileStart + token.Pos(f.ByteOffset(p))
+}
+
+// skipLineComment advances offset past the rest of its line if it only holds
+// white space and comments.
+func skipLineComment(code []byte, offset int) int {
+	i, n := offset, len(code)
+	for i < n && (code[i] == ' ' || code[i] == '\t' || code[i] == '\r') {
+		i++
+	}
+	if i+1 < n && code[i] == '/' && code[i+1] == '/' {
+		for i < n && code[i] != '\n' {
+			i++
+		}
+	}
+	if i < n && code[i] == '\n' {
+		return i + 1
+	}
+	if i == n {
+		return n
+	}
+	return offset
+}
+
+// origSource returns the original source of f, i.e. f.Code without the text
+// injected by parseFileEx.
+func origSource(f *ast.File) []byte {
+	code := f.Code
+	if f.NoEntrypoint {
+		e := f.NoEntry_
+		n := len(code) - 2 // strip the injected "\n}"
+		src := make([]byte, 0, n-e.Size)
+		src = append(src, code[:e.Offset]...)
+		code = append(src, code[e.Offset+e.Size:n]...)
+	}
+	if f.NoPkgDecl {
+		code = code[f.PkgDeclLen:]
+	}
+	return code
+}
+
+// StatementIndent returns the leading white space of the line on which stmt
+// starts in the original source of f. For a headless script it reports the
+// indentation the user wrote, not the one of the injected entrypoint.
+//
+// StatementIndent is only meaningful when f.Code holds the source that f was
+// parsed from, which is the case for files returned by this package.
+func StatementIndent(f *ast.File, stmt ast.Stmt) string {
+	src := origSource(f)
+	offset := f.ByteOffset(stmt.Pos())
+	start := offset
+	for start > 0 && src[start-1] != '\n' {
+		start--
+	}
+	end := start
+	for end < offset && (src[end] == ' ' || src[end] == '\t') {
+		end++
+	}
+	return string(src[start:end])
+}
+
+// -----------------------------------------------------------------------------
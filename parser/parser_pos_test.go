@@ -0,0 +1,403 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestInsertionPoint(t *testing.T) {
+	const src = `package foo
+
+// comment between clause and imports
+import "fmt"
+
+import (
+	"io"
+	"os"
+) // trailing comment
+
+func Foo() {
+	fmt.Println(os.Args)
+}
+`
+	f := parseTestFile(t, "/foo/bar.gop", src, ParseComments)
+	offset, ok := InsertionPoint(f)
+	if !ok || src[offset:offset+4] != "\nfun" {
+		t.Fatal("TestInsertionPoint failed:", offset, ok)
+	}
+
+	const src2 = "package foo // comment\nvar a = 1\n"
+	f = parseTestFile(t, "/foo/bar.gop", src2, 0)
+	if offset, ok = InsertionPoint(f); !ok || src2[offset:] != "var a = 1\n" {
+		t.Fatal("TestInsertionPoint failed:", offset, ok)
+	}
+
+	f = parseTestFile(t, "/foo/bar.gop", "import \"fmt\"\n\nfmt.Println(1)\n", 0)
+	if offset, ok = InsertionPoint(f); ok || offset != 0 {
+		t.Fatal("TestInsertionPoint (headless) failed:", offset, ok)
+	}
+}
+
+func TestPackageClauseRange(t *testing.T) {
+	cases := []struct {
+		src, clause string
+		mode        Mode
+	}{
+		{"package foo\n\nvar a = 1\n", "package foo", ParseComments},
+		{"// Copyright\n\n// Package foo does things.\npackage foo // trailing\n", "// Package foo does things.\npackage foo", ParseComments},
+		{"/*\n License\n*/\n\n/* doc */ package foo\n", "/* doc */ package foo", ParseComments},
+		{"// Package foo\n/* doc */ package foo\n", "// Package foo\n/* doc */ package foo", ParseComments},
+		{"/*\n Package foo\n*/\npackage foo\n", "/*\n Package foo\n*/\npackage foo", ParseComments},
+		{"// Package foo\npackage foo\n", "package foo", 0},
+	}
+	for _, c := range cases {
+		f := parseTestFile(t, "/foo/bar.gop", c.src, c.mode)
+		start, end, ok := PackageClauseRange(f, []byte(c.src))
+		if !ok || c.src[start:end] != c.clause {
+			t.Fatalf("PackageClauseRange(%q) failed: %d, %d, %v\n", c.src, start, end, ok)
+		}
+	}
+
+	const src = "// Script\nx := 1\n"
+	f := parseTestFile(t, "/foo/bar.gop", src, ParseComments)
+	if _, _, ok := PackageClauseRange(f, []byte(src)); ok {
+		t.Fatal("PackageClauseRange (headless) failed")
+	}
+	f = parseTestFile(t, "/foo/bar.gop", "package foo\n", 0)
+	if _, _, ok := PackageClauseRange(f, []byte("var a = 1\n")); ok {
+		t.Fatal("PackageClauseRange (wrong src) failed")
+	}
+}
+
+func TestStatementIndent(t *testing.T) {
+	f := parseTestFile(t, "/foo/bar.gop", `  x := 1
+if x > 0 {
+	  println x
+}
+	println "done"
+`, 0)
+	body := entrypointDecl(f).Body.List
+	if len(body) != 3 {
+		t.Fatal("TestStatementIndent failed: len(body) =", len(body))
+	}
+	inner := body[1].(*ast.IfStmt).Body.List[0]
+	indents := []string{
+		StatementIndent(f, body[0]), StatementIndent(f, body[1]),
+		StatementIndent(f, inner), StatementIndent(f, body[2]),
+	}
+	expected := []string{"  ", "", "\t  ", "\t"}
+	for i, indent := range indents {
+		if indent != expected[i] {
+			t.Fatalf("TestStatementIndent failed: indent[%d] = %q\n", i, indent)
+		}
+	}
+
+	f = parseTestFile(t, "/foo/bar.gop", "package foo\n\nfunc foo() {\n    bar()\n}\n", 0)
+	stmt := f.Decls[0].(*ast.FuncDecl).Body.List[0]
+	if indent := StatementIndent(f, stmt); indent != "    " {
+		t.Fatalf("TestStatementIndent failed: indent = %q\n", indent)
+	}
+}
+
+func TestByteOffset(t *testing.T) {
+	const src = "import \"fmt\"\n\n\tx := 1\n\t\tfmt.Println(x)\n"
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", src, 0)
+	if err != nil || !f.NoPkgDecl || !f.NoEntrypoint {
+		t.Fatal("ParseFile failed:", err, f.NoPkgDecl, f.NoEntrypoint)
+	}
+	var idents []*ast.Ident
+	ast.Inspect(f, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && (ident.Name == "x" || ident.Name == "Println") {
+			idents = append(idents, ident)
+		}
+		return true
+	})
+	expected := []int{15, 28, 36}
+	if len(idents) != len(expected) {
+		t.Fatal("TestByteOffset failed: len(idents) =", len(idents))
+	}
+	for i, ident := range idents {
+		offset := f.ByteOffset(ident.Pos())
+		if offset != expected[i] || src[offset:offset+len(ident.Name)] != ident.Name {
+			t.Fatalf("TestByteOffset failed: ByteOffset(%s) = %d\n", ident.Name, offset)
+		}
+		pos, _ := f.AdjustPos_(fset.Position(ident.Pos()))
+		if pos.Offset != offset {
+			t.Fatalf("TestByteOffset failed: AdjustPos_(%s).Offset = %d\n", ident.Name, pos.Offset)
+		}
+	}
+	if offset := f.ByteOffset(f.Name.Pos()); offset != 0 {
+		t.Fatal("TestByteOffset failed: offset of injected package name =", offset)
+	}
+	if offset := f.ByteOffset(f.End()); offset != len(src) {
+		t.Fatal("TestByteOffset failed: offset of end =", offset)
+	}
+}
+
+func TestRemapPos(t *testing.T) {
+	cases := []struct {
+		src  string
+		name string
+		line int
+		col  int
+	}{
+		{"x := 1; println x\n", "println", 1, 9},
+		{"import \"fmt\"\n\n\tx := 1\n\t\tfmt.Println(x)\n", "x", 3, 2},
+		{"import \"fmt\"\n\n\tx := 1\n\t\tfmt.Println(x)\n", "Println", 4, 7},
+		{"package foo\n\nvar a = 1\n\n  b := a\n", "b", 5, 3},
+		{"package foo\n\nfunc f() {\n\tc := 1\n\t_ = c\n}\n", "c", 4, 2},
+	}
+	for _, c := range cases {
+		fset := token.NewFileSet()
+		f, err := ParseFile(fset, "/foo/bar.gop", c.src, 0)
+		if err != nil {
+			t.Fatal("ParseFile failed:", err)
+		}
+		var ident *ast.Ident
+		ast.Inspect(f, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok && id.Name == c.name && ident == nil {
+				ident = id
+			}
+			return ident == nil
+		})
+		if ident == nil {
+			t.Fatal("TestRemapPos: ident not found:", c.name)
+		}
+		orig := token.NewFileSet()
+		file := orig.AddFile("/foo/bar.gop", -1, len(c.src))
+		file.SetLinesForContent([]byte(c.src))
+		pos := file.Position(file.Pos(int(RemapPos(f, ident.Pos()) - f.FileStart)))
+		if pos.Line != c.line || pos.Column != c.col || c.src[pos.Offset:pos.Offset+len(c.name)] != c.name {
+			t.Fatalf("TestRemapPos failed: %s at %d:%d (offset %d)\n", c.name, pos.Line, pos.Column, pos.Offset)
+		}
+		adjusted, _ := f.AdjustPos_(fset.Position(ident.Pos()))
+		if adjusted.Line != c.line || adjusted.Column != c.col || adjusted.Offset != pos.Offset {
+			t.Fatalf("TestRemapPos failed: AdjustPos_(%s) = %v\n", c.name, adjusted)
+		}
+	}
+	if pos := RemapPos(&ast.File{NoPkgDecl: true}, token.NoPos); pos != token.NoPos {
+		t.Fatal("TestRemapPos failed: RemapPos(NoPos) =", pos)
+	}
+}
+
+func TestBOMAndCRLF(t *testing.T) {
+	cases := []struct {
+		src  string
+		name string
+		line int
+		col  int
+	}{
+		{"\ufeffpackage foo\n\nvar abc = 1\n", "foo", 1, 9},
+		{"\ufeffpackage foo\n\nvar abc = 1\n", "abc", 3, 5},
+		{"\ufeffx := 1\nprintln x\n", "x", 1, 1},
+		{"\ufeffx := 1\nprintln x\n", "println", 2, 1},
+		{"package foo\r\n\r\nvar s = `a\r\nb`\r\nvar abc = 1\r\n", "abc", 5, 5},
+		{"x := 1\r\n\tprintln x\r\n", "println", 2, 2},
+	}
+	for _, c := range cases {
+		fset := token.NewFileSet()
+		f, err := ParseFile(fset, "/foo/bar.gop", c.src, 0)
+		if err != nil {
+			t.Fatalf("ParseFile(%q) failed: %v\n", c.src, err)
+		}
+		var ident *ast.Ident
+		ast.Inspect(f, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok && id.Name == c.name && ident == nil {
+				ident = id
+			}
+			return ident == nil
+		})
+		if pos, _ := f.AdjustPos_(fset.Position(ident.Pos())); pos.Line != c.line || pos.Column != c.col {
+			t.Fatalf("TestBOMAndCRLF failed: %s in %q at %v\n", c.name, c.src, pos)
+		}
+	}
+}
+
+func TestErrorPosNoPkgDecl(t *testing.T) {
+	_, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", "var x = )\n", 0)
+	if err == nil || err.Error() != "/foo/bar.gop:1:9: expected operand, found ')'" {
+		t.Fatal("TestErrorPosNoPkgDecl failed:", err)
+	}
+	_, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", "import \"fmt\"\n\nvar x = )\n", 0)
+	if err == nil || err.Error() != "/foo/bar.gop:3:9: expected operand, found ')'" {
+		t.Fatal("TestErrorPosNoPkgDecl failed:", err)
+	}
+}
+
+func TestNoEntrySpan(t *testing.T) {
+	for _, src := range []string{
+		"x := 1\nprintln x\n",
+		"import \"fmt\"\n\nfunc f() {}\n\n\tfmt.Println 1",
+	} {
+		fset := token.NewFileSet()
+		f, err := ParseFile(fset, "/foo/bar.gop", src, 0)
+		if err != nil || !f.NoEntrypoint {
+			t.Fatal("ParseFile failed:", err)
+		}
+		e, entry := f.NoEntry_, entrypointDecl(f)
+		header := string(f.Code[e.EntryPos-f.FileStart : e.EntryEnd-f.FileStart])
+		if header != " func main(){" || entry.Type.Func != e.EntryPos+1 || entry.Body.Lbrace != e.EntryEnd-1 {
+			t.Fatalf("TestNoEntrySpan failed: header %q\n", header)
+		}
+		if entry.Body.Rbrace != e.Rbrace || f.Code[e.Rbrace-f.FileStart] != '}' {
+			t.Fatal("TestNoEntrySpan failed: rbrace", e.Rbrace, entry.Body.Rbrace)
+		}
+		if file := fset.File(e.Rbrace); file == nil || file.Base() != int(f.FileStart) {
+			t.Fatal("TestNoEntrySpan failed: Rbrace not in fset")
+		}
+	}
+}
+
+func TestEntrypointLines(t *testing.T) {
+	const src = "import \"fmt\"\n\nvar a = 1\n\n\tfmt.Println a\nprintln 2\n"
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", src, 0)
+	if err != nil || !f.NoEntrypoint {
+		t.Fatal("ParseFile failed:", err)
+	}
+	// the lines are the ones of src, even without AdjustPos_
+	decl := fset.Position(f.Decls[1].Pos())
+	if decl.Line != 3 || decl.Column != 1 {
+		t.Fatal("TestEntrypointLines failed: var a at", decl)
+	}
+	stmts := entrypointDecl(f).Body.List
+	first, second := fset.Position(stmts[0].Pos()), fset.Position(stmts[1].Pos())
+	if first.Line != 5 || second.Line != 6 || second.Column != 1 {
+		t.Fatal("TestEntrypointLines failed: statements at", first, second)
+	}
+	if pos, _ := f.AdjustPos_(first); pos.Line != 5 || pos.Column != 2 {
+		t.Fatal("TestEntrypointLines failed: first statement at", pos)
+	}
+}
+
+func TestEntrypointErrors(t *testing.T) {
+	for _, c := range []struct {
+		src, msg string
+		mode     Mode
+	}{
+		{"import \"fmt\"\n\nfmt.Println 1\n  x := )\n", "/foo/bar.gop:4:8: expected operand, found ')'", 0},
+		{"  x := )\n", "/foo/bar.gop:1:8: expected operand, found ')'", 0},
+		{"package main\n\nx := 1\nif x {\n", "/foo/bar.gop:5:1: expected '}', found 'EOF'", 0},
+		{"x := 1\nif x {", "/foo/bar.gop:2:7: expected '}', found 'EOF'", 0},
+		{"x := 1\nif x {\n", "/foo/bar.gop:3:1: expected '}', found 'EOF'", ParseDetailedErrors},
+	} {
+		_, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", c.src, &Config{Mode: AllErrors | c.mode, Logger: io.Discard})
+		errs, ok := errorList(err)
+		if !ok {
+			t.Fatal("ParseFile: no error list:", c.src, err)
+		}
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		if !strings.Contains(strings.Join(msgs, "\n"), c.msg) {
+			t.Fatal("ParseFile failed:", c.src, msgs)
+		}
+		if e, ok := err.(*DetailedErrorList); ok {
+			for i, detail := range e.Details {
+				if detail.Pos != errs[i].Pos {
+					t.Fatal("ParseFile failed: detail", i, detail.Pos, errs[i].Pos)
+				}
+			}
+		}
+	}
+}
+
+func TestPkgDeclLen(t *testing.T) {
+	for _, c := range []struct {
+		src string
+		n   int
+	}{
+		{"println 1\n", 13},
+		{"func f() {}\n", 13},
+		{"package foo\n\nprintln 1\n", 0},
+		{"package foo\n\nfunc f() {}\n", 0},
+	} {
+		f, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", c.src, 0)
+		if err != nil || f.PkgDeclLen != c.n {
+			t.Fatal("ParseFile failed:", c.src, err, f.PkgDeclLen)
+		}
+		if n := f.PkgDeclLen; n > 0 && string(f.Code[:n]) != "package main;" {
+			t.Fatal("TestPkgDeclLen failed: code =", string(f.Code))
+		}
+		if offset := f.ByteOffset(f.Decls[0].Pos()); offset != strings.Index(c.src, "func") && offset != strings.Index(c.src, "println") {
+			t.Fatal("TestPkgDeclLen failed: offset =", offset)
+		}
+	}
+}
+
+func TestLicenseHeader(t *testing.T) {
+	for _, c := range []struct {
+		filename, src string
+		noPkgDecl     bool
+	}{
+		{"/foo/bar.gop", "/*\n Copyright 2021 The GoPlus Authors\n*/\n\npackage game\n\nfunc main() {}\n", false},
+		{"/foo/bar.spx", "// Copyright 2021 The GoPlus Authors\n// license\n\npackage game\n\nprintln 1\n", false},
+		{"/foo/bar.gop", "\ufeff/* a */ /* b */ package game\n", false},
+		{"/foo/bar.gop", "/*\n Copyright 2021 The GoPlus Authors\n*/\n\nprintln 1\n", true},
+	} {
+		f, err := ParseFile(token.NewFileSet(), c.filename, c.src, ParseComments)
+		if err != nil || f.NoPkgDecl != c.noPkgDecl {
+			t.Fatal("ParseFile failed:", c.src, err, f.NoPkgDecl)
+		}
+		if !c.noPkgDecl && f.Name.Name != "game" {
+			t.Fatal("ParseFile failed: package", f.Name.Name)
+		}
+		if len(f.Comments) == 0 || f.ByteOffset(f.Comments[0].Pos()) != 0 {
+			t.Fatal("ParseFile failed: comments =", f.Comments)
+		}
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	fset := token.NewFileSet()
+	cfg := &Config{Logger: io.Discard, Origin: token.Position{Filename: "/doc/README.md", Line: 10, Column: 5}}
+	f, err := cfg.ParseFile(fset, "/foo/frag1.gop", "import \"fmt\"\n\nfmt.Println 1\n")
+	if err != nil || !f.NoPkgDecl || !f.NoEntrypoint {
+		t.Fatal("ParseFile failed:", err)
+	}
+	imp, stmt := fset.Position(f.Imports[0].Pos()), fset.Position(entrypointDecl(f).Body.List[0].Pos())
+	if imp, _ = f.AdjustPos_(imp); imp.String() != "/doc/README.md:10:12" {
+		t.Fatal("TestOrigin failed: import at", imp)
+	}
+	if stmt, _ = f.AdjustPos_(stmt); stmt.String() != "/doc/README.md:12:1" {
+		t.Fatal("TestOrigin failed: statement at", stmt)
+	}
+
+	// a second fragment of the document, with an error
+	cfg.Origin = token.Position{Filename: "/doc/README.md", Line: 20}
+	_, err = cfg.ParseFile(fset, "/foo/frag2.gop", "package foo\n\nvar A = )\n")
+	if err == nil || err.Error() != "/doc/README.md:22:9: expected operand, found ')'" {
+		t.Fatal("ParseFile: err =", err)
+	}
+	cfg.Origin = token.Position{Line: 30}
+	f, err = cfg.ParseFile(fset, "/foo/frag3.gop", "var A = 1\n")
+	if err != nil || fset.Position(f.Decls[0].Pos()).String() != "/foo/frag3.gop:30:14" {
+		t.Fatal("ParseFile failed:", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,748 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// entrypointDecl returns the entrypoint function injected by parseFileEx, or
+// nil if f isn't a headless script. The injected function always wraps the
+// source up to EOF, so it is the last declaration of the file.
+func entrypointDecl(f *ast.File) *ast.FuncDecl {
+	if !f.NoEntrypoint || len(f.Decls) == 0 {
+		return nil
+	}
+	fn, _ := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+	return fn
+}
+
+// lastExprPos returns the position of the expression of the last statement
+// of the entrypoint injected for a headless script, or token.NoPos if there is
+// no such statement or it isn't an expression statement.
+func lastExprPos(f *ast.File) token.Pos {
+	entry := entrypointDecl(f)
+	if entry == nil || len(entry.Body.List) == 0 {
+		return token.NoPos
+	}
+	if stmt, ok := entry.Body.List[len(entry.Body.List)-1].(*ast.ExprStmt); ok {
+		return stmt.X.Pos()
+	}
+	return token.NoPos
+}
+
+// DocIndex maps each top-level declaration of f to its doc comment (nil if
+// none). f should be parsed with ParseComments, otherwise all docs are nil.
+//
+// The entrypoint injected for a headless script has no doc comment: comments
+// found before the first statement of the script belong to that statement,
+// so they are never reported as the doc of the synthetic function.
+func DocIndex(f *ast.File) map[ast.Decl]*ast.CommentGroup {
+	entry := entrypointDecl(f)
+	docs := make(map[ast.Decl]*ast.CommentGroup, len(f.Decls))
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			docs[d] = d.Doc
+		case *ast.FuncDecl:
+			if d == entry {
+				docs[d] = nil
+			} else {
+				docs[d] = d.Doc
+			}
+		default:
+			docs[d] = nil
+		}
+	}
+	return docs
+}
+
+// UserStatements returns the statements of a headless script as the user
+// wrote them, i.e. the body of the entrypoint injected by the parser (see
+// ast.File.NoEntrypoint) without the function wrapping it, e.g. for a
+// formatter to print the script back without its entrypoint. It returns
+// false if f wasn't wrapped into an entrypoint. The statements are the ones
+// of the AST, not copies.
+func UserStatements(f *ast.File) ([]ast.Stmt, bool) {
+	entry := entrypointDecl(f)
+	if entry == nil {
+		return nil, false
+	}
+	return entry.Body.List, true
+}
+
+// BlankAssignments returns all assignments of f whose left-hand side includes
+// the blank identifier (such as `_ = x`), ordered by position. Function
+// bodies are searched too, including the entrypoint injected for a headless
+// script. Use ast.File.AdjustPos_ to map their positions to the original
+// source.
+func BlankAssignments(f *ast.File) []*ast.AssignStmt {
+	var stmts []*ast.AssignStmt
+	ast.Inspect(f, func(node ast.Node) bool {
+		if stmt, ok := node.(*ast.AssignStmt); ok {
+			for _, x := range stmt.Lhs {
+				if ident, ok := x.(*ast.Ident); ok && ident.Name == "_" {
+					stmts = append(stmts, stmt)
+					break
+				}
+			}
+		}
+		return true
+	})
+	sort.SliceStable(stmts, func(i, j int) bool {
+		return stmts[i].Pos() < stmts[j].Pos()
+	})
+	return stmts
+}
+
+// PositionedStmt is a statement together with its position in the original
+// source (see ast.File.AdjustPos_).
+type PositionedStmt struct {
+	Pos  token.Position
+	Stmt ast.Stmt
+}
+
+// ConcurrencyStatements returns all `go` and `defer` statements of pkg,
+// including the ones of the entrypoints injected for headless scripts.
+// Files are visited in filename order, and the statements of a file are
+// ordered by position. Note that Go+ requires a parenthesized call after `go`
+// and `defer`: command-style calls (such as `go println "Hi"`) are rejected by
+// the parser.
+func ConcurrencyStatements(fset *token.FileSet, pkg *ast.Package) (gos, defers []PositionedStmt) {
+	filenames := sortedFilenames(pkg)
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		ast.Inspect(f, func(node ast.Node) bool {
+			switch stmt := node.(type) {
+			case *ast.GoStmt:
+				pos, _ := f.AdjustPos_(fset.Position(stmt.Pos()))
+				gos = append(gos, PositionedStmt{Pos: pos, Stmt: stmt})
+			case *ast.DeferStmt:
+				pos, _ := f.AdjustPos_(fset.Position(stmt.Pos()))
+				defers = append(defers, PositionedStmt{Pos: pos, Stmt: stmt})
+			}
+			return true
+		})
+	}
+	return
+}
+
+// RequiredFeatures returns the Go+ specific features used by f, as recorded
+// by the parser while parsing. The entrypoint injected for a headless script
+// isn't a feature by itself: check f.NoEntrypoint for that.
+func RequiredFeatures(f *ast.File) ast.FeatureSet {
+	return f.Features
+}
+
+// CallSite is a call found by CallGraph.
+type CallSite struct {
+	Name string         // name of the called function, such as `foo`, `fmt.Println` or `p.Close`
+	Pos  token.Position // position of the call in the original source
+}
+
+// CallGraph returns, for each function of f, the calls it makes, ordered by
+// position. It is a syntactic approximation: names aren't resolved, calls of
+// functions that aren't named (e.g. `f()()`) are skipped, and conversions
+// (e.g. `int(x)`) look like calls. Command-style calls (such as
+// `println "Hi"`) are reported like other calls.
+//
+// Functions are keyed by name, and methods by `T.Name` where T is the name
+// of the receiver type. The calls of a function literal belong to the
+// enclosing function, and the calls of the entrypoint injected for a headless
+// script belong to the entrypoint (e.g. `main`). Calls made by package-level
+// variable initializers are keyed by "".
+func CallGraph(fset *token.FileSet, f *ast.File) map[string][]CallSite {
+	graph := make(map[string][]CallSite)
+	for _, decl := range f.Decls {
+		var caller string
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			caller = fn.Name.Name
+			if fn.Recv != nil && len(fn.Recv.List) == 1 {
+				caller = recvTypeName(fn.Recv.List[0].Type) + "." + caller
+			}
+		}
+		ast.Inspect(decl, func(node ast.Node) bool {
+			if call, ok := node.(*ast.CallExpr); ok {
+				if name := calleeName(call.Fun); name != "" {
+					pos, _ := f.AdjustPos_(fset.Position(call.Pos()))
+					graph[caller] = append(graph[caller], CallSite{Name: name, Pos: pos})
+				}
+			}
+			return true
+		})
+	}
+	return graph
+}
+
+// calleeName returns the name of a called function, or "" if it isn't named.
+func calleeName(fun ast.Expr) string {
+	switch x := fun.(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		if name := calleeName(x.X); name != "" {
+			return name + "." + x.Sel.Name
+		}
+	case *ast.ParenExpr:
+		return calleeName(x.X)
+	}
+	return ""
+}
+
+// PositionedNode is a node together with its position in the original source
+// (see ast.File.AdjustPos_).
+type PositionedNode struct {
+	Pos  token.Position
+	Node ast.Node
+}
+
+// TypeAssertions returns all type assertions `x.(T)` of f, ordered by
+// position, including the ones of the entrypoint injected for a headless
+// script. The guards of type switches (`x.(type)`) aren't type assertions.
+func TypeAssertions(fset *token.FileSet, f *ast.File) []PositionedNode {
+	return collectNodes(fset, f, func(node ast.Node) bool {
+		x, ok := node.(*ast.TypeAssertExpr)
+		return ok && x.Type != nil
+	})
+}
+
+// Conversions returns all conversions `T(x)` of f, ordered by position,
+// including the ones of the entrypoint injected for a headless script.
+//
+// Without type information, a conversion is told from a call syntactically:
+// it is a call with one argument and no `...` whose function is a type
+// literal (such as `[]byte` or `func()`), a parenthesized type (such as
+// `(*T)`), a predeclared type name that isn't redeclared in the file (such as
+// `int`), or the name of a type declared in the file. Conversions to types of
+// other files or packages (such as `time.Duration(x)`) can't be recognized.
+func Conversions(fset *token.FileSet, f *ast.File) []PositionedNode {
+	return collectNodes(fset, f, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		return ok && len(call.Args) == 1 && call.Ellipsis == token.NoPos &&
+			call.NoParenEnd == token.NoPos && isTypeExpr(call.Fun)
+	})
+}
+
+func collectNodes(fset *token.FileSet, f *ast.File, match func(node ast.Node) bool) []PositionedNode {
+	var nodes []PositionedNode
+	ast.Inspect(f, func(node ast.Node) bool {
+		if node != nil && match(node) {
+			pos, _ := f.AdjustPos_(fset.Position(node.Pos()))
+			nodes = append(nodes, PositionedNode{Pos: pos, Node: node})
+		}
+		return true
+	})
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Node.Pos() < nodes[j].Node.Pos()
+	})
+	return nodes
+}
+
+// LabelsAndJumps returns all labeled statements of pkg, and all jumps to a
+// label: `goto` statements, and `break` and `continue` statements with a
+// label. The bodies of all functions are visited, including the ones of the
+// entrypoints injected for headless scripts. Files are visited in filename
+// order, and the nodes of a file are ordered by position.
+func LabelsAndJumps(fset *token.FileSet, pkg *ast.Package) (labels, jumps []PositionedNode) {
+	filenames := sortedFilenames(pkg)
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		labels = append(labels, collectNodes(fset, f, func(node ast.Node) bool {
+			_, ok := node.(*ast.LabeledStmt)
+			return ok
+		})...)
+		jumps = append(jumps, collectNodes(fset, f, func(node ast.Node) bool {
+			stmt, ok := node.(*ast.BranchStmt)
+			return ok && stmt.Label != nil
+		})...)
+	}
+	return
+}
+
+var predeclaredTypes = map[string]bool{
+	"bool": true, "byte": true, "complex64": true, "complex128": true, "error": true,
+	"float32": true, "float64": true, "int": true, "int8": true, "int16": true,
+	"int32": true, "int64": true, "rune": true, "string": true, "uint": true,
+	"uint8": true, "uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+}
+
+// isTypeExpr reports whether x is syntactically a type (see Conversions).
+func isTypeExpr(x ast.Expr) bool {
+	switch t := x.(type) {
+	case *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.InterfaceType, *ast.StructType:
+		return true
+	case *ast.ParenExpr:
+		if star, ok := t.X.(*ast.StarExpr); ok {
+			return isTypeExpr(star.X)
+		}
+		return isTypeExpr(t.X)
+	case *ast.Ident:
+		if t.Obj != nil {
+			return t.Obj.Kind == ast.Typ
+		}
+		return predeclaredTypes[t.Name]
+	}
+	return false
+}
+
+// PositionedLit is a numeric literal found by MagicNumbers.
+type PositionedLit struct {
+	Pos   token.Position // position in the original source (of the sign, if any)
+	Lit   *ast.BasicLit
+	Value string // Lit.Value, preceded by "-" if the literal is negated
+}
+
+// DefaultMagicExempt is the set of numbers MagicNumbers doesn't report by
+// default, keyed by their source text (with a leading "-" if negated).
+var DefaultMagicExempt = map[string]bool{"0": true, "1": true, "-1": true}
+
+// MagicNumbers returns the numeric literals (integer, float, imaginary and
+// rational ones) used in the expressions of f, ordered by position,
+// including the ones of the entrypoint injected for a headless script.
+// Literals of constant declarations and array lengths are skipped, as well
+// as the numbers in exempt (DefaultMagicExempt if exempt is nil). Exempt
+// numbers are matched by source text, so "0x0" isn't the same as "0".
+func MagicNumbers(fset *token.FileSet, f *ast.File, exempt map[string]bool) []PositionedLit {
+	if exempt == nil {
+		exempt = DefaultMagicExempt
+	}
+	var lits []PositionedLit
+	add := func(pos token.Pos, lit *ast.BasicLit, value string) {
+		if !exempt[value] {
+			position, _ := f.AdjustPos_(fset.Position(pos))
+			lits = append(lits, PositionedLit{Pos: position, Lit: lit, Value: value})
+		}
+	}
+	var inspect func(node ast.Node) bool
+	inspect = func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.GenDecl:
+			return x.Tok != token.CONST
+		case *ast.ArrayType:
+			ast.Inspect(x.Elt, inspect)
+			return false
+		case *ast.UnaryExpr:
+			if lit, ok := x.X.(*ast.BasicLit); ok && x.Op == token.SUB && isNumericLit(lit) {
+				add(x.OpPos, lit, "-"+lit.Value)
+				return false
+			}
+		case *ast.BasicLit:
+			if isNumericLit(x) {
+				add(x.ValuePos, x, x.Value)
+			}
+		}
+		return true
+	}
+	ast.Inspect(f, inspect)
+	return lits
+}
+
+func isNumericLit(lit *ast.BasicLit) bool {
+	switch lit.Kind {
+	case token.INT, token.FLOAT, token.IMAG, token.RAT:
+		return true
+	}
+	return false
+}
+
+// FieldInfo describes a field of a struct type found by StructLayout.
+type FieldInfo struct {
+	Name     string         // field name; the type name for an embedded field
+	Type     string         // type expression, in the compact form of go/types.ExprString
+	Tag      string         // unquoted tag; or ""
+	Pos      token.Position // position of the field name in the original source
+	Embedded bool           // the field is embedded
+}
+
+// StructLayout returns the fields (in source order) of each struct type
+// declared at package level in pkg, keyed by type name. A field declaring
+// several names (`X, Y int`) is reported once per name. Local types, such as
+// the ones of the entrypoint injected for a headless script, are excluded. If
+// a type is declared more than once, the declaration of the first file (in
+// filename order) wins.
+func StructLayout(fset *token.FileSet, pkg *ast.Package) map[string][]FieldInfo {
+	filenames := sortedFilenames(pkg)
+	layouts := make(map[string][]FieldInfo)
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		for _, decl := range f.Decls {
+			d, ok := decl.(*ast.GenDecl)
+			if !ok || d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				ts := spec.(*ast.TypeSpec)
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				if _, ok = layouts[ts.Name.Name]; !ok {
+					layouts[ts.Name.Name] = structFields(fset, f, st)
+				}
+			}
+		}
+	}
+	return layouts
+}
+
+func structFields(fset *token.FileSet, f *ast.File, st *ast.StructType) []FieldInfo {
+	fields := make([]FieldInfo, 0, st.Fields.NumFields())
+	for _, field := range st.Fields.List {
+		info := FieldInfo{Type: exprString(field.Type)}
+		if field.Tag != nil {
+			info.Tag, _ = strconv.Unquote(field.Tag.Value)
+		}
+		if len(field.Names) == 0 {
+			info.Name = recvTypeName(embeddedTypeName(field.Type))
+			info.Pos, _ = f.AdjustPos_(fset.Position(field.Type.Pos()))
+			info.Embedded = true
+			fields = append(fields, info)
+			continue
+		}
+		for _, name := range field.Names {
+			info.Name = name.Name
+			info.Pos, _ = f.AdjustPos_(fset.Position(name.Pos()))
+			fields = append(fields, info)
+		}
+	}
+	return fields
+}
+
+// embeddedTypeName strips the package of the type of an embedded field, such
+// as `*pkg.T`.
+func embeddedTypeName(typ ast.Expr) ast.Expr {
+	switch t := typ.(type) {
+	case *ast.StarExpr:
+		return embeddedTypeName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel
+	}
+	return typ
+}
+
+// CompositeInfo describes a composite literal found by CompositeLiterals.
+type CompositeInfo struct {
+	Type       string         // type expression, in the compact form of go/types.ExprString
+	Keys       []string       // keys of the keyed elements, without duplicates, in source order
+	Positional int            // number of elements without a key
+	Pos        token.Position // position of the literal in the original source
+}
+
+// CompositeLiterals returns the composite literals of f with an explicit type
+// (such as `Config{Name: "x"}`, but not the elided `{...}` elements of a
+// slice or map literal), ordered by position, including the ones of the
+// entrypoint injected for a headless script. Keys are rendered like types:
+// a field name as is, a map key as the expression it is (e.g. `"name"`).
+func CompositeLiterals(fset *token.FileSet, f *ast.File) []CompositeInfo {
+	nodes := collectNodes(fset, f, func(node ast.Node) bool {
+		lit, ok := node.(*ast.CompositeLit)
+		return ok && lit.Type != nil
+	})
+	lits := make([]CompositeInfo, len(nodes))
+	for i, node := range nodes {
+		lit := node.Node.(*ast.CompositeLit)
+		info := CompositeInfo{Type: exprString(lit.Type), Pos: node.Pos}
+		seen := make(map[string]bool)
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				info.Positional++
+				continue
+			}
+			if key := exprString(kv.Key); !seen[key] {
+				seen[key] = true
+				info.Keys = append(info.Keys, key)
+			}
+		}
+		lits[i] = info
+	}
+	return lits
+}
+
+// BranchKind is the kind of a statement found by BranchStatements.
+type BranchKind int
+
+const (
+	// BranchSwitch - an expression switch statement
+	BranchSwitch BranchKind = iota
+	// BranchTypeSwitch - a type switch statement (`switch x := y.(type)`)
+	BranchTypeSwitch
+	// BranchSelect - a select statement
+	BranchSelect
+)
+
+var branchKindNames = [...]string{
+	BranchSwitch:     "switch",
+	BranchTypeSwitch: "type switch",
+	BranchSelect:     "select",
+}
+
+func (k BranchKind) String() string {
+	if k >= 0 && int(k) < len(branchKindNames) {
+		return branchKindNames[k]
+	}
+	return "unknown"
+}
+
+// BranchInfo describes a statement found by BranchStatements.
+type BranchInfo struct {
+	Kind       BranchKind
+	Cases      int            // number of case clauses, including the default one
+	HasDefault bool           // there is a default clause
+	Pos        token.Position // position of the statement in the original source
+}
+
+// BranchStatements returns all switch, type switch and select statements of
+// f, ordered by position, including the ones of the entrypoint injected for a
+// headless script. The parser tells a type switch from an expression switch
+// syntactically: its guard is a type assertion `x.(type)`.
+func BranchStatements(fset *token.FileSet, f *ast.File) []BranchInfo {
+	nodes := collectNodes(fset, f, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			return true
+		}
+		return false
+	})
+	branches := make([]BranchInfo, len(nodes))
+	for i, node := range nodes {
+		info := BranchInfo{Pos: node.Pos}
+		var body *ast.BlockStmt
+		switch stmt := node.Node.(type) {
+		case *ast.SwitchStmt:
+			info.Kind, body = BranchSwitch, stmt.Body
+		case *ast.TypeSwitchStmt:
+			info.Kind, body = BranchTypeSwitch, stmt.Body
+		case *ast.SelectStmt:
+			info.Kind, body = BranchSelect, stmt.Body
+		}
+		for _, clause := range body.List {
+			switch c := clause.(type) {
+			case *ast.CaseClause:
+				info.HasDefault = info.HasDefault || c.List == nil
+			case *ast.CommClause:
+				info.HasDefault = info.HasDefault || c.Comm == nil
+			}
+		}
+		info.Cases = len(body.List)
+		branches[i] = info
+	}
+	return branches
+}
+
+// PositionedDecl is a declaration together with its position in the original
+// source (see ast.File.AdjustPos_).
+type PositionedDecl struct {
+	Pos  token.Position
+	Decl ast.Decl
+}
+
+// EmptyFunctions returns the functions and methods of pkg whose body has no
+// statements. A body holding only comments or empty statements (`{ ; }`) is
+// empty too; a function without body (implemented externally) isn't. The
+// entrypoints injected for headless scripts are excluded. Files are visited
+// in filename order, and the functions of a file are ordered by position.
+func EmptyFunctions(fset *token.FileSet, pkg *ast.Package) []PositionedDecl {
+	filenames := sortedFilenames(pkg)
+	var decls []PositionedDecl
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		synthetic := entrypointDecl(f)
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn == synthetic || fn.Body == nil || !isEmptyBlock(fn.Body) {
+				continue
+			}
+			pos, _ := f.AdjustPos_(fset.Position(fn.Pos()))
+			decls = append(decls, PositionedDecl{Pos: pos, Decl: fn})
+		}
+	}
+	return decls
+}
+
+func isEmptyBlock(block *ast.BlockStmt) bool {
+	for _, stmt := range block.List {
+		if _, ok := stmt.(*ast.EmptyStmt); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// EnumMember is a constant of an enum found by IotaEnums.
+type EnumMember struct {
+	Name    string         // constant name; "_" for a skipped value
+	Expr    string         // explicit or implied expression, in the compact form of go/types.ExprString
+	Implied bool           // Expr is implied by a previous constant of the block
+	Value   int64          // value of Expr, if not Complex
+	Complex bool           // the value of Expr couldn't be computed syntactically
+	Pos     token.Position // position of the name in the original source
+}
+
+// EnumInfo describes an enum found by IotaEnums.
+type EnumInfo struct {
+	Members []EnumMember
+	Pos     token.Position // position of the const keyword in the original source
+}
+
+// IotaEnums returns the parenthesized const declarations of pkg that use
+// iota, with the value of each of their constants. Files are visited in
+// filename order, and the enums of a file are ordered by position; local
+// const declarations, such as the ones of the entrypoint injected for a
+// headless script, are included.
+//
+// Values are computed syntactically: integer and character literals, iota,
+// the constants declared before in the same block and the integer operators
+// are supported. Any other expression (such as a conversion or a constant
+// declared elsewhere) makes the value Complex.
+func IotaEnums(fset *token.FileSet, pkg *ast.Package) []EnumInfo {
+	filenames := sortedFilenames(pkg)
+	var enums []EnumInfo
+	for _, filename := range filenames {
+		f := pkg.Files[filename]
+		for _, node := range collectNodes(fset, f, func(node ast.Node) bool {
+			d, ok := node.(*ast.GenDecl)
+			return ok && d.Tok == token.CONST && d.Lparen.IsValid() && usesIota(d)
+		}) {
+			enums = append(enums, iotaEnum(fset, f, node.Node.(*ast.GenDecl), node.Pos))
+		}
+	}
+	return enums
+}
+
+func usesIota(d *ast.GenDecl) (found bool) {
+	for _, spec := range d.Specs {
+		for _, v := range spec.(*ast.ValueSpec).Values {
+			ast.Inspect(v, func(node ast.Node) bool {
+				if ident, ok := node.(*ast.Ident); ok && ident.Name == "iota" {
+					found = true
+				}
+				return !found
+			})
+		}
+	}
+	return
+}
+
+func iotaEnum(fset *token.FileSet, f *ast.File, d *ast.GenDecl, pos token.Position) EnumInfo {
+	enum := EnumInfo{Pos: pos}
+	values := make(map[string]int64)
+	var last []ast.Expr
+	for iota, spec := range d.Specs {
+		vs := spec.(*ast.ValueSpec)
+		implied := len(vs.Values) == 0
+		if !implied {
+			last = vs.Values
+		}
+		for i, name := range vs.Names {
+			m := EnumMember{Name: name.Name, Implied: implied, Complex: true}
+			m.Pos, _ = f.AdjustPos_(fset.Position(name.Pos()))
+			if i < len(last) {
+				var ok bool
+				m.Expr = exprString(last[i])
+				m.Value, ok = evalConst(last[i], int64(iota), values)
+				m.Complex = !ok
+			}
+			if !m.Complex && name.Name != "_" {
+				values[name.Name] = m.Value
+			}
+			enum.Members = append(enum.Members, m)
+		}
+	}
+	return enum
+}
+
+// evalConst computes the value of the integer constant expression x.
+func evalConst(x ast.Expr, iota int64, values map[string]int64) (int64, bool) {
+	switch e := x.(type) {
+	case *ast.BasicLit:
+		switch e.Kind {
+		case token.INT:
+			v, err := strconv.ParseInt(e.Value, 0, 64)
+			return v, err == nil
+		case token.CHAR:
+			if s, err := strconv.Unquote(e.Value); err == nil && s != "" {
+				c, _ := utf8.DecodeRuneInString(s)
+				return int64(c), true
+			}
+		}
+	case *ast.Ident:
+		if e.Name == "iota" {
+			return iota, true
+		}
+		v, ok := values[e.Name]
+		return v, ok
+	case *ast.ParenExpr:
+		return evalConst(e.X, iota, values)
+	case *ast.UnaryExpr:
+		v, ok := evalConst(e.X, iota, values)
+		switch e.Op {
+		case token.ADD:
+			return v, ok
+		case token.SUB:
+			return -v, ok
+		case token.XOR:
+			return ^v, ok
+		}
+	case *ast.BinaryExpr:
+		x, ok1 := evalConst(e.X, iota, values)
+		y, ok2 := evalConst(e.Y, iota, values)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, true
+		case token.SUB:
+			return x - y, true
+		case token.MUL:
+			return x * y, true
+		case token.QUO:
+			if y == 0 {
+				return 0, false
+			}
+			return x / y, true
+		case token.REM:
+			if y == 0 {
+				return 0, false
+			}
+			return x % y, true
+		case token.AND:
+			return x & y, true
+		case token.OR:
+			return x | y, true
+		case token.XOR:
+			return x ^ y, true
+		case token.AND_NOT:
+			return x &^ y, true
+		case token.SHL:
+			return x << uint64(y), y >= 0
+		case token.SHR:
+			return x >> uint64(y), y >= 0
+		}
+	}
+	return 0, false
+}
+
+// -----------------------------------------------------------------------------
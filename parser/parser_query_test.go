@@ -0,0 +1,543 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goplus/gop/ast"
+	"github.com/goplus/gop/parser/parsertest"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func parseTestFile(t *testing.T, filename, src string, mode Mode) *ast.File {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, filename, src, mode)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	return f
+}
+
+func TestDocIndex(t *testing.T) {
+	f := parseTestFile(t, "/foo/bar.gop", `import "fmt"
+
+// Foo does nothing.
+func Foo() {
+}
+
+func bar() {
+}
+
+// comment of the script
+fmt.Println("Hi")
+`, ParseComments)
+	docs := DocIndex(f)
+	if len(docs) != 4 {
+		t.Fatal("TestDocIndex failed: len(docs) =", len(docs))
+	}
+	if doc := docs[f.Decls[1]]; doc == nil || doc.Text() != "Foo does nothing.\n" {
+		t.Fatal("TestDocIndex failed: doc of Foo =", doc)
+	}
+	if doc := docs[f.Decls[2]]; doc != nil {
+		t.Fatal("TestDocIndex failed: doc of bar =", doc.Text())
+	}
+	if doc, ok := docs[f.Decls[3]]; !ok || doc != nil {
+		t.Fatal("TestDocIndex failed: doc of entrypoint =", ok, doc)
+	}
+}
+
+func TestUserStatements(t *testing.T) {
+	const src = "import \"fmt\"\n\nfunc foo() {\n}\n\nx := 1\nfmt.Println(x)\n"
+	f := parseTestFile(t, "/foo/bar.gop", src, 0)
+	stmts, ok := UserStatements(f)
+	if !ok || len(stmts) != 2 {
+		t.Fatal("TestUserStatements failed:", ok, stmts)
+	}
+	if _, ok := stmts[0].(*ast.AssignStmt); !ok {
+		t.Fatal("TestUserStatements failed: stmts[0] =", stmts[0])
+	}
+	if _, ok := stmts[1].(*ast.ExprStmt); !ok {
+		t.Fatal("TestUserStatements failed: stmts[1] =", stmts[1])
+	}
+	if offset := f.ByteOffset(stmts[0].Pos()); offset != strings.Index(src, "x := 1") {
+		t.Fatal("TestUserStatements failed: offset of stmts[0] =", offset)
+	}
+	f = parseTestFile(t, "/foo/bar.gop", "package main\n\nfunc main() {\n\tprintln 1\n}\n", 0)
+	if stmts, ok := UserStatements(f); ok || stmts != nil {
+		t.Fatal("TestUserStatements failed: not wrapped:", ok, stmts)
+	}
+}
+
+func TestBlankAssignments(t *testing.T) {
+	f := parseTestFile(t, "/foo/bar.gop", `import "os"
+
+func foo() {
+	_ = os.Args
+	a, _ := 1, 2
+	for _, v := range [1, 2] {
+		_ = v
+	}
+	_ = a
+}
+
+x := 1
+_, _ = x, [y*y for y <- [1, 2]]
+println x
+`, 0)
+	stmts := BlankAssignments(f)
+	if len(stmts) != 5 {
+		t.Fatal("TestBlankAssignments failed: len(stmts) =", len(stmts))
+	}
+	for i := 1; i < len(stmts); i++ {
+		if stmts[i-1].Pos() >= stmts[i].Pos() {
+			t.Fatal("TestBlankAssignments failed: not ordered by position")
+		}
+	}
+	if last := stmts[4]; len(last.Lhs) != 2 || len(last.Rhs) != 2 {
+		t.Fatal("TestBlankAssignments failed: last =", last)
+	}
+}
+
+func TestParseCaptureLast(t *testing.T) {
+	const src = "x := 1\nif x > 0 {\n\tx++\n}\nx * 2\n"
+	f := parseTestFile(t, "/foo/bar.gop", src, ParseCaptureLast)
+	pos := f.NoEntry_.LastExprPos
+	if !pos.IsValid() {
+		t.Fatal("TestParseCaptureLast failed: no LastExprPos")
+	}
+	if offset := f.ByteOffset(pos); src[offset:] != "x * 2\n" {
+		t.Fatal("TestParseCaptureLast failed: offset =", offset)
+	}
+	if f = parseTestFile(t, "/foo/bar.gop", src, 0); f.NoEntry_.LastExprPos.IsValid() {
+		t.Fatal("TestParseCaptureLast failed: LastExprPos set without ParseCaptureLast")
+	}
+
+	for _, src := range []string{"x := 1\ny := x * 2\n", "x := 1\nif x > 0 {\n\tx * 2\n}\n"} {
+		f = parseTestFile(t, "/foo/bar.gop", src, ParseCaptureLast)
+		if f.NoEntry_.LastExprPos.IsValid() {
+			t.Fatalf("TestParseCaptureLast failed: LastExprPos set for %q\n", src)
+		}
+	}
+}
+
+func TestConcurrencyStatements(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package main\n\nfunc foo() {\n\tdefer println(\"a\")\n\tgo func() {\n\t\tdefer recover()\n\t}()\n}\n",
+		"/foo/b.gop": "go println(\"b\")\ndefer foo()\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	gos, defers := ConcurrencyStatements(fset, pkgs["main"])
+	positions := func(stmts []PositionedStmt) (ret []string) {
+		for _, stmt := range stmts {
+			ret = append(ret, stmt.Pos.String())
+		}
+		return
+	}
+	if ret := positions(gos); !reflect.DeepEqual(ret, []string{"/foo/a.gop:5:2", "/foo/b.gop:1:1"}) {
+		t.Fatal("TestConcurrencyStatements failed: gos =", ret)
+	}
+	if ret := positions(defers); !reflect.DeepEqual(ret, []string{"/foo/a.gop:4:2", "/foo/a.gop:6:3", "/foo/b.gop:2:1"}) {
+		t.Fatal("TestConcurrencyStatements failed: defers =", ret)
+	}
+}
+
+func TestLabelsAndJumps(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package main\n\nfunc foo() {\nOuter:\n\tfor {\n\t\tfor {\n\t\t\tbreak Outer\n\t\t}\n\t\tcontinue\n\t}\n}\n",
+		"/foo/b.gop": "i := 0\nL:\ni++\nif i < 3 {\n\tgoto L\n}\nfor {\n\tcontinue Done\n}\nDone:\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	labels, jumps := LabelsAndJumps(fset, pkgs["main"])
+	positions := func(nodes []PositionedNode) (ret []string) {
+		for _, node := range nodes {
+			ret = append(ret, node.Pos.String())
+		}
+		return
+	}
+	if ret := positions(labels); !reflect.DeepEqual(ret, []string{"/foo/a.gop:4:1", "/foo/b.gop:2:1", "/foo/b.gop:10:1"}) {
+		t.Fatal("TestLabelsAndJumps failed: labels =", ret)
+	}
+	if ret := positions(jumps); !reflect.DeepEqual(ret, []string{"/foo/a.gop:7:4", "/foo/b.gop:5:2", "/foo/b.gop:8:2"}) {
+		t.Fatal("TestLabelsAndJumps failed: jumps =", ret)
+	}
+	if tok := jumps[1].Node.(*ast.BranchStmt).Tok; tok != token.GOTO {
+		t.Fatal("TestLabelsAndJumps failed: tok =", tok)
+	}
+}
+
+func TestRequiredFeatures(t *testing.T) {
+	f := parseTestFile(t, "/foo/bar.gop", `a := [1, 3, 2]
+foo x => x * 2
+b := 1/3r
+println a, b
+`, 0)
+	features := RequiredFeatures(f)
+	if !features.Has(ast.FeatureSliceLit | ast.FeatureCommandCall | ast.FeatureLambda | ast.FeatureRatLit) {
+		t.Fatalf("TestRequiredFeatures failed: features = %b\n", features)
+	}
+	if features.Has(ast.FeatureForPhrase) || features.Has(ast.FeatureErrWrap) {
+		t.Fatalf("TestRequiredFeatures failed: features = %b\n", features)
+	}
+
+	f = parseTestFile(t, "/foo/bar.gop", "package foo\n\nfunc Foo(a []int) {\n\tfor _, x := range a {\n\t\tprintln(x)\n\t}\n}\n", 0)
+	if features = RequiredFeatures(f); features != 0 {
+		t.Fatalf("TestRequiredFeatures failed: features = %b\n", features)
+	}
+}
+
+func TestCallGraph(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", `import "fmt"
+
+type T struct{}
+
+func (p *T) Close() {
+	fmt.Println("close")
+}
+
+func foo(t *T) {
+	defer t.Close()
+	func() {
+		bar(1)
+	}()
+}
+
+println "Hi", foo(&T{})
+`, 0)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	graph := CallGraph(fset, f)
+	sites := func(caller string) (ret []string) {
+		for _, site := range graph[caller] {
+			ret = append(ret, fmt.Sprintf("%s@%d:%d", site.Name, site.Pos.Line, site.Pos.Column))
+		}
+		return
+	}
+	expected := map[string][]string{
+		"T.Close": {"fmt.Println@6:2"},
+		"foo":     {"t.Close@10:8", "bar@12:3"},
+		"main":    {"println@16:1", "foo@16:15"},
+	}
+	if len(graph) != len(expected) {
+		t.Fatal("TestCallGraph failed: len(graph) =", len(graph))
+	}
+	for caller, exp := range expected {
+		if ret := sites(caller); !reflect.DeepEqual(ret, exp) {
+			t.Fatal("TestCallGraph failed:", caller, ret)
+		}
+	}
+}
+
+func TestTypeAssertionsAndConversions(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", `type T int
+
+func foo(v interface{}) {
+	switch v.(type) {
+	case T:
+		println T(1), (*T)(nil), []byte("a")
+	}
+}
+
+var x interface{} = 1
+n, ok := x.(int)
+println int(n), ok, x.(T), len("abc"), string(rune(65))
+`, 0)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	positions := func(nodes []PositionedNode) (ret []string) {
+		for _, node := range nodes {
+			ret = append(ret, fmt.Sprintf("%d:%d", node.Pos.Line, node.Pos.Column))
+		}
+		return
+	}
+	if ret := positions(TypeAssertions(fset, f)); !reflect.DeepEqual(ret, []string{"11:10", "12:21"}) {
+		t.Fatal("TypeAssertions failed:", ret)
+	}
+	expected := []string{"6:11", "6:17", "6:28", "12:9", "12:40", "12:47"}
+	if ret := positions(Conversions(fset, f)); !reflect.DeepEqual(ret, expected) {
+		t.Fatal("Conversions failed:", ret)
+	}
+}
+
+func TestMagicNumbers(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", `const Max = 100
+
+var buf [64]byte
+
+func scale(x float64) float64 {
+	const half = 0.5
+	return x*2.5 - 1 + half
+}
+
+for i := 0; i < 10; i++ {
+	println scale(float64(-i)) * -3, "42"
+}
+`, 0)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	values := func(lits []PositionedLit) (ret []string) {
+		for _, lit := range lits {
+			ret = append(ret, fmt.Sprintf("%s@%d:%d", lit.Value, lit.Pos.Line, lit.Pos.Column))
+		}
+		return
+	}
+	expected := []string{"2.5@7:11", "10@10:17", "-3@11:31"}
+	if ret := values(MagicNumbers(fset, f, nil)); !reflect.DeepEqual(ret, expected) {
+		t.Fatal("MagicNumbers failed:", ret)
+	}
+	expected = []string{"2.5@7:11", "1@7:17", "0@10:10"}
+	if ret := values(MagicNumbers(fset, f, map[string]bool{"10": true, "-3": true})); !reflect.DeepEqual(ret, expected) {
+		t.Fatal("MagicNumbers failed:", ret)
+	}
+}
+
+func TestStructLayout(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\nimport \"sync\"\n\ntype User struct {\n\t*sync.Mutex\n\tID, Age int `db:\"id\"`\n\tTags map[string][]string\n}\n",
+		"/foo/b.gop": "package foo\n\ntype Empty struct{}\n\ntype Alias = int\n\nfunc foo() {\n\ttype local struct{ X int }\n}\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	layouts := StructLayout(fset, pkgs["foo"])
+	if len(layouts) != 2 || len(layouts["Empty"]) != 0 {
+		t.Fatal("StructLayout failed:", layouts)
+	}
+	expected := []FieldInfo{
+		{Name: "Mutex", Type: "*sync.Mutex", Embedded: true},
+		{Name: "ID", Type: "int", Tag: `db:"id"`},
+		{Name: "Age", Type: "int", Tag: `db:"id"`},
+		{Name: "Tags", Type: "map[string][]string"},
+	}
+	lines := []int{6, 7, 7, 8}
+	fields := layouts["User"]
+	if len(fields) != len(expected) {
+		t.Fatal("StructLayout failed:", fields)
+	}
+	for i, field := range fields {
+		pos := field.Pos
+		field.Pos = token.Position{}
+		if field != expected[i] || pos.Line != lines[i] {
+			t.Fatal("StructLayout failed:", field, pos)
+		}
+	}
+}
+
+func TestCompositeLiterals(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", `import "net/http"
+
+type Config struct {
+	Name string
+	Port int
+}
+
+cfg := Config{Name: "app", Port: 8080}
+srv := &http.Server{Addr: ":8080"}
+pts := [][2]int{{1, 2}, {3, 4}}
+env := map[string]string{"HOME": "/root", "USER": "root"}
+println cfg, srv, pts, env
+`, 0)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	lits := CompositeLiterals(fset, f)
+	expected := []CompositeInfo{
+		{Type: "Config", Keys: []string{"Name", "Port"}},
+		{Type: "http.Server", Keys: []string{"Addr"}},
+		{Type: "[][2]int", Positional: 2},
+		{Type: "map[string]string", Keys: []string{`"HOME"`, `"USER"`}},
+	}
+	lines := []int{8, 9, 10, 11}
+	if len(lits) != len(expected) {
+		t.Fatal("CompositeLiterals failed:", lits)
+	}
+	for i, lit := range lits {
+		pos := lit.Pos
+		lit.Pos = token.Position{}
+		if !reflect.DeepEqual(lit, expected[i]) || pos.Line != lines[i] {
+			t.Fatal("CompositeLiterals failed:", lit, pos)
+		}
+	}
+}
+
+func TestBranchStatements(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", `func kind(v interface{}) string {
+	switch x := v.(type) {
+	case int, int64:
+		return "int"
+	case string:
+		return x
+	}
+	return "other"
+}
+
+ch := make(chan int)
+switch n := 3; {
+case n > 2:
+	select {
+	case v := <-ch:
+		println v
+	default:
+	}
+default:
+	println kind(n)
+}
+`, 0)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	branches := BranchStatements(fset, f)
+	expected := []BranchInfo{
+		{Kind: BranchTypeSwitch, Cases: 2},
+		{Kind: BranchSwitch, Cases: 2, HasDefault: true},
+		{Kind: BranchSelect, Cases: 2, HasDefault: true},
+	}
+	lines := []int{2, 12, 14}
+	if len(branches) != len(expected) {
+		t.Fatal("BranchStatements failed:", branches)
+	}
+	for i, branch := range branches {
+		pos := branch.Pos
+		branch.Pos = token.Position{}
+		if branch != expected[i] || pos.Line != lines[i] {
+			t.Fatal("BranchStatements failed:", branch, pos)
+		}
+	}
+	if s := BranchTypeSwitch.String(); s != "type switch" {
+		t.Fatal("BranchKind.String failed:", s)
+	}
+}
+
+func TestEmptyFunctions(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package main\n\ntype T struct{}\n\nfunc (t *T) Close() error {\n\t// TODO\n}\n\nfunc (t T) String() string { return \"T\" }\n\nfunc stub() { ; }\n\nfunc external()\n",
+		"/foo/b.gop": "func noop() {}\n\nnoop\n",
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	var ret []string
+	for _, decl := range EmptyFunctions(fset, pkgs["main"]) {
+		ret = append(ret, decl.Pos.String()+" "+decl.Decl.(*ast.FuncDecl).Name.Name)
+	}
+	expected := []string{"/foo/a.gop:5:1 Close", "/foo/a.gop:11:1 stub", "/foo/b.gop:1:1 noop"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Fatal("TestEmptyFunctions failed:", ret)
+	}
+}
+
+func TestIotaEnums(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop"},
+	}, map[string]string{
+		"/foo/a.gop": `package foo
+
+const (
+	KB = 1 << (10 * (iota + 1))
+	MB
+)
+
+const (
+	Red Color = iota
+	_
+	Blue
+	Last = Blue
+	Size = len("abc") + iota
+)
+
+const (
+	A, B = iota, 'a' + iota
+	C, D
+)
+
+const (
+	Q = 1 / iota
+	R = 7 % iota
+)
+
+const Max = 10
+`,
+	})
+	fset := token.NewFileSet()
+	pkgs, err := ParseFSDir(fset, fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	enums := IotaEnums(fset, pkgs["foo"])
+	if len(enums) != 4 || enums[0].Pos.Line != 3 || enums[1].Pos.Line != 8 || enums[2].Pos.Line != 16 || enums[3].Pos.Line != 21 {
+		t.Fatal("IotaEnums failed:", enums)
+	}
+	var ret []string
+	for _, enum := range enums {
+		for _, m := range enum.Members {
+			ret = append(ret, fmt.Sprintf("%d:%s=%s:%v:%d:%v", m.Pos.Line, m.Name, m.Expr, m.Implied, m.Value, m.Complex))
+		}
+	}
+	expected := []string{
+		"4:KB=1 << (10 * (iota + 1)):false:1024:false",
+		"5:MB=1 << (10 * (iota + 1)):true:1048576:false",
+		"9:Red=iota:false:0:false",
+		"10:_=iota:true:1:false",
+		"11:Blue=iota:true:2:false",
+		"12:Last=Blue:false:2:false",
+		"13:Size=len(\"abc\") + iota:false:0:true",
+		"17:A=iota:false:0:false",
+		"17:B='a' + iota:false:97:false",
+		"18:C=iota:true:1:false",
+		"18:D='a' + iota:true:98:false",
+		"22:Q=1 / iota:false:0:true",
+		"23:R=7 % iota:false:0:false",
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Fatal("IotaEnums failed:", ret)
+	}
+}
+
+// -----------------------------------------------------------------------------
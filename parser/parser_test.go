@@ -17,8 +17,12 @@
 package parser
 
 import (
+	"bytes"
+	"fmt"
+	"os"
 	"testing"
 
+	"github.com/goplus/gop/ast"
 	"github.com/goplus/gop/parser/parsertest"
 	"github.com/goplus/gop/token"
 )
@@ -286,4 +290,183 @@ ast.FuncDecl:
 `)
 }
 
+func TestParseExpr(t *testing.T) {
+	x, err := ParseExpr("1 + 2*x")
+	if err != nil {
+		t.Fatal("ParseExpr failed:", err)
+	}
+	add, ok := x.(*ast.BinaryExpr)
+	if !ok || add.Op != token.ADD {
+		t.Fatal("ParseExpr failed: not an addition -", x)
+	}
+	mul, ok := add.Y.(*ast.BinaryExpr)
+	if !ok || mul.Op != token.MUL || mul.Y.Pos() != 7 { // x is at offset 6
+		t.Fatal("ParseExpr failed: not a multiplication -", add.Y)
+	}
+
+	if x, err = ParseExpr("func(a int) int { return a * 2 }"); err != nil {
+		t.Fatal("ParseExpr failed:", err)
+	}
+	if fn, ok := x.(*ast.FuncLit); !ok || len(fn.Body.List) != 1 {
+		t.Fatal("ParseExpr failed: not a function literal -", x)
+	}
+
+	if x, err = ParseExpr("[x*x for x <- [1, 3, 5], x > 1]"); err != nil {
+		t.Fatal("ParseExpr failed:", err)
+	}
+	if _, ok := x.(*ast.ComprehensionExpr); !ok {
+		t.Fatal("ParseExpr failed: not a comprehension -", x)
+	}
+
+	if _, err = ParseExpr("a b"); err == nil || err.Error() != "1:3: expected 'EOF', found b" {
+		t.Fatal("ParseExpr (trailing tokens): err =", err)
+	}
+	if _, err = ParseExpr("(1 + )"); err == nil {
+		t.Fatal("ParseExpr (invalid): no error?")
+	}
+}
+
+func TestParseFileFileSet(t *testing.T) {
+	for _, src := range []string{
+		"package main\n\nfunc f() {\n}\n",
+		"package main\n\nprintln \"hi\"\n",
+		"println \"hi\"\n",
+	} {
+		fset := token.NewFileSet()
+		if _, err := ParseFile(fset, "/foo/a.gop", src, 0); err != nil {
+			t.Fatal("ParseFile failed:", err)
+		}
+		n := 0
+		fset.Iterate(func(*token.File) bool {
+			n++
+			return true
+		})
+		if n != 1 {
+			t.Fatalf("TestParseFileFileSet: %d files in fset for %q", n, src)
+		}
+	}
+}
+
+// benchCode returns a source file of about 2000 lines, with a package clause
+// or as a headless script.
+func benchCode(script bool) []byte {
+	var b bytes.Buffer
+	if !script {
+		b.WriteString("package main\n\n")
+	}
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&b, "func f%d(x int) int {\n\ty := x * %d\n\tif y > 100 {\n\t\treturn y\n\t}\n", i, i)
+		fmt.Fprintf(&b, "\tfor i := 0; i < x; i++ {\n\t\ty += i\n\t}\n\treturn y\n}\n")
+	}
+	if script {
+		b.WriteString("println f1(2)\n")
+	}
+	return b.Bytes()
+}
+
+func benchmarkParseFile(b *testing.B, script bool, mode Mode) {
+	SetDebug(0)
+	defer SetDebug(DbgFlagAll)
+	code := benchCode(script)
+	b.SetBytes(int64(len(code)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", code, mode); err != nil {
+			b.Fatal("ParseFile failed:", err)
+		}
+	}
+}
+
+func BenchmarkParseFile(b *testing.B) {
+	benchmarkParseFile(b, false, 0)
+}
+
+func BenchmarkParseFileScript(b *testing.B) {
+	benchmarkParseFile(b, true, 0)
+}
+
+func BenchmarkParseFileDeclarationsOnly(b *testing.B) {
+	benchmarkParseFile(b, false, DeclarationsOnly)
+}
+
+func benchmarkParseFSDir(b *testing.B, parse func(*token.FileSet, FileSystem, string, func(os.FileInfo) bool, Mode) (map[string]*ast.Package, error)) {
+	SetDebug(0)
+	defer SetDebug(DbgFlagAll)
+	var names []string
+	files := make(map[string]string)
+	code := string(benchCode(false))
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("f%03d.gop", i)
+		names = append(names, name)
+		files["/foo/"+name] = code
+	}
+	fs := parsertest.NewMemFS(map[string][]string{"/foo": names}, files)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parse(token.NewFileSet(), fs, "/foo", nil, 0); err != nil {
+			b.Fatal("ParseFSDir failed:", err)
+		}
+	}
+}
+
+func BenchmarkParseFSDir(b *testing.B) {
+	benchmarkParseFSDir(b, ParseFSDir)
+}
+
+func BenchmarkParseFSDirConcurrent(b *testing.B) {
+	benchmarkParseFSDir(b, ParseFSDirConcurrent)
+}
+
+// benchmarkParseDirManyFiles parses a local directory of thousands of files,
+// only one of which is a Go+ file, so that listing the directory dominates.
+func benchmarkParseDirManyFiles(b *testing.B, fs FileSystem) {
+	SetDebug(0)
+	defer SetDebug(DbgFlagAll)
+	dir := b.TempDir()
+	for i := 0; i < 5000; i++ {
+		if err := os.WriteFile(fmt.Sprintf("%s/f%04d.txt", dir, i), nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(dir+"/foo.gop", []byte("package foo\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if pkgs, err := ParseFSDir(token.NewFileSet(), fs, dir, nil, 0); err != nil || len(pkgs) != 1 {
+			b.Fatal("ParseFSDir failed:", err, pkgs)
+		}
+	}
+}
+
+func BenchmarkParseDirManyFiles(b *testing.B) {
+	benchmarkParseDirManyFiles(b, local)
+}
+
+func BenchmarkParseDirManyFilesReadDir(b *testing.B) {
+	// hide ReadDirEntries: the directory is listed by ReadDir
+	benchmarkParseDirManyFiles(b, struct{ FileSystem }{local})
+}
+
+// BenchmarkParseStringSources parses many small snippets given as strings,
+// as tools evaluating in-memory code do.
+func BenchmarkParseStringSources(b *testing.B) {
+	SetDebug(0)
+	defer SetDebug(DbgFlagAll)
+	srcs := make([]string, 10000)
+	for i := range srcs {
+		srcs[i] = fmt.Sprintf("package foo\n\nvar x%d = %d\n", i, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fset := token.NewFileSet()
+		for _, src := range srcs {
+			if _, err := ParseFile(fset, "/foo/bar.gop", src, 0); err != nil {
+				b.Fatal("ParseFile failed:", err)
+			}
+		}
+	}
+}
+
 // -----------------------------------------------------------------------------
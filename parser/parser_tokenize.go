@@ -0,0 +1,68 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"github.com/goplus/gop/scanner"
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+// Tokenize scans the source of a single Go+ source file and calls fn for each
+// of its tokens, comments included, until EOF, e.g. for a syntax highlighter
+// that needs no AST. The source is read like ParseFile does: a leading byte
+// order mark is stripped, and so is a leading `#!` line if the extension of
+// filename isn't a Go+ one (as the StripShebang mode does). The positions are
+// recorded in fset, which must not be nil.
+//
+// If the source couldn't be read, fn isn't called and the error is returned.
+// Otherwise the errors of the scanner, if any, are returned as a
+// scanner.ErrorList sorted by position; the scanner goes on after an error.
+func Tokenize(fset *token.FileSet, filename string, src interface{}, fn func(pos token.Pos, tok token.Token, lit string)) error {
+	var code []byte
+	var err error
+	if src == nil {
+		code, err = local.ReadFile(filename)
+	} else {
+		code, err = readSource(src)
+	}
+	if err != nil {
+		return err
+	}
+	code = stripBOM(code)
+	if _, isOk := lookupFileType(fileExt(filename)); !isOk {
+		code = stripShebang(code)
+	}
+	var errs scanner.ErrorList
+	var s scanner.Scanner
+	file := fset.AddFile(filename, -1, len(code))
+	s.Init(file, code, func(pos token.Position, msg string) {
+		errs.Add(pos, msg)
+	}, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		fn(pos, tok, lit)
+	}
+	errs.Sort()
+	return errs.Err()
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,55 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/goplus/gop/token"
+)
+
+// -----------------------------------------------------------------------------
+
+func TestTokenize(t *testing.T) {
+	fset := token.NewFileSet()
+	var toks []string
+	err := Tokenize(fset, "/foo/bar.gop", "\uFEFFx := 1 // one\nprintln x\n", func(pos token.Pos, tok token.Token, lit string) {
+		toks = append(toks, fmt.Sprintf("%v:%v:%q", fset.Position(pos).Column, tok, lit))
+	})
+	if err != nil {
+		t.Fatal("Tokenize failed:", err)
+	}
+	const expected = `1:IDENT:"x" 3::=:"" 6:INT:"1" 8:;:"\n" 8:COMMENT:"// one" 1:IDENT:"println" 9:IDENT:"x" 10:;:"\n"`
+	if ret := strings.Join(toks, " "); ret != expected {
+		t.Fatal("Tokenize failed:", ret)
+	}
+
+	toks = nil
+	err = Tokenize(fset, "/foo/bar", "#!/usr/bin/env gop\nx := 'ab'\n", func(pos token.Pos, tok token.Token, lit string) {
+		toks = append(toks, fmt.Sprintf("%v:%v", fset.Position(pos).Line, tok))
+	})
+	if err == nil || err.Error() != "/foo/bar:2:6: illegal rune literal" {
+		t.Fatal("Tokenize: err =", err)
+	}
+	if ret := strings.Join(toks, " "); ret != "2:IDENT 2::= 2:CHAR 2:;" {
+		t.Fatal("Tokenize failed:", ret)
+	}
+}
+
+// -----------------------------------------------------------------------------
@@ -18,12 +18,22 @@ package parser
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/goplus/gop/ast"
 	"github.com/goplus/gop/parser/parsertest"
@@ -51,6 +61,80 @@ func TestReadSource(t *testing.T) {
 	if _, err := readSource(0); err == nil {
 		t.Fatal("readSource int failed: no error?")
 	}
+	var code, data interface{} = "package foo\n", []byte("package foo\n")
+	if n := testing.AllocsPerRun(10, func() { readSource(code) }); n != 1 {
+		t.Fatal("readSource string: allocs =", n)
+	}
+	if n := testing.AllocsPerRun(10, func() { readSource(data) }); n != 0 {
+		t.Fatal("readSource []byte: allocs =", n)
+	}
+	text := "package foo\n"
+	_, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", &text, 0)
+	if !errors.Is(err, ErrInvalidSource) || err.Error() != "invalid source of type *string" {
+		t.Fatal("ParseFile *string: err =", err)
+	}
+	if e, ok := err.(*SourceTypeError); !ok || e.Type != reflect.TypeOf(&text) {
+		t.Fatal("ParseFile *string: not a SourceTypeError -", err)
+	}
+	if _, err = readAt(strings.NewReader(""), 0, -1); err != ErrInvalidSource {
+		t.Fatal("readAt negative size: err =", err)
+	}
+}
+
+type readerAtOnly struct {
+	r     *strings.Reader
+	calls int
+}
+
+func (p *readerAtOnly) Size() int64 { return p.r.Size() }
+
+func (p *readerAtOnly) ReadAt(b []byte, off int64) (int, error) {
+	p.calls++
+	return p.r.ReadAt(b, off)
+}
+
+func (p *readerAtOnly) Read(b []byte) (int, error) {
+	panic("readerAtOnly: Read called")
+}
+
+func TestReadSourceReaderAt(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("package foo\n\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&b, "var a%d = %d\n", i, i)
+	}
+	src := b.String()
+	r := &readerAtOnly{r: strings.NewReader(src)}
+	f, err := ParseFile(token.NewFileSet(), "/foo/big.gop", r, 0)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	if r.calls != 1 || len(f.Code) != len(src) || cap(f.Code) != len(src) {
+		t.Fatal("TestReadSourceReaderAt failed:", r.calls, len(f.Code), cap(f.Code))
+	}
+	if len(f.Decls) != 20000 {
+		t.Fatal("TestReadSourceReaderAt failed: len(f.Decls) =", len(f.Decls))
+	}
+
+	// a headless script is copied to inject the package clause and entrypoint
+	script := "x := 1\nprintln x\n"
+	r = &readerAtOnly{r: strings.NewReader(script)}
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", io.NewSectionReader(r, 0, r.Size()), 0)
+	if err != nil || !f.NoPkgDecl || !f.NoEntrypoint || r.calls != 1 {
+		t.Fatal("ParseFile failed:", err, r.calls)
+	}
+
+	// a reader already partly read is read from its current position on
+	sr := strings.NewReader("// header\npackage foo\n")
+	sr.Seek(10, io.SeekStart)
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", sr, 0)
+	if err != nil || string(f.Code) != "package foo\n" || sr.Len() != 0 {
+		t.Fatal("ParseFile (partly read) failed:", err, string(f.Code), sr.Len())
+	}
+
+	if _, err = readSource(io.NewSectionReader(strings.NewReader("abc"), 0, 5)); err != io.ErrUnexpectedEOF {
+		t.Fatal("readSource short ReaderAt: err =", err)
+	}
 }
 
 func TestParseFile(t *testing.T) {
@@ -60,6 +144,1480 @@ func TestParseFile(t *testing.T) {
 	}
 }
 
+func TestStat(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, "a.gop")
+	if err := ioutil.WriteFile(filename, []byte("println 1\n"), 0644); err != nil {
+		t.Fatal("WriteFile failed:", err)
+	}
+	mtime := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatal("Chtimes failed:", err)
+	}
+	fi, err := Stat(local, filename)
+	if err != nil || fi.Name() != "a.gop" || fi.Size() != 10 || !fi.ModTime().Equal(mtime) {
+		t.Fatal("Stat failed:", err, fi)
+	}
+	if _, err = Stat(local, path.Join(dir, "b.gop")); !os.IsNotExist(err) {
+		t.Fatal("Stat failed:", err)
+	}
+
+	fs := parsertest.NewSingleFileFS("/foo", "bar.gop", "println 1\n")
+	if fi, err = Stat(fs, "/foo/bar.gop"); err != nil || fi.Name() != "bar.gop" {
+		t.Fatal("Stat (ReadDir) failed:", err, fi)
+	}
+	if _, err = Stat(fs, "/foo/baz.gop"); !os.IsNotExist(err) {
+		t.Fatal("Stat (ReadDir) failed:", err)
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.gop": "package foo\n\nvar A = 1\n",
+		"b.gop": "package foo\n\nvar B = A\n",
+		"c.gop": "package bar\n\nvar C = 1\n",
+		"d.gop": "package bar\n\nvar = 1\n",
+	}
+	var filenames []string
+	for _, name := range []string{"a.gop", "b.gop", "c.gop", "d.gop", "e.gop"} {
+		filename := path.Join(dir, name)
+		if data, ok := files[name]; ok {
+			if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+				t.Fatal("WriteFile failed:", err)
+			}
+		}
+		filenames = append(filenames, filename)
+	}
+	pkgs, err := ParseFiles(token.NewFileSet(), filenames, 0)
+	if _, ok := err.(scanner.ErrorList); !ok {
+		t.Fatal("ParseFiles: unexpected error", err)
+	}
+	if len(pkgs) != 2 || len(pkgs["foo"].Files) != 2 || len(pkgs["bar"].Files) != 1 {
+		t.Fatal("ParseFiles failed:", pkgs)
+	}
+	if pkgs["foo"].Files[filenames[1]] == nil || pkgs["bar"].Files[filenames[2]] == nil {
+		t.Fatal("ParseFiles failed:", pkgs["foo"].Files, pkgs["bar"].Files)
+	}
+	if _, err = ParseFiles(token.NewFileSet(), filenames[4:], 0); !os.IsNotExist(err) {
+		t.Fatal("ParseFiles: unexpected error", err)
+	}
+}
+
+func TestParseFSFiles(t *testing.T) {
+	fs := parsertest.NewMemFS(nil, map[string]string{
+		"/foo/a.gop":     "package foo\n\nvar A = 1\n",
+		"/foo/sub/b.gop": "package foo\n\nvar B = A\n",
+		"/bar/c.gop":     "package bar\n\nvar = 1\n",
+		"/bar/d.gop":     "package bar\n\nvar D = 1\n",
+	})
+	filenames := []string{"/foo/a.gop", "/foo/sub/b.gop", "/bar/c.gop", "/bar/d.gop"}
+	pkgs, err := ParseFSFiles(token.NewFileSet(), fs, filenames, 0)
+	if errs, ok := err.(scanner.ErrorList); !ok || errs[0].Pos.Filename != "/bar/c.gop" {
+		t.Fatal("ParseFSFiles: unexpected error", err)
+	}
+	if len(pkgs) != 2 || len(pkgs["foo"].Files) != 2 || len(pkgs["bar"].Files) != 1 {
+		t.Fatal("ParseFSFiles failed:", pkgs)
+	}
+	if pkgs["foo"].Files["/foo/sub/b.gop"] == nil || pkgs["bar"].Files["/bar/d.gop"] == nil {
+		t.Fatal("ParseFSFiles failed:", pkgs["foo"].Files, pkgs["bar"].Files)
+	}
+}
+
+func TestAllowedImports(t *testing.T) {
+	const src = `import (
+	"fmt"
+	. "strings"
+	osx "os"
+)
+
+fmt.Println(ToUpper("Hi"), osx.Args)
+`
+	fset := token.NewFileSet()
+	if _, err := ParseFileConfig(fset, "/foo/bar.gop", src, &Config{}); err != nil {
+		t.Fatal("ParseFileConfig (nil policy) failed:", err)
+	}
+	allowed := map[string]bool{"fmt": true, "strings": true, "os": true}
+	if _, err := ParseFileConfig(fset, "/foo/bar.gop", src, &Config{AllowedImports: allowed}); err != nil {
+		t.Fatal("ParseFileConfig (allowed) failed:", err)
+	}
+	delete(allowed, "os")
+	_, err := ParseFileConfig(fset, "/foo/bar.gop", src, &Config{AllowedImports: allowed})
+	errs, ok := err.(scanner.ErrorList)
+	if !ok || len(errs) != 1 {
+		t.Fatal("ParseFileConfig (disallowed) failed:", err)
+	}
+	if e := errs[0]; e.Msg != `import "os" is not allowed` || e.Pos.Line != 4 || e.Pos.Column != 6 || e.Pos.Offset != 34 {
+		t.Fatal("ParseFileConfig (disallowed) failed:", e)
+	}
+	_, err = ParseFileConfig(fset, "/foo/bar.gop", src, &Config{AllowedImports: map[string]bool{}})
+	if errs, ok := err.(scanner.ErrorList); !ok || len(errs) != 3 {
+		t.Fatal("ParseFileConfig (allow nothing) failed:", err)
+	}
+
+	// the import of a headless script on its first line
+	_, err = ParseFileConfig(fset, "/foo/bar.gop", "import \"os\"\n\nprintln os.Args\n", &Config{AllowedImports: allowed})
+	if errs, ok := err.(scanner.ErrorList); !ok || len(errs) != 1 ||
+		errs[0].Pos.Line != 1 || errs[0].Pos.Column != 8 || errs[0].Pos.Offset != 7 {
+		t.Fatal("ParseFileConfig (headless) failed:", err)
+	}
+}
+
+func TestImportClassifier(t *testing.T) {
+	const src = `import (
+	"fmt"
+	_ "github.com/goplus/gop/ast"
+	osx "os"
+	. "example.com/foo/bar"
+)
+`
+	classify := func(path string) ast.ImportKind {
+		switch {
+		case strings.HasPrefix(path, "github.com/goplus/gop/"):
+			return ast.ImportLocal
+		case strings.Contains(path, "."):
+			return ast.ImportThirdParty
+		}
+		return ast.ImportStd
+	}
+	f, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, &Config{ImportClassifier: classify})
+	if err != nil {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	expected := []ast.ImportKind{ast.ImportStd, ast.ImportLocal, ast.ImportStd, ast.ImportThirdParty}
+	if len(f.Imports) != len(expected) {
+		t.Fatal("TestImportClassifier failed: len(f.Imports) =", len(f.Imports))
+	}
+	for i, spec := range f.Imports {
+		if spec.Kind != expected[i] {
+			t.Fatal("TestImportClassifier failed:", spec.Path.Value, spec.Kind)
+		}
+	}
+	f, _ = ParseFile(token.NewFileSet(), "/foo/bar.gop", src, 0)
+	if f.Imports[0].Kind != ast.ImportUnknown {
+		t.Fatal("TestImportClassifier failed: default kind =", f.Imports[0].Kind)
+	}
+}
+
+func TestParseFSDirConfig(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\nimport \"os\"\n",
+		"/foo/b.gop": "package foo\n\n" + strings.Repeat("var = 1\n", 15),
+	})
+	var msgs []string
+	cfg := &Config{MaxErrors: 3, ErrorHandler: func(pos token.Position, msg string) {
+		msgs = append(msgs, fmt.Sprintf("%d: %s", pos.Line, msg))
+	}}
+	pkgs, err := ParseFSDirConfig(token.NewFileSet(), fs, "/foo", nil, cfg)
+	if err == nil || len(pkgs["foo"].Files) != 1 {
+		t.Fatal("ParseFSDirConfig failed:", err, pkgs)
+	}
+	if errs := err.(scanner.ErrorList); len(errs) != 3 || len(msgs) != 3 || msgs[0] != "3: expected 'IDENT', found '='" {
+		t.Fatal("ParseFSDirConfig failed:", err, msgs)
+	}
+
+	_, err = ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if errs := err.(scanner.ErrorList); len(errs) != 11 {
+		t.Fatal("ParseFSDir failed: len(errs) =", len(errs))
+	}
+	_, err = ParseFSDirConfig(token.NewFileSet(), fs, "/foo", nil, &Config{Mode: AllErrors})
+	if errs := err.(scanner.ErrorList); len(errs) != 45 {
+		t.Fatal("ParseFSDirConfig failed: len(errs) =", len(errs))
+	}
+	_, err = ParseFSDirConfig(token.NewFileSet(), fs, "/foo", nil, &Config{Mode: AllErrors, MaxErrors: 12})
+	if errs := err.(scanner.ErrorList); len(errs) != 12 {
+		t.Fatal("ParseFSDirConfig failed: len(errs) =", len(errs))
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	var got []string
+	cfg := &Config{Mode: AllErrors, Logger: io.Discard, ErrorHandler: func(pos token.Position, msg string) {
+		got = append(got, fmt.Sprintf("%d:%d: %s", pos.Line, pos.Column, msg))
+	}}
+	for _, c := range []struct {
+		src  string
+		want string
+	}{
+		{"package foo\n\n" + strings.Repeat("var = 1\n", 5), "3:5: expected 'IDENT', found '='"},
+		// in the injected entrypoint
+		{"x := 1\ny := )\n", "2:6: expected operand, found ')'"},
+		// no statement, so no entrypoint to inject: parsed once
+		{"func f( {\n}\n", "1:9: expected type, found '{'"},
+		// at the end of the original source
+		{"package foo\n\nx := 1\nif x {\n", "5:1: expected '}', found 'EOF'"},
+	} {
+		got = nil
+		_, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", c.src, cfg)
+		errs, ok := err.(scanner.ErrorList)
+		if !ok || len(got) != len(errs) {
+			t.Fatal("ErrorHandler failed:", c.src, err, got)
+		}
+		var want []string
+		for _, e := range errs {
+			want = append(want, fmt.Sprintf("%d:%d: %s", e.Pos.Line, e.Pos.Column, e.Msg))
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal("ErrorHandler failed:", c.src, got, want)
+		}
+		if !strings.Contains(strings.Join(got, "\n"), c.want) {
+			t.Fatal("ErrorHandler failed:", c.src, got)
+		}
+	}
+
+	got = nil
+	cfg.MaxErrors = 2
+	src := "package foo\n\n" + strings.Repeat("var = 1\n", 5)
+	_, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg)
+	if errs, ok := err.(scanner.ErrorList); !ok || len(errs) != 2 || len(got) != 2 {
+		t.Fatal("ErrorHandler (MaxErrors) failed:", err, got)
+	}
+}
+
+// failingFS fails to read the file named fail.
+type failingFS struct {
+	FileSystem
+	fail string
+}
+
+func (p *failingFS) ReadFile(filename string) ([]byte, error) {
+	if filename == p.fail {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrPermission}
+	}
+	return p.FileSystem.ReadFile(filename)
+}
+
+func TestParseFSDirErrors(t *testing.T) {
+	fs := &failingFS{FileSystem: parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "c.gop", "d.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n",
+		"/foo/b.gop": "package foo\n",
+		"/foo/c.gop": "package foo\n\nfunc c( {\n",
+		"/foo/d.gop": "package foo\n",
+	}), fail: "/foo/b.gop"}
+	pkgs, errs, first := ParseFSDirErrors(token.NewFileSet(), fs, "/foo", nil, 0)
+	if len(errs) != 2 || first != errs["/foo/b.gop"] {
+		t.Fatal("ParseFSDirErrors failed:", errs, first)
+	}
+	if !errors.Is(errs["/foo/b.gop"], os.ErrPermission) {
+		t.Fatal("ParseFSDirErrors failed: b.gop:", errs["/foo/b.gop"])
+	}
+	if _, ok := errs["/foo/c.gop"].(scanner.ErrorList); !ok {
+		t.Fatal("ParseFSDirErrors failed: c.gop:", errs["/foo/c.gop"])
+	}
+	if files := pkgs["foo"].Files; len(files) != 2 || files["/foo/a.gop"] == nil || files["/foo/d.gop"] == nil {
+		t.Fatal("ParseFSDirErrors failed:", files)
+	}
+	if pkgs, errs, first = ParseFSDirErrors(token.NewFileSet(), fs, "/bar", nil, 0); pkgs != nil || errs != nil || first == nil {
+		t.Fatal("ParseFSDirErrors failed: /bar:", pkgs, errs, first)
+	}
+}
+
+func TestFilePattern(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"game_a.gop", "game_b.gop", "_game_c.gop", "game_d.txt", "main.gop"},
+	}, map[string]string{
+		"/foo/game_a.gop":  "package foo\n",
+		"/foo/game_b.gop":  "package foo\n",
+		"/foo/_game_c.gop": "package foo\n",
+		"/foo/game_d.txt":  "package foo\n",
+		"/foo/main.gop":    "package foo\n",
+	})
+	filter := func(d os.FileInfo) bool { return d.Name() != "game_b.gop" }
+	cfg := &Config{FilePattern: "game_*"}
+	pkgs, err := ParseFSDirConfig(token.NewFileSet(), fs, "/foo", filter, cfg)
+	if err != nil || len(pkgs) != 1 || len(pkgs["foo"].Files) != 1 || pkgs["foo"].Files["/foo/game_a.gop"] == nil {
+		t.Fatal("ParseFSDirConfig failed:", err, pkgs)
+	}
+	cfg.FilePattern = "test_*.gop"
+	if pkgs, err = ParseFSDirConfig(token.NewFileSet(), fs, "/foo", nil, cfg); err != nil || len(pkgs) != 0 {
+		t.Fatal("ParseFSDirConfig (no match) failed:", err, pkgs)
+	}
+	cfg.FilePattern = "game_["
+	if _, err = ParseFSDirConfig(token.NewFileSet(), fs, "/foo", nil, cfg); err != filepath.ErrBadPattern {
+		t.Fatal("ParseFSDirConfig (bad pattern): err =", err)
+	}
+}
+
+// joinFS is a MemFS whose paths are joined by join, such as a Windows-like
+// one separating them with backslashes whatever the OS.
+type joinFS struct {
+	*parsertest.MemFS
+	join func(elem ...string) string
+}
+
+func (p *joinFS) Join(elem ...string) string {
+	return p.join(elem...)
+}
+
+// shuffledFS lists the entries of a directory in a fixed pseudo-random order.
+type shuffledFS struct {
+	FileSystem
+	seed int
+}
+
+func (p *shuffledFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := p.FileSystem.ReadDir(dirname)
+	for i := len(list) - 1; i > 0; i-- {
+		j := (i*7 + p.seed) % (i + 1)
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, err
+}
+
+func TestParseFSDirOrder(t *testing.T) {
+	names := []string{"a.gop", "b.gop", "c.gop", "d.gop", "e.gop"}
+	files := map[string]string{
+		"/foo/a.gop": "package main\n",
+		"/foo/b.gop": "package main\n\nfunc b( {\n",
+		"/foo/c.gop": "package main\n",
+		"/foo/d.gop": "package main\n\nfunc d( {\n",
+		"/foo/e.gop": "package main\n",
+	}
+	for seed := 0; seed < 5; seed++ {
+		fs := &shuffledFS{FileSystem: parsertest.NewMemFS(map[string][]string{"/foo": names}, files), seed: seed}
+		pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+		if err == nil || !strings.HasPrefix(err.Error(), "/foo/b.gop:") {
+			t.Fatal("ParseFSDir: seed", seed, "first error =", err)
+		}
+		if n := len(pkgs["main"].Files); n != 3 {
+			t.Fatal("ParseFSDir: seed", seed, "files =", n)
+		}
+	}
+}
+
+func TestDuplicateFilePath(t *testing.T) {
+	// Join drops the extension: a.gop and a.spx collide
+	join := func(elem ...string) string {
+		name := path.Join(elem...)
+		return strings.TrimSuffix(name, path.Ext(name))
+	}
+	fs := &joinFS{parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "a.spx", "b.gop"},
+	}, map[string]string{
+		"/foo/a": "package foo\n",
+		"/foo/b": "package foo\n",
+	}), join}
+	for _, parse := range []func(*token.FileSet, FileSystem, string, func(os.FileInfo) bool, Mode) (map[string]*ast.Package, error){
+		ParseFSDir, ParseFSDirConcurrent,
+	} {
+		pkgs, err := parse(token.NewFileSet(), fs, "/foo", nil, 0)
+		if err == nil || err.Error() != "/foo/a: duplicate file path" {
+			t.Fatal("ParseFSDir: err =", err)
+		}
+		if len(pkgs["foo"].Files) != 2 {
+			t.Fatal("ParseFSDir failed:", pkgs["foo"].Files)
+		}
+	}
+}
+
+func TestJoinSeparator(t *testing.T) {
+	files := map[string]string{
+		"a.gop": "package foo\n\nfunc A() {}\n",
+		"b.spx": "println 1\n",
+		"c.txt": "not Go+ source",
+	}
+	for _, c := range []struct {
+		dir  string
+		join func(elem ...string) string
+	}{
+		{"/proj.v1/foo", path.Join},
+		{`C:\proj.v1\foo`, func(elem ...string) string { return strings.Join(elem, `\`) }},
+	} {
+		names, srcs := []string{}, map[string]string{}
+		for name, src := range files {
+			names = append(names, name)
+			srcs[c.join(c.dir, name)] = src
+		}
+		sort.Strings(names)
+		fs := &joinFS{parsertest.NewMemFS(map[string][]string{c.dir: names}, srcs), c.join}
+		pkgs, err := ParseFSDir(token.NewFileSet(), fs, c.dir, nil, 0)
+		if err != nil || len(pkgs) != 2 {
+			t.Fatal("ParseFSDir failed:", err, len(pkgs))
+		}
+		a, b := c.join(c.dir, "a.gop"), c.join(c.dir, "b.spx")
+		if f := pkgs["foo"].Files[a]; f == nil || f.FileType != ast.FileTypeGop {
+			t.Fatal("ParseFSDir failed:", a, pkgs["foo"].Files)
+		}
+		if f := pkgs["main"].Files[b]; f == nil || f.FileType != ast.FileTypeSpx || !f.NoEntrypoint {
+			t.Fatal("ParseFSDir failed:", b, pkgs["main"].Files)
+		}
+		if fi, err := Stat(fs, a); err != nil || fi.Name() != "a.gop" {
+			t.Fatal("Stat failed:", a, err)
+		}
+	}
+}
+
+func TestSplitGoFiles(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"foo.go", "bar.gop"},
+	}, map[string]string{
+		"/foo/foo.go":  "package foo\n\nfunc Foo() {}\n",
+		"/foo/bar.gop": "package foo\n\nfunc Bar() {}\n",
+	})
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, ParseGoFiles)
+	if err != nil || len(pkgs) != 1 || len(pkgs["foo"].Files) != 2 {
+		t.Fatal("ParseFSDir failed:", err, len(pkgs))
+	}
+	goFiles, gopFiles := SplitGoFiles(pkgs["foo"])
+	if len(goFiles) != 1 || goFiles["/foo/foo.go"] == nil {
+		t.Fatal("SplitGoFiles failed: goFiles", goFiles)
+	}
+	if len(gopFiles) != 1 || gopFiles["/foo/bar.gop"] == nil {
+		t.Fatal("SplitGoFiles failed: gopFiles", gopFiles)
+	}
+	pkgs, err = ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil || len(pkgs) != 1 {
+		t.Fatal("ParseFSDir failed:", err, len(pkgs))
+	}
+	if goFiles, gopFiles = SplitGoFiles(pkgs["foo"]); goFiles != nil || len(gopFiles) != 1 {
+		t.Fatal("SplitGoFiles failed:", goFiles, gopFiles)
+	}
+}
+
+func TestParseTestFiles(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"foo.gop", "foo_test.gop", "bar_test.gop", "_baz_test.gop"},
+	}, map[string]string{
+		"/foo/foo.gop":       "package foo\n",
+		"/foo/foo_test.gop":  "package foo\n",
+		"/foo/bar_test.gop":  "package foo_test\n",
+		"/foo/_baz_test.gop": "package foo\n",
+	})
+	names := func(pkg *ast.Package) string {
+		var ret []string
+		for filename := range pkg.Files {
+			ret = append(ret, path.Base(filename))
+		}
+		sort.Strings(ret)
+		return strings.Join(ret, " ")
+	}
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil || len(pkgs) != 2 {
+		t.Fatal("ParseFSDir failed:", err, len(pkgs))
+	}
+	if names(pkgs["foo"]) != "foo.gop foo_test.gop" || names(pkgs["foo_test"]) != "bar_test.gop" {
+		t.Fatal("ParseFSDir failed:", names(pkgs["foo"]), names(pkgs["foo_test"]))
+	}
+	pkgs, err = ParseFSDir(token.NewFileSet(), fs, "/foo", nil, ParseTestFiles)
+	if err != nil || len(pkgs) != 2 {
+		t.Fatal("ParseFSDir (ParseTestFiles) failed:", err, len(pkgs))
+	}
+	if names(pkgs["foo"]) != "foo.gop" || names(pkgs["foo_test"]) != "bar_test.gop foo_test.gop" {
+		t.Fatal("ParseFSDir (ParseTestFiles) failed:", names(pkgs["foo"]), names(pkgs["foo_test"]))
+	}
+	if pkgs["foo_test"].Name != "foo_test" {
+		t.Fatal("ParseFSDir (ParseTestFiles) failed: package name =", pkgs["foo_test"].Name)
+	}
+}
+
+func TestFileParsed(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "c.gop", "d.txt"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n",
+		"/foo/b.gop": "package foo\n\nvar b = )\n",
+		"/foo/c.gop": "package foo\n",
+		"/foo/d.txt": "not Go+ source",
+	})
+	var calls []string
+	cfg := &Config{FileParsed: func(filename string, f *ast.File, err error, elapsed time.Duration) {
+		if (f == nil) == (err == nil) || elapsed < 0 {
+			t.Fatal("FileParsed:", filename, f, err, elapsed)
+		}
+		calls = append(calls, fmt.Sprintf("%s:%v", filename, err != nil))
+	}}
+	pkgs, err := ParseFSDirConfig(token.NewFileSet(), fs, "/foo", nil, cfg)
+	if err == nil || len(pkgs["foo"].Files) != 2 {
+		t.Fatal("ParseFSDirConfig failed:", err, pkgs)
+	}
+	if ret := strings.Join(calls, " "); ret != "/foo/a.gop:false /foo/b.gop:true /foo/c.gop:false" {
+		t.Fatal("TestFileParsed failed:", ret)
+	}
+}
+
+type cancelFS struct {
+	FileSystem
+	cancel func()
+	reads  int
+}
+
+func (p *cancelFS) ReadFile(filename string) ([]byte, error) {
+	p.reads++
+	p.cancel()
+	return p.FileSystem.ReadFile(filename)
+}
+
+func TestParseFSDirContext(t *testing.T) {
+	base := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "c.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n",
+		"/foo/b.gop": "package foo\n",
+		"/foo/c.gop": "package foo\n",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &cancelFS{FileSystem: base, cancel: cancel}
+	pkgs, err := ParseFSDirContext(ctx, token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != context.Canceled || fs.reads != 1 {
+		t.Fatal("ParseFSDirContext failed:", err, fs.reads)
+	}
+	if len(pkgs) != 1 || len(pkgs["foo"].Files) != 1 || pkgs["foo"].Files["/foo/a.gop"] == nil {
+		t.Fatal("ParseFSDirContext failed:", pkgs)
+	}
+	if pkgs, err = ParseFSDirContext(context.Background(), token.NewFileSet(), base, "/foo", nil, 0); err != nil || len(pkgs["foo"].Files) != 3 {
+		t.Fatal("ParseFSDirContext failed:", err, pkgs)
+	}
+}
+
+func TestParseFSDirAll(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.gop", "c.gop", "d.gop"},
+	}, map[string]string{
+		"/foo/a.gop": "package foo\n\nvar = 1\n",
+		"/foo/b.gop": "package foo\n\nvar B = 1\n",
+		"/foo/c.gop": "package foo\n\nconst = 2\n",
+	})
+	pkgs, err := ParseFSDirAll(token.NewFileSet(), fs, "/foo", nil, 0)
+	if pkgs == nil || len(pkgs["foo"].Files) != 1 || pkgs["foo"].Files["/foo/b.gop"] == nil {
+		t.Fatal("ParseFSDirAll failed:", pkgs)
+	}
+	errs, ok := err.(scanner.ErrorList)
+	if !ok {
+		t.Fatal("ParseFSDirAll failed:", err)
+	}
+	var files []string
+	for _, e := range errs {
+		if n := len(files); n == 0 || files[n-1] != e.Pos.Filename {
+			files = append(files, e.Pos.Filename)
+		}
+	}
+	if !reflect.DeepEqual(files, []string{"/foo/a.gop", "/foo/c.gop", "/foo/d.gop"}) {
+		t.Fatal("ParseFSDirAll failed:", err)
+	}
+	if errs[0].Pos.Line != 3 || errs[len(errs)-1].Pos.Line != 0 {
+		t.Fatal("ParseFSDirAll failed:", err)
+	}
+
+	_, first := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if first.(scanner.ErrorList)[0].Pos.Filename != "/foo/a.gop" {
+		t.Fatal("ParseFSDir failed:", first)
+	}
+	if pkgs, err = ParseFSDirAll(token.NewFileSet(), fs, "/bar", nil, 0); pkgs != nil || err == nil {
+		t.Fatal("ParseFSDirAll failed:", pkgs, err)
+	}
+}
+
+func TestRegisterFileTypeConcurrent(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.spx"},
+	}, map[string]string{
+		"/foo/a.gop": "package main\n\nvar A = 1\n",
+		"/foo/b.spx": "println A\n",
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			ext := fmt.Sprintf(".race%d", i)
+			RegisterFileType(ext, ast.FileTypeSpx)
+			RegisterRawBlock(ext, "sql")
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0); err != nil {
+				t.Error("ParseFSDir failed:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if ft, ok := lookupFileType(".race7"); !ok || ft != ast.FileTypeSpx {
+		t.Fatal("RegisterFileType failed:", ft, ok)
+	}
+}
+
+func TestUnregisterFileType(t *testing.T) {
+	const src = "println 1\n"
+	RegisterFileType(".plug", ast.FileTypeSpx)
+	f, err := ParseFile(token.NewFileSet(), "/foo/bar.plug", src, 0)
+	if err != nil || f.FileType != ast.FileTypeSpx || entrypointDecl(f).Name.Name != "Main" {
+		t.Fatal("ParseFile failed:", err, f.FileType)
+	}
+	UnregisterFileType(".plug")
+	UnregisterFileType(".plug") // no-op
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.plug", src, 0)
+	if err != nil || f.FileType != ast.FileTypeGop || entrypointDecl(f).Name.Name != "main" {
+		t.Fatal("ParseFile failed:", err, f.FileType)
+	}
+	fs := parsertest.NewSingleFileFS("/foo", "bar.plug", src)
+	if pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0); err != nil || len(pkgs) != 0 {
+		t.Fatal("ParseFSDir failed:", err, pkgs)
+	}
+	RegisterFileType(".plug", ast.FileTypeGmx) // can be registered again
+	UnregisterFileType(".plug")
+
+	defer func() {
+		if e := recover(); e != "UnregisterFileType: can't unregister built-in file type .spx" {
+			t.Fatal("UnregisterFileType: unexpected", e)
+		}
+		if _, ok := lookupFileType(".spx"); !ok {
+			t.Fatal("UnregisterFileType: .spx removed")
+		}
+	}()
+	UnregisterFileType(".spx")
+}
+
+func TestRegisterFileTypeEx(t *testing.T) {
+	RegisterFileTypeEx(".foo", ast.FileTypeSpx, "func Run()")
+	defer UnregisterFileType(".foo")
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.foo", "x := 1\nprintln x\n", 0)
+	if err != nil || !f.NoEntrypoint || f.NoEntry_.Entry != "func Run()" {
+		t.Fatal("ParseFile failed:", err, f.NoEntry_)
+	}
+	entry := entrypointDecl(f)
+	if entry.Name.Name != "Run" || entry.Recv != nil || len(entry.Body.List) != 2 {
+		t.Fatal("ParseFile failed:", entry.Name.Name, entry.Recv, len(entry.Body.List))
+	}
+	if pos := fset.Position(entry.Body.List[1].Pos()); pos.Line != 2 {
+		t.Fatal("ParseFile failed:", pos)
+	}
+
+	RegisterFileTypeEx(".bar", ast.FileTypeGmx, "")
+	defer UnregisterFileType(".bar")
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.bar", "println 1\n", 0)
+	if err != nil || entrypointDecl(f).Name.Name != "MainEntry" {
+		t.Fatal("ParseFile failed:", err)
+	}
+}
+
+func TestRegisterFileTypeForce(t *testing.T) {
+	entry := func() string {
+		f, err := ParseFile(token.NewFileSet(), "/foo/bar.spc", "println 1\n", 0)
+		if err != nil {
+			t.Fatal("ParseFile failed:", err)
+		}
+		return entrypointDecl(f).Name.Name
+	}
+	if name := entry(); name != "MainEntry" {
+		t.Fatal("TestRegisterFileTypeForce: .spc entrypoint =", name)
+	}
+	defer RegisterFileTypeForce(".spc", ast.FileTypeGmx, "")
+	RegisterFileTypeForce(".spc", ast.FileTypeSpx, "")
+	if ft, _ := lookupFileType(".spc"); ft != ast.FileTypeSpx || entry() != "Main" {
+		t.Fatal("TestRegisterFileTypeForce: .spc not overridden as spx")
+	}
+	RegisterFileTypeForce(".spc", ast.FileTypeSpx, "func Run()")
+	if name := entry(); name != "Run" {
+		t.Fatal("TestRegisterFileTypeForce: .spc entrypoint =", name)
+	}
+	RegisterFileTypeForce(".spc", ast.FileTypeGmx, "")
+	if name := entry(); name != "MainEntry" {
+		t.Fatal("TestRegisterFileTypeForce: .spc entrypoint =", name)
+	}
+
+	defer func() {
+		if e := recover(); e != "RegisterFileTypeForce: can't override built-in file type .gop" {
+			t.Fatal("RegisterFileTypeForce: unexpected", e)
+		}
+	}()
+	RegisterFileTypeForce(".gop", ast.FileTypeSpx, "")
+}
+
+func TestDetectFileType(t *testing.T) {
+	for filename, want := range map[string]ast.FileType{
+		"/foo/bar.go": ast.FileTypeGo, "/foo/bar.gop": ast.FileTypeGop, "/foo/bar.spx": ast.FileTypeSpx,
+		"/foo/bar.gmx": ast.FileTypeGmx, "/foo/bar.spc": ast.FileTypeGmx, "/foo/bar.gop.go": ast.FileTypeGop,
+		"/foo/bar.spx.gz": ast.FileTypeSpx, "/foo/bar.txt": ast.FileTypeGop, "/foo/bar": ast.FileTypeGop,
+		"/foo/bar.rdft": ast.FileTypeGop,
+	} {
+		if ft := DetectFileType(filename); ft != want {
+			t.Fatal("DetectFileType failed:", filename, ft)
+		}
+	}
+	MustRegisterFileType(".rdft", ast.FileTypeSpx)
+	if ft := DetectFileType("/foo/bar.rdft"); ft != ast.FileTypeSpx {
+		t.Fatal("DetectFileType failed: registered .rdft", ft)
+	}
+	UnregisterFileType(".rdft")
+	if ft := DetectFileType("/foo/bar.rdft"); ft != ast.FileTypeGop {
+		t.Fatal("DetectFileType failed: unregistered .rdft", ft)
+	}
+}
+
+func TestRegisteredFileTypes(t *testing.T) {
+	fts := RegisteredFileTypes()
+	for ext, ft := range map[string]ast.FileType{
+		".go": ast.FileTypeGo, ".gop": ast.FileTypeGop, ".spx": ast.FileTypeSpx,
+		".gmx": ast.FileTypeGmx, ".spc": ast.FileTypeGmx,
+	} {
+		if v, ok := fts[ext]; !ok || v != ft {
+			t.Fatal("RegisteredFileTypes failed:", ext, v, ok)
+		}
+	}
+	if _, ok := fts[".regft"]; ok {
+		t.Fatal("RegisteredFileTypes failed: .regft registered")
+	}
+	delete(fts, ".gop") // a copy
+	if _, ok := lookupFileType(".gop"); !ok {
+		t.Fatal("RegisteredFileTypes failed: not a copy")
+	}
+
+	RegisterFileType(".regft", ast.FileTypeSpx)
+	defer UnregisterFileType(".regft")
+	if ft, ok := RegisteredFileTypes()[".regft"]; !ok || ft != ast.FileTypeSpx {
+		t.Fatal("RegisteredFileTypes failed: .regft =", ft, ok)
+	}
+}
+
+func TestParsePackageName(t *testing.T) {
+	for src, name := range map[string]string{
+		"package foo\n\nvar a = )\n":        "foo",
+		"// Doc\npackage main\n":            "main",
+		"import \"fmt\"\n\nfmt.Println 1\n": "main",
+		"":                                  "main",
+	} {
+		if ret, err := ParsePackageName(token.NewFileSet(), "/foo/bar.gop", src); err != nil || ret != name {
+			t.Fatalf("ParsePackageName(%q) = %q, %v\n", src, ret, err)
+		}
+	}
+	if _, err := ParsePackageName(token.NewFileSet(), "/foo/bar.gop", "package 1\n"); err == nil {
+		t.Fatal("ParsePackageName: no error for an invalid package clause")
+	}
+	if _, err := ParsePackageName(token.NewFileSet(), "/foo/nonexistent.gop", nil); err == nil {
+		t.Fatal("ParsePackageName: no error for a missing file")
+	}
+}
+
+func TestParseImports(t *testing.T) {
+	fset := token.NewFileSet()
+	specs, err := ParseImports(fset, "/foo/a.gop", "package foo\n\nimport (\n\t\"fmt\"\n\tosx \"os\"\n)\n\nvar = 1\n")
+	if err != nil || len(specs) != 2 || specs[1].Name.Name != "osx" {
+		t.Fatal("ParseImports failed:", err, specs)
+	}
+	if pos := fset.Position(specs[1].Path.Pos()); pos.Line != 5 || pos.Column != 6 {
+		t.Fatal("ParseImports failed:", pos)
+	}
+
+	const script = "import \"fmt\"; import \"strings\"\n\nfmt.Println strings.ToUpper(\"hi\")\n"
+	specs, err = ParseImports(fset, "/foo/b.gop", script)
+	if err != nil || len(specs) != 2 {
+		t.Fatal("ParseImports failed:", err, specs)
+	}
+	for i, col := range []int{8, 22} {
+		pos := fset.Position(specs[i].Path.Pos())
+		if pos.Filename != "/foo/b.gop" || pos.Line != 1 || pos.Column != col {
+			t.Fatal("ParseImports failed:", pos)
+		}
+		if end := fset.Position(specs[i].End()); script[pos.Offset:end.Offset] != specs[i].Path.Value {
+			t.Fatal("ParseImports failed:", pos, end)
+		}
+	}
+
+	if specs, err = ParseImports(fset, "/foo/c.gop", "println 1\n"); err != nil || len(specs) != 0 {
+		t.Fatal("ParseImports failed:", err, specs)
+	}
+	if _, err = ParseImports(fset, "/foo/d.gop", "import \"fmt\n"); err == nil {
+		t.Fatal("ParseImports: no error")
+	} else if e := err.(scanner.ErrorList)[0]; e.Pos.Line != 1 || e.Pos.Column != 8 {
+		t.Fatal("ParseImports failed:", e)
+	}
+}
+
+func TestParseFSDirRecursive(t *testing.T) {
+	fs := NewFSAdapter(fstest.MapFS{
+		"src/main.gop":           {Data: []byte("println 1\n")},
+		"src/util/a.gop":         {Data: []byte("package util\n\nvar A = 1\n")},
+		"src/util/a_test.gop":    {Data: []byte("package util_test\n")},
+		"src/util/x.txt":         {Data: []byte("not Go+")},
+		"src/util/deep/b.gop":    {Data: []byte("package deep\n\nvar B = 1\n")},
+		"src/util/deep/c.gop":    {Data: []byte("package deep\n\nvar = 1\n")},
+		"src/empty/README":       {Data: []byte("nothing")},
+		"src/_skip/d.gop":        {Data: []byte("package skip\n")},
+		"src/.hidden/e.gop":      {Data: []byte("package hidden\n")},
+		"src/util/_data/f.gop":   {Data: []byte("package data\n")},
+		"src/util/deep/.git/g.x": {Data: []byte("")},
+	})
+	dirs, err := ParseFSDirRecursive(token.NewFileSet(), fs, "src", nil, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "src/util/deep/c.gop:3:5") {
+		t.Fatal("ParseFSDirRecursive: unexpected error", err)
+	}
+	if len(dirs) != 3 || len(dirs["src"]) != 1 || len(dirs["src/util"]) != 2 || len(dirs["src/util/deep"]) != 1 {
+		t.Fatal("ParseFSDirRecursive failed:", dirs)
+	}
+	if dirs["src/util"]["util_test"] == nil || len(dirs["src/util/deep"]["deep"].Files) != 1 {
+		t.Fatal("ParseFSDirRecursive failed:", dirs["src/util"], dirs["src/util/deep"])
+	}
+
+	filter := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.gop") && fi.Name() != "c.gop"
+	}
+	if dirs, err = ParseFSDirRecursive(token.NewFileSet(), fs, "src", filter, 0); err != nil || len(dirs["src/util"]) != 1 {
+		t.Fatal("ParseFSDirRecursive failed:", err, dirs)
+	}
+	if dirs, err = ParseFSDirRecursive(token.NewFileSet(), fs, "nosuch", nil, 0); err == nil || dirs != nil {
+		t.Fatal("ParseFSDirRecursive failed:", err, dirs)
+	}
+}
+
+func TestParseFSDirFileType(t *testing.T) {
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gop", "b.spx", "c.gmx", "d.go", "e.txt"},
+	}, map[string]string{
+		"/foo/a.gop": "package main\n",
+		"/foo/b.spx": "println 1\n",
+		"/foo/c.gmx": "println 2\n",
+		"/foo/d.go":  "package main\n",
+		"/foo/e.txt": "package main\n",
+	})
+	var seen []string
+	pkgs, err := ParseFSDirFileType(token.NewFileSet(), fs, "/foo", func(fi os.FileInfo, ft ast.FileType) bool {
+		seen = append(seen, fi.Name())
+		return ft == ast.FileTypeSpx || ft == ast.FileTypeGmx
+	}, 0)
+	if err != nil {
+		t.Fatal("ParseFSDirFileType failed:", err)
+	}
+	if files := pkgs["main"].Files; len(files) != 2 || files["/foo/b.spx"] == nil || files["/foo/c.gmx"] == nil {
+		t.Fatal("ParseFSDirFileType failed:", files)
+	}
+	if !reflect.DeepEqual(seen, []string{"a.gop", "b.spx", "c.gmx"}) {
+		t.Fatal("ParseFSDirFileType filter called for:", seen)
+	}
+	if pkgs, err = ParseFSDirFileType(token.NewFileSet(), fs, "/foo", nil, ParseGoFiles); err != nil || len(pkgs["main"].Files) != 4 {
+		t.Fatal("ParseFSDirFileType (nil filter) failed:", err, pkgs)
+	}
+}
+
+func TestParseFSDirRecursiveFilter(t *testing.T) {
+	fs := &countingFS{FileSystem: NewFSAdapter(fstest.MapFS{
+		"src/main.gop":      {Data: []byte("println 1\n")},
+		"src/util/a.gop":    {Data: []byte("package util\n")},
+		"src/vendor/b.gop":  {Data: []byte("package vendor\n")},
+		"src/.hidden/c.gop": {Data: []byte("package hidden\n")},
+		"src/_data/d.gop":   {Data: []byte("package data\n")},
+	}), reads: make(map[string]int)}
+	var seen []string
+	dirFilter := func(dirname string, d os.FileInfo) bool {
+		seen = append(seen, dirname)
+		return d.Name() != "vendor" && !strings.HasPrefix(d.Name(), ".")
+	}
+	dirs, err := ParseFSDirRecursiveFilter(token.NewFileSet(), fs, "src", dirFilter, nil, 0)
+	if err != nil || len(dirs) != 3 || dirs["src/util"] == nil || dirs["src/_data"] == nil {
+		t.Fatal("ParseFSDirRecursiveFilter failed:", err, dirs)
+	}
+	if strings.Join(seen, " ") != "src/.hidden src/_data src/util src/vendor" {
+		t.Fatal("ParseFSDirRecursiveFilter failed: dirFilter called for", seen)
+	}
+	for _, name := range []string{"src/vendor", "src/vendor/b.gop", "src/.hidden", "src/.hidden/c.gop"} {
+		if fs.reads[name] != 0 {
+			t.Fatal("ParseFSDirRecursiveFilter: pruned directory read", name)
+		}
+	}
+	dirs, err = ParseFSDirRecursiveFilter(token.NewFileSet(), fs, "src", nil, nil, 0)
+	if err != nil || len(dirs) != 3 || dirs["src/vendor"] == nil || dirs["src/_data"] != nil {
+		t.Fatal("ParseFSDirRecursiveFilter (default) failed:", err, dirs)
+	}
+}
+
+func TestParseFSDirConcurrent(t *testing.T) {
+	var names []string
+	files := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("f%02d.gop", i)
+		names = append(names, name)
+		switch {
+		case i%20 == 7:
+			files["/foo/"+name] = "package foo\n\nvar = 1\n"
+		case i%2 == 0:
+			files["/foo/"+name] = fmt.Sprintf("package foo\n\nvar V%d = %d\n", i, i)
+		default:
+			files["/foo/"+name] = fmt.Sprintf("package bar\n\nvar V%d = %d\n", i, i)
+		}
+	}
+	fs := parsertest.NewMemFS(map[string][]string{"/foo": names}, files)
+	pkgs, err := ParseFSDirConcurrent(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "/foo/f07.gop:3:5") {
+		t.Fatal("ParseFSDirConcurrent: unexpected error", err)
+	}
+	expected, first := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if first.Error() != err.Error() || len(pkgs) != 2 {
+		t.Fatal("ParseFSDirConcurrent failed:", first, pkgs)
+	}
+	for name, pkg := range expected {
+		if len(pkgs[name].Files) != len(pkg.Files) {
+			t.Fatal("ParseFSDirConcurrent failed:", name, len(pkgs[name].Files), len(pkg.Files))
+		}
+		for filename := range pkg.Files {
+			if pkgs[name].Files[filename] == nil {
+				t.Fatal("ParseFSDirConcurrent: file not found -", filename)
+			}
+		}
+	}
+	if pkgs, err = ParseFSDirConcurrent(token.NewFileSet(), fs, "/bar", nil, 0); err == nil || pkgs != nil {
+		t.Fatal("ParseFSDirConcurrent failed:", err, pkgs)
+	}
+}
+
+func TestDisableAutoEntry(t *testing.T) {
+	const script = "package main\n\nimport \"fmt\"\n\nfmt.Println 1\n"
+	f, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", script, 0)
+	if err != nil || !f.NoEntrypoint || entrypointDecl(f) == nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", script, DisableAutoEntry)
+	if err == nil || f.NoEntrypoint || !strings.HasPrefix(err.Error(), "/foo/bar.gop:5:1: expected declaration") {
+		t.Fatal("ParseFile (DisableAutoEntry) failed:", err)
+	}
+
+	const headless = "var a = 1\n"
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", headless, DisableAutoEntry)
+	if err != nil || !f.NoPkgDecl || f.NoEntrypoint {
+		t.Fatal("ParseFile (DisableAutoEntry) failed:", err)
+	}
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", headless, DisableAutoPkgDecl)
+	if err == nil || f.NoPkgDecl || !strings.HasPrefix(err.Error(), "/foo/bar.gop:1:1: expected 'package'") {
+		t.Fatal("ParseFile (DisableAutoPkgDecl) failed:", err)
+	}
+}
+
+func TestHeadlessStatements(t *testing.T) {
+	cases := []struct {
+		src   string
+		stmts int
+		line  int
+	}{
+		{"// say hello\nx := 1\ny := 2\nprintln x + y\n", 3, 2},
+		{"import \"fmt\"\n\nfunc add(a, b int) int {\n\treturn a + b\n}\n\nfunc() {\n\tfmt.Println(add(1, 2))\n}()\nprintln 3\n", 2, 7},
+		{"func() { println(1) }()\nprintln 2\n", 2, 1},
+		{"type T int\n\nfunc (a T) + (b T) T {\n\treturn a\n}\n\nfunc (a T) String() string {\n\treturn \"T\"\n}\n\n/* sum */ println T(1) + T(2)\nprintln T(3)\n", 2, 11},
+	}
+	for _, c := range cases {
+		fset := token.NewFileSet()
+		// no debug output: the panic on a missing ',' breaks the detection
+		cfg := &Config{Mode: ParseComments, Logger: io.Discard}
+		f, err := ParseFileConfig(fset, "/foo/bar.gop", c.src, cfg)
+		if err != nil || !f.NoEntrypoint {
+			t.Fatal("ParseFile failed:", err)
+		}
+		entry := entrypointDecl(f)
+		if entry == nil || len(entry.Body.List) != c.stmts {
+			t.Fatal("TestHeadlessStatements failed: entrypoint =", entry)
+		}
+		if pos, _ := f.AdjustPos_(fset.Position(entry.Body.List[0].Pos())); pos.Line != c.line {
+			t.Fatal("TestHeadlessStatements failed: first statement at", pos)
+		}
+		if int(entry.Body.Rbrace-f.FileStart) != len(f.Code)-1 {
+			t.Fatal("TestHeadlessStatements failed: entrypoint doesn't end at EOF")
+		}
+	}
+}
+
+func TestStrictFileType(t *testing.T) {
+	const src = "println 1\n"
+	f, err := ParseFile(token.NewFileSet(), "/foo/bar.txt", src, 0)
+	if err != nil || f.FileType != ast.FileTypeGop || !f.NoEntrypoint {
+		t.Fatal("ParseFile failed:", err)
+	}
+	_, err = ParseFile(token.NewFileSet(), "/foo/bar.txt", src, StrictFileType)
+	if !errors.Is(err, ErrUnknownFileType) || err.Error() != "parse /foo/bar.txt: unknown file type" {
+		t.Fatal("ParseFile (StrictFileType): err =", err)
+	}
+	fs := parsertest.NewSingleFileFS("/foo", "bar.txt", src)
+	if _, err = ParseFSFile(token.NewFileSet(), fs, "/foo/bar.txt", nil, StrictFileType); !errors.Is(err, ErrUnknownFileType) {
+		t.Fatal("ParseFSFile (StrictFileType): err =", err)
+	}
+	if _, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", src, StrictFileType); err != nil {
+		t.Fatal("ParseFile (StrictFileType) failed:", err)
+	}
+}
+
+func TestDeclarationsOnly(t *testing.T) {
+	const src = `import "fmt"
+
+type T struct{ a int }
+
+var f = func() {
+	fmt.Println(T{1})
+}
+
+func (t *T) Get() int {
+	if t.a > 0 { return t.a; } // a comment with {
+	return 0 +
+}
+
+func add(a, b int) int {
+	return a + b
+}
+
+add 1, 2
+`
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.gop", src, DeclarationsOnly)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	if !f.NoPkgDecl || !f.NoEntrypoint || len(f.Decls) != 6 {
+		t.Fatal("ParseFile failed:", f.NoPkgDecl, f.NoEntrypoint, len(f.Decls))
+	}
+	var names []string
+	for _, decl := range f.Decls[3:] {
+		fn := decl.(*ast.FuncDecl)
+		names = append(names, fn.Name.Name)
+		if len(fn.Body.List) != 0 {
+			t.Fatal("ParseFile failed: body of", fn.Name.Name, "=", fn.Body.List)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"Get", "add", "main"}) {
+		t.Fatal("ParseFile failed:", names)
+	}
+	add := f.Decls[4].(*ast.FuncDecl)
+	if len(add.Type.Params.List) != 1 || len(add.Type.Params.List[0].Names) != 2 || add.Type.Results == nil {
+		t.Fatal("ParseFile failed: signature of add")
+	}
+	if pos := fset.Position(add.Body.Rbrace); pos.Line != 16 || pos.Column != 1 {
+		t.Fatal("ParseFile failed: add.Body.Rbrace =", pos)
+	}
+	lit := f.Decls[2].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Values[0].(*ast.FuncLit)
+	if len(lit.Body.List) != 0 || !lit.Body.Rbrace.IsValid() {
+		t.Fatal("ParseFile failed: func literal body =", lit.Body)
+	}
+
+	// the syntax error in Get is only reported when bodies are parsed
+	if _, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", src, 0); err == nil {
+		t.Fatal("ParseFile: no error")
+	}
+}
+
+func TestRecoverErrors(t *testing.T) {
+	const src = "package main\n\nfunc A() {}\n\nfunc B() {\n\tx := 1\n\ty := 1 +\n\tprintln x\n}\n"
+	cfg := &Config{Mode: RecoverErrors, Logger: io.Discard}
+	f, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, cfg)
+	if err == nil || f == nil || f.FileType != ast.FileTypeGop {
+		t.Fatal("ParseFile failed:", err, f)
+	}
+	var names []string
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			names = append(names, fn.Name.Name)
+		}
+	}
+	if strings.Join(names, " ") != "A B" || len(f.Decls[1].(*ast.FuncDecl).Body.List) == 0 {
+		t.Fatal("ParseFile (RecoverErrors) failed:", names)
+	}
+
+	const script = "import \"fmt\"\n\nfunc A() {}\n\nx := 1\ny := )\nfmt.Println x\n"
+	fset := token.NewFileSet()
+	f, err = ParseFileConfig(fset, "/foo/bar.gop", script, cfg)
+	if err == nil || f == nil || !f.NoPkgDecl || !f.NoEntrypoint {
+		t.Fatal("ParseFile (script) failed:", err, f)
+	}
+	if fn, ok := f.Decls[1].(*ast.FuncDecl); !ok || fn.Name.Name != "A" || entrypointDecl(f) == nil {
+		t.Fatal("ParseFile (script) failed:", f.Decls)
+	}
+	if file := fset.File(f.FileStart); file == nil || file.Name() != "/foo/bar.gop" {
+		t.Fatal("ParseFile (script) failed: not positioned in fset")
+	}
+
+	const headless = "var a = 1\nvar b = )\n"
+	fset = token.NewFileSet()
+	f, err = ParseFileConfig(fset, "/foo/bar.gop", headless, cfg)
+	if err == nil || f == nil || !f.NoPkgDecl || f.NoEntrypoint || len(f.Decls) != 2 {
+		t.Fatal("ParseFile (headless) failed:", err, f)
+	}
+	if fset.File(f.FileStart) == nil {
+		t.Fatal("ParseFile (headless) failed: not positioned in fset")
+	}
+}
+
+func TestParseFileType(t *testing.T) {
+	f, err := ParseFileType(token.NewFileSet(), "/foo/bar.txt", "println 1\n", 0, ast.FileTypeSpx)
+	if err != nil || f.FileType != ast.FileTypeSpx || !f.NoEntrypoint || f.NoEntry_.Entry != "func Main()" {
+		t.Fatal("ParseFileType failed:", err, f)
+	}
+	if entry := entrypointDecl(f); entry == nil || entry.Name.Name != "Main" {
+		t.Fatal("ParseFileType failed: entrypoint =", entry)
+	}
+	f, err = ParseFileType(token.NewFileSet(), "/foo/bar.spx", "println 1\n", 0, ast.FileTypeGop)
+	if err != nil || f.FileType != ast.FileTypeGop || f.NoEntry_.Entry != "func main()" {
+		t.Fatal("ParseFileType failed:", err, f)
+	}
+}
+
+func TestMultiDotExt(t *testing.T) {
+	for name, want := range map[string]string{
+		"foo.gop.go": ".gop.go", "foo.go": ".go", "foo.spx.go": ".go", "/a.b/foo.gop.go.gz": ".gop.go",
+	} {
+		if ext := fileExt(name); ext != want {
+			t.Fatal("fileExt failed:", name, ext)
+		}
+	}
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"foo.gop.go", "foo.go", "foo.spx.go"},
+	}, map[string]string{
+		"/foo/foo.gop.go": "println \"gop\"\n",
+		"/foo/foo.go":     "package main\n",
+		"/foo/foo.spx.go": "package main\n",
+	})
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	if files := pkgs["main"].Files; len(files) != 1 || files["/foo/foo.gop.go"].FileType != ast.FileTypeGop {
+		t.Fatal("ParseFSDir failed:", files)
+	}
+
+	MustRegisterFileType(".spx.go", ast.FileTypeSpx)
+	defer UnregisterFileType(".spx.go")
+	pkgs, err = ParseFSDir(token.NewFileSet(), fs, "/foo", nil, ParseGoFiles)
+	if err != nil {
+		t.Fatal("ParseFSDir failed:", err)
+	}
+	files := pkgs["main"].Files
+	if len(files) != 3 || files["/foo/foo.gop.go"].FileType != ast.FileTypeGop ||
+		files["/foo/foo.go"].FileType != ast.FileTypeGo || files["/foo/foo.spx.go"].FileType != ast.FileTypeSpx {
+		t.Fatal("ParseFSDir failed:", files)
+	}
+}
+
+func TestGoFileMetadata(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.go", "package main\n\nfunc main() {\n}\n", ParseGoFiles)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	if f.FileType != ast.FileTypeGo || f.NoPkgDecl || f.NoEntrypoint || f.NoEntry_ != nil {
+		t.Fatal("ParseFile failed:", f.FileType, f.NoPkgDecl, f.NoEntrypoint, f.NoEntry_)
+	}
+	f, err = ParseFile(fset, "/foo/bar.go", "println 1\n", ParseGoFiles)
+	if err != nil {
+		t.Fatal("ParseFile failed:", err)
+	}
+	if f.FileType != ast.FileTypeGo || !f.NoPkgDecl || !f.NoEntrypoint || f.NoEntry_ == nil {
+		t.Fatal("ParseFile (headless) failed:", f.FileType, f.NoPkgDecl, f.NoEntrypoint, f.NoEntry_)
+	}
+}
+
+func TestEntrypointConflict(t *testing.T) {
+	cases := []struct {
+		filename, src, err string
+	}{
+		{"/foo/bar.spx", "func Main() {\n}\n\nprintln 1\n", "/foo/bar.spx:4:1: statements outside of func Main, which is already declared"},
+		{"/foo/bar.spx", "println 1\n\nfunc Main() {\n}\n", "/foo/bar.spx:1:1: statements outside of func Main, which is already declared"},
+		{"/foo/bar.gop", "package main\n\nfunc main() {\n}\n\nprintln 1\n", "/foo/bar.gop:6:1: statements outside of func main, which is already declared"},
+	}
+	for _, c := range cases {
+		cfg := &Config{Logger: io.Discard}
+		if _, err := ParseFileConfig(token.NewFileSet(), c.filename, c.src, cfg); err == nil || err.Error() != c.err {
+			t.Fatal("ParseFile failed:", c.src, err)
+		}
+	}
+	// Main is a method of the class, not the entrypoint of a script
+	f, err := ParseFile(token.NewFileSet(), "/foo/bar.gop", "func (t T) Main() {\n}\n\nprintln 1\n", 0)
+	if err != nil || !f.NoEntrypoint {
+		t.Fatal("ParseFile failed:", err)
+	}
+	// a package may have several init functions
+	f, err = ParseFile(token.NewFileSet(), "/foo/bar.gop", "package foo\n\nfunc init() {\n}\n\nprintln 1\n", 0)
+	if err != nil || !f.NoEntrypoint || entrypointDecl(f).Name.Name != "init" {
+		t.Fatal("ParseFile failed:", err)
+	}
+}
+
+func TestConfigParseFile(t *testing.T) {
+	const script = "x := 1\nprintln x\n"
+	fs := parsertest.NewSingleFileFS("/foo", "bar.script", script)
+	cfg := &Config{FileSystem: fs, DefaultFileType: ast.FileTypeSpx}
+	f, err := cfg.ParseFile(token.NewFileSet(), "/foo/bar.script", nil)
+	if err != nil || f.FileType != ast.FileTypeSpx || entrypointDecl(f).Name.Name != "Main" {
+		t.Fatal("Config.ParseFile failed:", err)
+	}
+	cfg.Mode |= DisableAutoEntry
+	f, err = cfg.ParseFile(token.NewFileSet(), "/foo/bar.script", nil)
+	if err == nil || f.NoEntrypoint || !strings.HasPrefix(err.Error(), "/foo/bar.script:1:1: expected declaration") {
+		t.Fatal("Config.ParseFile (DisableAutoEntry) failed:", err)
+	}
+	if _, err = cfg.ParseFile(token.NewFileSet(), "/foo/missing.gop", nil); err == nil {
+		t.Fatal("Config.ParseFile: no error for a missing file")
+	}
+
+	// a zero Config is the default one
+	f, err = new(Config).ParseFile(token.NewFileSet(), "/foo/bar.script", script)
+	if err != nil || f.FileType != ast.FileTypeGop || entrypointDecl(f).Name.Name != "main" {
+		t.Fatal("Config.ParseFile (zero Config) failed:", err)
+	}
+}
+
+func TestParseGzipFile(t *testing.T) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte("import \"fmt\"\n\nfmt.Println 1\n"))
+	w.Close()
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.spx.gz", b.Bytes(), 0)
+	if err != nil || !f.NoPkgDecl || !f.NoEntrypoint || f.FileType != ast.FileTypeSpx {
+		t.Fatal("ParseFile failed:", err, f.FileType)
+	}
+	entry := entrypointDecl(f)
+	if entry.Name.Name != "Main" || len(entry.Body.List) != 1 {
+		t.Fatal("ParseFile failed: entrypoint", entry.Name.Name)
+	}
+	if pos, _ := f.AdjustPos_(fset.Position(entry.Body.List[0].Pos())); pos.Line != 3 || pos.Column != 1 {
+		t.Fatal("ParseFile failed: statement at", pos)
+	}
+
+	fs := parsertest.NewSingleFileFS("/foo", "bar.gop.gz", b.String())
+	if f, err = ParseFSFile(token.NewFileSet(), fs, "/foo/bar.gop.gz", nil, 0); err != nil || entrypointDecl(f).Name.Name != "main" {
+		t.Fatal("ParseFSFile failed:", err)
+	}
+	if _, err = ParseFile(token.NewFileSet(), "/foo/bar.gop.gz", "not gzipped", 0); err != gzip.ErrHeader {
+		t.Fatal("ParseFile (not gzipped): err =", err)
+	}
+}
+
+func TestStripShebang(t *testing.T) {
+	src := []byte("#!/usr/bin/env gop\nimport \"fmt\"\n\nfmt.Println(\"Hi\")\n")
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/hello", src, ParseComments|StripShebang)
+	if err != nil || !f.NoPkgDecl || !f.NoEntrypoint || f.FileType != ast.FileTypeGop {
+		t.Fatal("ParseFile failed:", err, f.NoPkgDecl, f.NoEntrypoint, f.FileType)
+	}
+	if len(f.Comments) != 0 || src[0] != '#' {
+		t.Fatal("TestStripShebang failed: shebang not stripped or source modified")
+	}
+	var println *ast.Ident
+	ast.Inspect(f, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && ident.Name == "Println" {
+			println = ident
+		}
+		return true
+	})
+	if pos, _ := f.AdjustPos_(fset.Position(println.Pos())); pos.Line != 4 || pos.Column != 5 {
+		t.Fatal("TestStripShebang failed: position of Println =", pos)
+	}
+
+	// a known extension keeps the shebang line (a comment)
+	f, err = ParseFile(token.NewFileSet(), "/foo/hello.gop", src, ParseComments|StripShebang)
+	if err != nil || len(f.Comments) != 1 {
+		t.Fatal("ParseFile (.gop) failed:", err, len(f.Comments))
+	}
+	// without StripShebang
+	f, err = ParseFile(token.NewFileSet(), "/foo/hello", src, ParseComments)
+	if err != nil || len(f.Comments) != 1 {
+		t.Fatal("ParseFile (no StripShebang) failed:", err, len(f.Comments))
+	}
+}
+
+func TestConfigLogger(t *testing.T) {
+	const src = "package foo\n\nfunc bar() {\n\tprintln(1 + 2)\n}\n"
+	var verbose, silent bytes.Buffer
+	var wg sync.WaitGroup
+	for i, cfg := range []*Config{
+		{Logger: &verbose, DebugFlags: DbgFlagAll},
+		{Logger: &silent},
+	} {
+		wg.Add(1)
+		go func(i int, cfg *Config) {
+			defer wg.Done()
+			filename := fmt.Sprintf("/foo/bar%d.gop", i)
+			if _, err := ParseFileConfig(token.NewFileSet(), filename, src, cfg); err != nil {
+				t.Error("ParseFileConfig failed:", err)
+			}
+		}(i, cfg)
+	}
+	wg.Wait()
+	if !strings.Contains(verbose.String(), "ast.FuncDecl{Name: bar, ...}") {
+		t.Fatal("TestConfigLogger failed: verbose output =", verbose.String())
+	}
+	if silent.Len() != 0 {
+		t.Fatal("TestConfigLogger failed: silent output =", silent.String())
+	}
+}
+
+func TestIdentRewriter(t *testing.T) {
+	const src = `import "fmt"
+
+type foo struct {
+	foo int
+}
+
+foo := &foo{foo: 1}
+fmt.Println foo.foo
+`
+	var seen []string
+	rename := func(name string, pos token.Position) (string, bool) {
+		seen = append(seen, name)
+		if name == "foo" && pos.Line == 3 {
+			return "Foo", true
+		}
+		return "", false
+	}
+	f, err := ParseFileConfig(token.NewFileSet(), "/foo/bar.gop", src, &Config{IdentRewriter: rename})
+	if err != nil {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	if strings.Join(seen, " ") != "foo foo int foo foo foo foo foo" {
+		t.Fatal("TestIdentRewriter failed: seen =", seen)
+	}
+	if name := f.Decls[1].(*ast.GenDecl).Specs[0].(*ast.TypeSpec).Name; name.Name != "Foo" || name.Pos() == token.NoPos {
+		t.Fatal("TestIdentRewriter failed:", name.Name, name.Pos())
+	}
+	var foos int
+	ast.Inspect(f, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && ident.Name == "foo" {
+			foos++
+		}
+		return true
+	})
+	if foos != 6 || f.Name.Name != "main" || entrypointDecl(f).Name.Name != "main" {
+		t.Fatal("TestIdentRewriter failed:", foos, f.Name.Name)
+	}
+}
+
+func TestMethodEntry(t *testing.T) {
+	RegisterFileType(".mcls", ast.FileTypeSpx)
+	RegisterMethodEntry(".mcls", "")
+	RegisterFileType(".mgam", ast.FileTypeGmx)
+	RegisterMethodEntry(".mgam", "Game")
+	cases := []struct {
+		filename, recv string
+	}{
+		{"/foo/Hero.mcls", "this *Hero"},
+		{"/foo/index.mgam", "this *Game"},
+	}
+	const src = "this.x = 1\nprintln this.x\n"
+	for _, c := range cases {
+		f, err := ParseFile(token.NewFileSet(), c.filename, src, 0)
+		if err != nil || !f.NoEntrypoint || f.NoEntry_.Recv != c.recv {
+			t.Fatal("TestMethodEntry failed:", c.filename, err, f.NoEntry_)
+		}
+		fn := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+		if fn.Name.Name != "Main" || fn.Recv == nil || fn.Recv.List[0].Names[0].Name != "this" || len(fn.Body.List) != 2 {
+			t.Fatal("TestMethodEntry failed:", c.filename, fn.Name.Name)
+		}
+		if offset := f.ByteOffset(fn.Body.List[1].Pos()); offset != 11 {
+			t.Fatal("TestMethodEntry failed: offset =", offset)
+		}
+	}
+	defer func() {
+		if e := recover(); e == nil {
+			t.Fatal("RegisterMethodEntry: no panic for .gop")
+		}
+	}()
+	RegisterMethodEntry(".gop", "")
+}
+
+func TestKeywordAliases(t *testing.T) {
+	const src = `package foo
+
+函数 Foo(n int) int {
+	return n
+}
+`
+	fset := token.NewFileSet()
+	cfg := &Config{KeywordAliases: map[string]token.Token{"函数": token.FUNC}}
+	f, err := ParseFileConfig(fset, "/foo/bar.gop", src, cfg)
+	if err != nil || len(f.Decls) != 1 {
+		t.Fatal("ParseFileConfig failed:", err)
+	}
+	fn, ok := f.Decls[0].(*ast.FuncDecl)
+	if !ok || fn.Name.Name != "Foo" {
+		t.Fatal("ParseFileConfig failed: unexpected decl", f.Decls[0])
+	}
+	if pos := fset.Position(fn.Type.Func); pos.Line != 3 || pos.Column != 1 {
+		t.Fatal("ParseFileConfig failed: func at", pos)
+	}
+}
+
+func TestIsPureGo(t *testing.T) {
+	cases := []struct {
+		src  string
+		pure bool
+	}{
+		{"package foo\n\nfunc Foo() int {\n\treturn 1\n}\n", true},
+		{"package main\n\nfunc main() {\n\tprintln \"Hi\"\n}\n", false},
+		{"package foo\n\nvar a = [1, 2, 3]\n", false},
+		{"println(\"Hi\")\n", false},
+		{"package foo\n\nx := 1\n", false},
+	}
+	for _, c := range cases {
+		pure, err := IsPureGo([]byte(c.src))
+		if err != nil || pure != c.pure {
+			t.Fatal("IsPureGo failed:", c.src, pure, err)
+		}
+	}
+}
+
+func TestRawBlock(t *testing.T) {
+	RegisterRawBlock(".rawtest", "shader")
+	const src = `var a = 1
+
+shader {
+	void main() { gl_FragColor = vec4(1.0); }
+	\} escaped
+}
+
+println a
+`
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "/foo/bar.rawtest", src, 0)
+	if err != nil || len(f.Decls) != 3 {
+		t.Fatal("ParseFile failed:", err)
+	}
+	raw, ok := f.Decls[1].(*ast.RawBlock)
+	if !ok || raw.Kind != "shader" {
+		t.Fatal("ParseFile failed: not a raw block -", f.Decls[1])
+	}
+	if raw.Text != "\n\tvoid main() { gl_FragColor = vec4(1.0); }\n\t\\} escaped\n" {
+		t.Fatalf("ParseFile failed: raw text = %q\n", raw.Text)
+	}
+	if pos, _ := f.AdjustPos_(fset.Position(raw.Pos())); pos.Line != 3 || pos.Column != 1 {
+		t.Fatal("ParseFile failed: raw block at", pos)
+	}
+	if pos := fset.Position(raw.Rbrace); pos.Line != 6 || pos.Column != 1 {
+		t.Fatal("ParseFile failed: raw block ends at", pos)
+	}
+	if _, ok := f.Decls[2].(*ast.FuncDecl); !ok || !f.NoEntrypoint {
+		t.Fatal("ParseFile failed: no entrypoint")
+	}
+	if _, err = ParseFile(fset, "/foo/bar.rawtest", "shader { {\n", 0); err == nil {
+		t.Fatal("ParseFile failed: no error?")
+	}
+}
+
+func TestTopLevelScanner(t *testing.T) {
+	RegisterRawBlock(".rawtest", "shader")
+	const src = `shader {
+	func main() \{
+}
+
+func (t *T) Main() {
+	shader { \} }
+}
+
+x := func() int { return 1 }()
+`
+	cfg := new(Config)
+	if off, ok := firstStmtOffset("/foo/bar.rawtest", []byte(src), cfg); !ok || src[off:off+2] != "x " {
+		t.Fatal("firstStmtOffset failed:", off, ok)
+	}
+	if off, ok := firstStmtOffset("/foo/bar.rawtest", []byte("shader\n"), cfg); !ok || off != 0 {
+		t.Fatal("firstStmtOffset (not a raw block) failed:", off, ok)
+	}
+	if hasFuncDecl("/foo/bar.rawtest", []byte(src), cfg, "main", false) {
+		t.Fatal("hasFuncDecl: func main declared in a raw block")
+	}
+	if !hasFuncDecl("/foo/bar.rawtest", []byte(src), cfg, "Main", true) {
+		t.Fatal("hasFuncDecl: method Main not found")
+	}
+}
+
 func testFrom(t *testing.T, pkgDir, sel string, exclude Mode) {
 	if sel != "" && !strings.Contains(pkgDir, sel) {
 		return
@@ -117,14 +1675,25 @@ func TestFromTestdata(t *testing.T) {
 }
 
 func TestRegisterFileType(t *testing.T) {
-	RegisterFileType(".gsh", ast.FileTypeSpx)
+	if err := RegisterFileType(".gsh", ast.FileTypeSpx); err != nil {
+		t.Fatal("RegisterFileType failed:", err)
+	}
+	if err := RegisterFileType(".gsh", ast.FileTypeGmx); err == nil || err.Error() != "RegisterFileType: file type .gsh exists (FileTypeSpx)" {
+		t.Fatal("RegisterFileType: err =", err)
+	}
+	if err := RegisterFileType(".spx", ast.FileTypeGmx); err == nil || err.Error() != "RegisterFileType: file type .spx exists (FileTypeSpx)" {
+		t.Fatal("RegisterFileType: err =", err)
+	}
+	if ft, _ := lookupFileType(".gsh"); ft != ast.FileTypeSpx {
+		t.Fatal("RegisterFileType: file type replaced", ft)
+	}
 	func() {
 		defer func() {
 			if e := recover(); e == nil {
 				t.Fatal("TestRegisterFileType failed: no error?")
 			}
 		}()
-		RegisterFileType(".gshx", ast.FileTypeGop)
+		RegisterFileType(".gshx", ast.FileType(100))
 	}()
 	func() {
 		defer func() {
@@ -132,8 +1701,37 @@ func TestRegisterFileType(t *testing.T) {
 				t.Fatal("TestRegisterFileType failed: no error?")
 			}
 		}()
-		RegisterFileType(".gsh", ast.FileTypeGmx)
+		MustRegisterFileType(".gsh", ast.FileTypeGmx)
 	}()
 }
 
+func TestRegisterFileTypeGop(t *testing.T) {
+	MustRegisterFileType(".gshs", ast.FileTypeGop)
+	defer UnregisterFileType(".gshs")
+	f, err := ParseFile(token.NewFileSet(), "/foo/bar.gshs", "import \"os\"\n\nprintln os.Args\n", 0)
+	if err != nil || f.FileType != ast.FileTypeGop || !f.NoPkgDecl || f.NoEntry_.Entry != "func main()" {
+		t.Fatal("ParseFile failed:", err, f)
+	}
+	if entry := entrypointDecl(f); entry == nil || entry.Name.Name != "main" || len(entry.Body.List) != 1 {
+		t.Fatal("ParseFile failed: entrypoint =", entry)
+	}
+
+	MustRegisterFileType(".gshg", ast.FileTypeGo)
+	defer UnregisterFileType(".gshg")
+	fs := parsertest.NewMemFS(map[string][]string{
+		"/foo": {"a.gshs", "b.gshg"},
+	}, map[string]string{
+		"/foo/a.gshs": "println 1\n",
+		"/foo/b.gshg": "package main\n",
+	})
+	pkgs, err := ParseFSDir(token.NewFileSet(), fs, "/foo", nil, 0)
+	if err != nil || len(pkgs["main"].Files) != 1 {
+		t.Fatal("ParseFSDir failed:", err, pkgs)
+	}
+	pkgs, err = ParseFSDir(token.NewFileSet(), fs, "/foo", nil, ParseGoFiles)
+	if err != nil || len(pkgs["main"].Files) != 2 || pkgs["main"].Files["/foo/b.gshg"].FileType != ast.FileTypeGo {
+		t.Fatal("ParseFSDir failed:", err, pkgs)
+	}
+}
+
 // -----------------------------------------------------------------------------
@@ -1989,6 +1989,9 @@ func (p *printer) decl(decl ast.Decl) {
 		p.genDecl(d)
 	case *ast.FuncDecl:
 		p.funcDecl(d)
+	case *ast.RawBlock:
+		p.print(d.Pos(), &ast.Ident{Name: d.Kind}, blank)
+		p.print(&ast.BasicLit{ValuePos: d.Lbrace, Kind: token.STRING, Value: "{" + d.Text + "}"})
 	default:
 		panic("unreachable")
 	}
@@ -48,6 +48,11 @@ type Scanner struct {
 
 	// public state - ok to modify
 	ErrorCount int // number of errors encountered
+
+	// KeywordAliases maps an alias lexeme to the keyword token it stands
+	// for (e.g. to support a localized keyword set). It is not reset by
+	// Init; set it after calling Init.
+	KeywordAliases map[string]token.Token
 }
 
 const bom = 0xFEFF // byte order mark, only permitted as very first character
@@ -720,6 +725,39 @@ func (s *Scanner) scanRawString() string {
 	return string(lit)
 }
 
+// ScanRawBlock scans the raw text of a block whose opening "{" was the last
+// token returned by Scan, up to the matching "}". Nested pairs of braces are
+// part of the text, and a brace escaped by a backslash (`\{` or `\}`) isn't
+// counted; escapes are kept verbatim. It returns the text and the position
+// of the closing "}". If the block isn't terminated, an error is reported
+// and ok is false.
+//
+func (s *Scanner) ScanRawBlock() (text string, rbrace token.Pos, ok bool) {
+	offs := s.offset
+	depth := 0
+	for s.ch >= 0 {
+		switch s.ch {
+		case '\\':
+			s.next() // skip the escaped char
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				text, rbrace = string(s.src[offs:s.offset]), s.file.Pos(s.offset)
+				s.next()
+				s.insertSemi = true
+				return text, rbrace, true
+			}
+			depth--
+		}
+		if s.ch >= 0 {
+			s.next()
+		}
+	}
+	s.error(offs, "raw block not terminated")
+	return string(s.src[offs:s.offset]), s.file.Pos(s.offset), false
+}
+
 func (s *Scanner) skipWhitespace() {
 	for s.ch == ' ' || s.ch == '\t' || s.ch == '\n' && !s.insertSemi || s.ch == '\r' {
 		s.next()
@@ -814,14 +852,18 @@ scanAgain:
 		if len(lit) > 1 {
 			// keywords are longer than one letter - avoid lookup otherwise
 			tok = token.Lookup(lit)
-			switch tok {
-			case token.IDENT, token.BREAK, token.CONTINUE, token.FALLTHROUGH, token.RETURN:
-				insertSemi = true
-			}
 		} else {
-			insertSemi = true
 			tok = token.IDENT
 		}
+		if tok == token.IDENT && s.KeywordAliases != nil {
+			if alias, ok := s.KeywordAliases[lit]; ok {
+				tok = alias
+			}
+		}
+		switch tok {
+		case token.IDENT, token.BREAK, token.CONTINUE, token.FALLTHROUGH, token.RETURN:
+			insertSemi = true
+		}
 	case isDecimal(ch) || ch == '.' && isDecimal(rune(s.peek())):
 		insertSemi = true
 		tok, lit = s.scanNumber()